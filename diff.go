@@ -0,0 +1,256 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import "strconv"
+
+// ChangeKind identifies the kind of difference described by a Change.
+type ChangeKind int
+
+const (
+	// ElementAdded indicates an element present only in the second tree.
+	ElementAdded ChangeKind = iota
+
+	// ElementRemoved indicates an element present only in the first tree.
+	ElementRemoved
+
+	// AttrAdded indicates an attribute present only on the second tree's
+	// element.
+	AttrAdded
+
+	// AttrRemoved indicates an attribute present only on the first tree's
+	// element.
+	AttrRemoved
+
+	// AttrModified indicates an attribute whose value differs between the
+	// two trees.
+	AttrModified
+
+	// TextModified indicates an element whose text differs between the two
+	// trees.
+	TextModified
+
+	// TailModified indicates an element whose tail text, the text following
+	// its end tag, differs between the two trees.
+	TailModified
+)
+
+// String returns a short description of the change kind.
+func (k ChangeKind) String() string {
+	switch k {
+	case ElementAdded:
+		return "element added"
+	case ElementRemoved:
+		return "element removed"
+	case AttrAdded:
+		return "attribute added"
+	case AttrRemoved:
+		return "attribute removed"
+	case AttrModified:
+		return "attribute modified"
+	case TextModified:
+		return "text modified"
+	case TailModified:
+		return "tail modified"
+	default:
+		return "ChangeKind(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+// A Change describes a single difference between two element trees, as
+// reported by Diff.
+type Change struct {
+	Kind     ChangeKind
+	Path     string // path of the affected element
+	Attr     string // full key of the affected attribute, if any
+	OldValue string // value in the first tree, if any
+	NewValue string // value in the second tree, if any
+}
+
+// Diff compares the element trees rooted at a and b and returns the list of
+// changes required to turn a into b. Child elements are aligned by full tag
+// and position, so the n-th child named "x" in a is compared with the n-th
+// child named "x" in b. Attributes are aligned by their full keys.
+//
+// Each change's Path is an absolute path starting with the tag of a or b.
+// When a and b are root elements, or documents, the path may be used with
+// FindElement on the tree containing the element. A positional filter is
+// included when an element has siblings with the same tag, and an unprefixed
+// tag is written as *[name()='tag'] when it has siblings with the same local
+// name and a namespace prefix, which the plain tag would also match.
+//
+// An element's text and the tail text following each of its child elements
+// are compared separately. Text consisting only of whitespace is treated as
+// empty, so differences in indentation are not reported. If a and b are
+// identical, Diff returns nil.
+func Diff(a, b *Element) []Change {
+	var changes []Change
+	switch {
+	case a == nil && b == nil:
+		return nil
+	case a == nil:
+		return append(changes, Change{Kind: ElementAdded, Path: rootPath(b)})
+	case b == nil:
+		return append(changes, Change{Kind: ElementRemoved, Path: rootPath(a)})
+	case a.FullTag() != b.FullTag():
+		changes = append(changes, Change{Kind: ElementRemoved, Path: rootPath(a)})
+		return append(changes, Change{Kind: ElementAdded, Path: rootPath(b)})
+	}
+	return diffElements(changes, a, b, rootPath(a))
+}
+
+// rootPath returns the path used to identify the element at the top of a
+// diffed tree.
+func rootPath(e *Element) string {
+	if e.Tag == "" {
+		return "/"
+	}
+	return "/" + e.FullTag()
+}
+
+// diffElements appends the changes between elements a and b, which share
+// the same tag and are identified by path, to the changes list.
+func diffElements(changes []Change, a, b *Element, path string) []Change {
+	// Compare attributes.
+	for _, attr := range a.Attr {
+		key := attr.FullKey()
+		if other := findAttr(b, attr.Space, attr.Key); other == nil {
+			changes = append(changes, Change{Kind: AttrRemoved, Path: path, Attr: key, OldValue: attr.Value})
+		} else if other.Value != attr.Value {
+			changes = append(changes, Change{Kind: AttrModified, Path: path, Attr: key, OldValue: attr.Value, NewValue: other.Value})
+		}
+	}
+	for _, attr := range b.Attr {
+		if findAttr(a, attr.Space, attr.Key) == nil {
+			changes = append(changes, Change{Kind: AttrAdded, Path: path, Attr: attr.FullKey(), NewValue: attr.Value})
+		}
+	}
+
+	// Compare text.
+	atext, btext := diffText(a.Text()), diffText(b.Text())
+	if atext != btext {
+		changes = append(changes, Change{Kind: TextModified, Path: path, OldValue: atext, NewValue: btext})
+	}
+
+	// Align child elements by tag and position.
+	achildren, bchildren := a.ChildElements(), b.ChildElements()
+	acount, bcount := tagCounts(achildren), tagCounts(bchildren)
+	prefixed := prefixedTags(achildren, bchildren)
+	prefix := path
+	if prefix == "/" {
+		prefix = ""
+	}
+	childPath := func(tag string, n int) string {
+		step := tag
+		if prefixed[tag] {
+			step = "*[name()='" + tag + "']"
+		}
+		if acount[tag] > 1 || bcount[tag] > 1 {
+			step += "[" + strconv.Itoa(n) + "]"
+		}
+		return prefix + "/" + step
+	}
+
+	aseen := make(map[string]int)
+	for _, ac := range achildren {
+		tag := ac.FullTag()
+		aseen[tag]++
+		n := aseen[tag]
+		if n > bcount[tag] {
+			changes = append(changes, Change{Kind: ElementRemoved, Path: childPath(tag, n)})
+			continue
+		}
+		bc := nthChildElement(bchildren, tag, n)
+		changes = diffElements(changes, ac, bc, childPath(tag, n))
+		atail, btail := diffText(ac.Tail()), diffText(bc.Tail())
+		if atail != btail {
+			changes = append(changes, Change{Kind: TailModified, Path: childPath(tag, n), OldValue: atail, NewValue: btail})
+		}
+	}
+
+	bseen := make(map[string]int)
+	for _, bc := range bchildren {
+		tag := bc.FullTag()
+		bseen[tag]++
+		n := bseen[tag]
+		if n <= acount[tag] {
+			continue
+		}
+		changes = append(changes, Change{Kind: ElementAdded, Path: childPath(tag, n)})
+	}
+
+	return changes
+}
+
+// findAttr returns the element's attribute with exactly the namespace
+// prefix 'space' and key 'key', or nil if there is none.
+func findAttr(e *Element, space, key string) *Attr {
+	for i, a := range e.Attr {
+		if a.Space == space && a.Key == key {
+			return &e.Attr[i]
+		}
+	}
+	return nil
+}
+
+// diffText returns the text for comparison, treating whitespace-only text
+// as empty.
+func diffText(text string) string {
+	if isWhitespace(text) {
+		return ""
+	}
+	return text
+}
+
+// prefixedTags returns the set of unprefixed tags whose local names are
+// shared by a prefixed element in either list of elements.
+func prefixedTags(a, b []*Element) map[string]bool {
+	var prefixed map[string]bool
+	for _, list := range [][]*Element{a, b} {
+		for _, e := range list {
+			if e.Space != "" {
+				if prefixed == nil {
+					prefixed = make(map[string]bool)
+				}
+				prefixed[e.Tag] = false
+			}
+		}
+	}
+	if prefixed == nil {
+		return nil
+	}
+	tags := make(map[string]bool)
+	for _, list := range [][]*Element{a, b} {
+		for _, e := range list {
+			if _, ok := prefixed[e.Tag]; ok && e.Space == "" {
+				tags[e.Tag] = true
+			}
+		}
+	}
+	return tags
+}
+
+// tagCounts returns the number of elements with each full tag.
+func tagCounts(elements []*Element) map[string]int {
+	counts := make(map[string]int)
+	for _, e := range elements {
+		counts[e.FullTag()]++
+	}
+	return counts
+}
+
+// nthChildElement returns the n-th element (starting from 1) with the
+// requested full tag.
+func nthChildElement(elements []*Element, tag string, n int) *Element {
+	for _, e := range elements {
+		if e.FullTag() == tag {
+			n--
+			if n == 0 {
+				return e
+			}
+		}
+	}
+	return nil
+}
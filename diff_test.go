@@ -0,0 +1,90 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	a := newDocumentFromString(t, `<root>
+	<book id="1" lang="en">
+		<title>Old Title</title>
+		<author>A</author>
+	</book>
+	<book id="2">
+		<title>Same</title>
+	</book>
+	<note>remove me</note>
+</root>`)
+	b := newDocumentFromString(t, `<root><book id="1" year="2005"><title>New Title</title><author>A</author></book><book id="3"><title>Same</title></book><book id="4"/><extra/></root>`)
+
+	expected := []Change{
+		{Kind: AttrRemoved, Path: "/root/book[1]", Attr: "lang", OldValue: "en"},
+		{Kind: AttrAdded, Path: "/root/book[1]", Attr: "year", NewValue: "2005"},
+		{Kind: TextModified, Path: "/root/book[1]/title", OldValue: "Old Title", NewValue: "New Title"},
+		{Kind: AttrModified, Path: "/root/book[2]", Attr: "id", OldValue: "2", NewValue: "3"},
+		{Kind: ElementRemoved, Path: "/root/note"},
+		{Kind: ElementAdded, Path: "/root/book[3]"},
+		{Kind: ElementAdded, Path: "/root/extra"},
+	}
+
+	changes := Diff(&a.Element, &b.Element)
+	checkIntEq(t, len(changes), len(expected))
+	for i := 0; i < len(changes) && i < len(expected); i++ {
+		if changes[i] != expected[i] {
+			t.Errorf("etree: change %d mismatch:\n  expected: %+v\n  got:      %+v", i, expected[i], changes[i])
+		}
+	}
+
+	// Paths must locate the changed elements in their trees.
+	if e := a.FindElement("/root/note"); e == nil {
+		t.Error("etree: removed element path not found in first tree")
+	}
+	if e := b.FindElement("/root/book[3]"); e == nil || e.SelectAttrValue("id", "") != "4" {
+		t.Error("etree: added element path not found in second tree")
+	}
+
+	if changes := Diff(a.Root(), a.Root().Copy()); changes != nil {
+		t.Errorf("etree: expected no changes, got %+v", changes)
+	}
+
+	changes = Diff(a.Root(), b.FindElement("//title"))
+	checkIntEq(t, len(changes), 2)
+	checkStrEq(t, changes[0].Kind.String(), "element removed")
+	checkStrEq(t, changes[0].Path, "/root")
+	checkStrEq(t, changes[1].Kind.String(), "element added")
+	checkStrEq(t, changes[1].Path, "/title")
+}
+
+func TestDiffExact(t *testing.T) {
+	// Attributes are matched by their exact keys.
+	a := newDocumentFromString(t, `<r x:id="1"/>`)
+	b := newDocumentFromString(t, `<r id="1"/>`)
+	changes := Diff(a.Root(), b.Root())
+	checkIntEq(t, len(changes), 2)
+	checkStrEq(t, changes[0].Kind.String(), "attribute removed")
+	checkStrEq(t, changes[0].Attr, "x:id")
+	checkStrEq(t, changes[1].Kind.String(), "attribute added")
+	checkStrEq(t, changes[1].Attr, "id")
+
+	// Text following child elements is compared.
+	a = newDocumentFromString(t, `<p>Hello <b>big</b> world</p>`)
+	b = newDocumentFromString(t, `<p>Hello <b>big</b> there</p>`)
+	changes = Diff(a.Root(), b.Root())
+	checkIntEq(t, len(changes), 1)
+	checkStrEq(t, changes[0].Kind.String(), "tail modified")
+	checkStrEq(t, changes[0].Path, "/p/b")
+	checkStrEq(t, changes[0].OldValue, " world")
+	checkStrEq(t, changes[0].NewValue, " there")
+
+	// Paths of unprefixed elements don't match prefixed siblings.
+	a = newDocumentFromString(t, `<r><x:a/><a id="1"/></r>`)
+	b = newDocumentFromString(t, `<r><x:a/><a id="2"/></r>`)
+	changes = Diff(a.Root(), b.Root())
+	checkIntEq(t, len(changes), 1)
+	checkStrEq(t, changes[0].Path, "/r/*[name()='a']")
+	if e := b.FindElement(changes[0].Path); e == nil || e.SelectAttrValue("id", "") != "2" {
+		t.Errorf("etree: path %s doesn't locate the modified element", changes[0].Path)
+	}
+}
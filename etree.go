@@ -12,8 +12,10 @@ import (
 	"encoding/xml"
 	"errors"
 	"io"
+	"net/url"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 )
 
@@ -26,10 +28,107 @@ const (
 // ErrXML is returned when XML parsing fails due to incorrect formatting.
 var ErrXML = errors.New("etree: invalid XML format")
 
+// ErrDocument is returned by Document.Validate when a document violates
+// document-level well-formedness rules.
+type ErrDocument string
+
+// Error returns the string describing a document error.
+func (err ErrDocument) Error() string {
+	return "etree: " + string(err)
+}
+
+// EndTagError is returned when ReadSettings.StrictEndTags is true and XML
+// parsing encounters an end tag that doesn't match the most recently opened
+// element. It wraps ErrXML.
+type EndTagError struct {
+	Expected string // full tag of the open element, or "" if none is open
+	Actual   string // full tag of the end tag encountered
+	Offset   int64  // input offset following the end tag
+}
+
+// Error returns the string describing the end tag error.
+func (err *EndTagError) Error() string {
+	if err.Expected == "" {
+		return "etree: unexpected end tag </" + err.Actual + ">"
+	}
+	return "etree: mismatched end tag: expected </" + err.Expected +
+		">, found </" + err.Actual + ">"
+}
+
+// Unwrap returns ErrXML.
+func (err *EndTagError) Unwrap() error {
+	return ErrXML
+}
+
+// ParseError is returned when the XML decoder reports a syntax error while
+// parsing XML input. It wraps the decoder's error, and it identifies where in
+// the input the error occurred.
+type ParseError struct {
+	Offset  int64  // input offset at which the error was detected
+	Line    int    // line number of the error, starting at 1
+	Column  int    // column number of the error, starting at 1
+	Excerpt string // the line of input surrounding the error, if available
+	Err     error  // the underlying error
+}
+
+// Error returns the string describing the parse error. It is the underlying
+// error's message, followed by the column and the excerpt when an excerpt is
+// available.
+func (err *ParseError) Error() string {
+	s := err.Err.Error()
+	if err.Excerpt != "" {
+		s += " (column " + strconv.Itoa(err.Column) + ", near " +
+			strconv.Quote(err.Excerpt) + ")"
+	}
+	return s
+}
+
+// Unwrap returns the underlying error.
+func (err *ParseError) Unwrap() error {
+	return err.Err
+}
+
+// ErrInvalidChar is returned by a Document's WriteTo* functions when
+// WriteSettings.ErrorOnInvalidChar is true and a character outside the range
+// of legal XML characters is found in the tokens to be written.
+var ErrInvalidChar = errors.New("etree: invalid XML character")
+
+// ErrComment is returned when a comment's text would produce an invalid XML
+// comment.
+var ErrComment = errors.New("etree: invalid comment text")
+
+// ErrMaxBytes is returned by a Document's WriteTo* functions when the
+// serialized document would exceed WriteSettings.MaxBytes bytes.
+var ErrMaxBytes = errors.New("etree: document exceeds maximum output size")
+
+// ErrInvalidName is returned when a string isn't a legal XML name.
+var ErrInvalidName = errors.New("etree: invalid XML name")
+
+// ErrDeclaration is returned by Document.SetDeclaration when a field of
+// the declaration holds a value that isn't allowed in an XML declaration.
+var ErrDeclaration = errors.New("etree: invalid XML declaration")
+
+// ErrDocTypeID is returned by Document.CreateDocType when a public
+// identifier contains characters not allowed in one, or a system identifier
+// contains both single and double quotes.
+var ErrDocTypeID = errors.New("etree: invalid DOCTYPE identifier")
+
+// ErrIndentString is returned by Document.IndentWith when the indentation
+// string contains characters other than spaces and tabs.
+var ErrIndentString = errors.New("etree: indent string must contain only spaces and tabs")
+
 // cdataPrefix is used to detect CDATA text when ReadSettings.PreserveCData is
 // true.
 var cdataPrefix = []byte("<![CDATA[")
 
+// byteOrderMark is the UTF-8 encoding of the Unicode byte order mark, which
+// may appear at the start of a document.
+const byteOrderMark = "\ufeff"
+
+// excerptRadius is the maximum number of bytes of input preceding and
+// following a parse error that are included in a ParseError's excerpt.
+const excerptRadius = 32
+
 // ReadSettings determine the default behavior of the Document's ReadFrom*
 // functions.
 type ReadSettings struct {
@@ -41,10 +140,30 @@ type ReadSettings struct {
 	// nil.
 	CharsetReader func(charset string, input io.Reader) (io.Reader, error)
 
-	// Permissive allows input containing common mistakes such as missing tags
-	// or attribute values. Default: false.
+	// Permissive allows input containing common mistakes, such as attributes
+	// without values or quotes, and unknown or malformed entity references,
+	// which are kept as literal text. It disables the strict mode of Go's
+	// encoding/xml decoder. Mismatched end tags are reported as errors
+	// regardless, and missing end tags are tolerated only for the elements
+	// listed in AutoClose. To tolerate only malformed attributes, use
+	// LenientAttrs instead. Default: false.
 	Permissive bool
 
+	// LenientAttrs allows attributes without values, such as <select
+	// disabled>, and attribute values without quotes, such as <a href=x>,
+	// while continuing to report unknown or malformed entity references as
+	// errors. Go's encoding/xml decoder can tolerate these attributes only
+	// in its non-strict mode, which also accepts malformed references, so
+	// etree checks references itself, requiring additional processing during
+	// ReadFrom* operations. The check is skipped when Permissive is true.
+	// Default: false.
+	LenientAttrs bool
+
+	// StrictEndTags causes an end tag that doesn't match the most recently
+	// opened element to be reported with an EndTagError, which identifies
+	// the expected and actual tags, instead of with ErrXML. Default: false.
+	StrictEndTags bool
+
 	// Preserve CDATA character data blocks when decoding XML (instead of
 	// converting it to normal character text). This entails additional
 	// processing and memory usage during ReadFrom* operations. Default:
@@ -55,9 +174,53 @@ type ReadSettings struct {
 	// preserve them instead of keeping only one. Default: false.
 	PreserveDuplicateAttrs bool
 
+	// CoalesceText merges adjacent runs of character data into a single
+	// CharData token when decoding XML. When PreserveCData is true, only
+	// adjacent runs that are both CDATA sections or both simple text are
+	// merged. Text read into an existing element by ReadFromWithSettings or
+	// AddFromReader is not merged with the element's existing character
+	// data. Default: false.
+	CoalesceText bool
+
+	// PreserveProcInstSpacing preserves the exact whitespace separating a
+	// processing instruction's target from its instruction when decoding
+	// XML. Without this setting, the whitespace is discarded, and a single
+	// space is written in its place. This entails additional processing
+	// during ReadFrom* operations. The XML declaration is always written in a
+	// standard form, so its spacing isn't preserved. Default: false.
+	PreserveProcInstSpacing bool
+
+	// TrimText trims leading and trailing whitespace from each run of
+	// character data that contains non-whitespace text, so that an element
+	// such as <year>\n\t2005\n</year> has the text "2005". Whitespace within
+	// the text is left alone, as is character data consisting only of
+	// whitespace. CDATA sections are not trimmed when PreserveCData is true.
+	// Each run is trimmed as it is read, before any CoalesceText merging.
+	// Default: false.
+	TrimText bool
+
+	// StripBOM discards a UTF-8 byte order mark (U+FEFF) found at the very
+	// start of the input, instead of storing it as character data at the
+	// start of the document. To write a byte order mark when the document
+	// is serialized, use WriteSettings.WriteBOM. Default: false.
+	StripBOM bool
+
+	// PreserveCharRefs preserves tab, newline and carriage return characters
+	// that appear in text as numeric character references (such as &#10;),
+	// so that they are written as character references instead of as literal
+	// characters. Character references within attribute values and CDATA
+	// sections aren't affected, and any other character references are
+	// decoded as usual. A preserved reference is written in hexadecimal form
+	// (such as &#xA;), and it is discarded if the token's text is modified.
+	// This entails additional processing and memory usage during ReadFrom*
+	// operations. Default: false.
+	PreserveCharRefs bool
+
 	// ValidateInput forces all ReadFrom* functions to validate that the
 	// provided input is composed of "well-formed"(*) XML before processing it.
 	// If invalid XML is detected, the ReadFrom* functions return an error.
+	// A syntax error is reported as a ParseError without an excerpt, so its
+	// message is the decoder's own.
 	// Because this option requires the input to be processed twice, it incurs a
 	// significant performance penalty. Default: false.
 	//
@@ -70,11 +233,42 @@ type ReadSettings struct {
 	// Entity to be passed to standard xml.Decoder. Default: nil.
 	Entity map[string]string
 
-	// When Permissive is true, AutoClose indicates a set of elements to
-	// consider closed immediately after they are opened, regardless of
-	// whether an end element is present. Commonly set to xml.HTMLAutoClose.
-	// Default: nil.
+	// PreserveUndefinedEntities causes references to entities that are
+	// neither predefined by XML nor listed in Entity, such as &custom;, to
+	// be kept instead of producing an error. Each such reference within text
+	// is stored as an EntityRef token, which is written back as the same
+	// reference. TrimText and CoalesceText apply to the text surrounding the
+	// reference. A reference within an attribute value can't be preserved,
+	// so it is reported as an error, unless Permissive is true, in which
+	// case it is kept as literal text. This requires the decoder's non-strict
+	// mode, so etree checks the other entity references and attributes
+	// itself, requiring additional processing during ReadFrom* operations.
+	// Default: false.
+	PreserveUndefinedEntities bool
+
+	// AutoClose indicates a set of elements to consider closed immediately
+	// after they are opened, regardless of whether an end element is
+	// present. It applies whether or not Permissive is true, so it may be
+	// combined with otherwise strict decoding. Commonly set to
+	// xml.HTMLAutoClose. Default: nil.
 	AutoClose []string
+
+	// DecoderConfig, if non-nil, is called with each xml.Decoder created by
+	// the ReadFrom* functions, after the decoder's fields have been set from
+	// these read settings and before any XML is decoded. Because it runs
+	// last, any fields it sets override the values etree derives from these
+	// settings.
+	//
+	// etree reads tokens using the decoder's RawToken method, so only some
+	// of the decoder's fields have an effect. CharsetReader and Entity are
+	// used as usual. Strict controls only how attributes and entity
+	// references are parsed, since etree matches end tags itself, and the
+	// additional checks etree performs for LenientAttrs and
+	// PreserveUndefinedEntities depend on these settings rather than on
+	// Strict. AutoClose is applied by etree rather than by the decoder.
+	// DefaultSpace has no effect, because RawToken doesn't translate
+	// namespaces. Default: nil.
+	DecoderConfig func(d *xml.Decoder)
 }
 
 // defaultCharsetReader is used by the xml decoder when the ReadSettings
@@ -106,6 +300,14 @@ type WriteSettings struct {
 	// elements that have no child elements. Default: false.
 	CanonicalEndTags bool
 
+	// ExplicitCloseTags lists the local names (i.e., tags without namespace
+	// prefixes) of elements that are always written with an explicit end
+	// tag, as in <script></script>, even when they have no child tokens.
+	// Other elements without children are written as self-closing tags
+	// unless CanonicalEndTags is true. Names must match exactly. Default:
+	// nil.
+	ExplicitCloseTags []string
+
 	// CanonicalText forces the production of XML character references for
 	// text data characters &, <, and >. If false, XML character references
 	// are also produced for " and '. Default: false.
@@ -122,6 +324,69 @@ type WriteSettings struct {
 	// false.
 	AttrSingleQuote bool
 
+	// EscapeAttrWhitespace forces the production of XML character references
+	// for tab, newline and carriage return characters within attribute
+	// values, so that they survive the attribute-value normalization
+	// performed by XML parsers. Canonical attribute values always escape
+	// these characters. Default: false.
+	EscapeAttrWhitespace bool
+
+	// ErrorOnInvalidChar causes the document's WriteTo* functions to return
+	// ErrInvalidChar, without writing anything, if any token contains a
+	// character outside the range of legal XML characters. This includes
+	// text, CDATA sections, comments, directives, processing instructions,
+	// names and attribute values. If false, each such character within text
+	// or an attribute value is replaced by the Unicode replacement character
+	// (U+FFFD), and other tokens are written unchanged. Because a token's
+	// WriteTo function can't return an error, it always behaves as if the
+	// setting were false. Default: false.
+	ErrorOnInvalidChar bool
+
+	// ForceStandalone, if non-nil, overrides the standalone pseudo-attribute
+	// written in the document's XML declaration, producing standalone="yes"
+	// when true and standalone="no" when false. The document itself is not
+	// modified. If nil, the declaration is written as it was read or set.
+	// Default: nil.
+	ForceStandalone *bool
+
+	// MinimizeBoolAttrs lists the keys of attributes to write in the
+	// minimized form used by HTML boolean attributes, as in <select
+	// disabled>, when their values are empty or equal to their keys. Keys
+	// must match exactly, including any namespace prefix, and a value is
+	// compared with the full key, so p:flag="flag" is not minimized. A
+	// permissive read stores a minimized attribute's key without its prefix
+	// as its value, so unprefixed attributes round-trip unchanged. Minimized attributes aren't valid XML, so this
+	// setting is intended only for writing HTML documents. Default: nil.
+	MinimizeBoolAttrs []string
+
+	// SortChildrenByTag causes each element's child elements to be written in
+	// order of their full tags, with elements sharing a tag kept in their
+	// original order. Any comments, processing instructions and whitespace
+	// preceding a child element are written along with it. Elements
+	// containing character data other than whitespace are written in their
+	// original order, since reordering mixed content would alter its meaning.
+	// The document itself is not modified. Default: false.
+	SortChildrenByTag bool
+
+	// WriteBOM causes the document's WriteTo* functions to write a UTF-8
+	// byte order mark (U+FEFF) before the document, unless the document's
+	// first token is character data that already begins with one. Default:
+	// false.
+	WriteBOM bool
+
+	// MaxBytes, if greater than zero, limits the size of the document's
+	// serialized output. If writing the document would exceed MaxBytes
+	// bytes, the document's WriteTo* functions write only the first MaxBytes
+	// bytes and return ErrMaxBytes. Default: 0.
+	MaxBytes int64
+
+	// MaxAttrWidth, if greater than zero, limits the width of an element's
+	// start tag when it has two or more attributes. If writing the start tag
+	// on a single line, including the indentation preceding it, would exceed
+	// MaxAttrWidth bytes, then each attribute after the first is written on
+	// its own line, aligned under the first attribute. Default: 0.
+	MaxAttrWidth int
+
 	// UseCRLF causes the document's Indent* functions to use a carriage return
 	// followed by a linefeed ("\r\n") when outputting a newline. If false,
 	// only a linefeed is used ("\n"). Default: false.
@@ -135,7 +400,27 @@ func (s *WriteSettings) dup() WriteSettings {
 	return *s
 }
 
+// PrettyStableSettings returns write settings suitable for producing
+// deterministic, review-friendly XML that differs little between runs. Empty
+// elements are written as self-closing tags, attribute values are written
+// in double quotes, and tab, newline and carriage return characters in
+// attribute values are escaped. The settings are most useful along with
+// sorted attributes and two-space indentation, as produced by
+// Document.WritePrettyStable.
+func PrettyStableSettings() WriteSettings {
+	return WriteSettings{
+		CanonicalEndTags:     false,
+		CanonicalText:        false,
+		CanonicalAttrVal:     false,
+		AttrSingleQuote:      false,
+		EscapeAttrWhitespace: true,
+	}
+}
+
 // IndentSettings determine the behavior of the Document's Indent* functions.
+// Regardless of settings, the Indent* functions never alter the whitespace
+// within an element having an xml:space="preserve" attribute, or within its
+// descendants, unless a descendant overrides it with xml:space="default".
 type IndentSettings struct {
 	// Spaces indicates the number of spaces to insert for each level of
 	// indentation. Set to etree.NoIndent to remove all indentation. Ignored
@@ -146,16 +431,41 @@ type IndentSettings struct {
 	// Default: false.
 	UseTabs bool
 
+	// IndentString, if non-empty, holds the string inserted once for each
+	// level of indentation, such as "  " or "\t  ". It takes precedence over
+	// Spaces and UseTabs. If it contains characters other than spaces and
+	// tabs, it is ignored and Spaces and UseTabs apply instead; use
+	// Document.IndentWith to have such a string reported as ErrIndentString.
+	// It is an indent setting rather than a write setting because the
+	// WriteTo* functions never add indentation; to write an indented
+	// document without modifying it, indent a copy. Default: "".
+	IndentString string
+
 	// UseCRLF causes newlines to be written as a carriage return followed by
 	// a linefeed ("\r\n"). If false, only a linefeed character is output
 	// for a newline ("\n"). Default: false.
 	UseCRLF bool
 
 	// PreserveLeafWhitespace causes indent functions to preserve whitespace
-	// within XML elements containing only non-CDATA character data. Default:
-	// false.
+	// within XML elements containing only non-CDATA character data.
+	// Indentation inserted by a previous indent call is not considered leaf
+	// whitespace and is always replaced. Default: false.
 	PreserveLeafWhitespace bool
 
+	// IndentLeafText causes the text of an element containing only
+	// character data to be placed on its own line, indented one level
+	// deeper than the element, with the element's end tag on the following
+	// line. The inserted whitespace becomes part of the element's text, so
+	// use it only when consumers ignore surrounding whitespace. Default:
+	// false.
+	IndentLeafText bool
+
+	// InlineSingleChild causes an element whose only child is an element
+	// containing nothing but character data to be written on a single line
+	// along with that child, as in <name><first>John</first></name>.
+	// Elements with other content are indented as usual. Default: false.
+	InlineSingleChild bool
+
 	// SuppressTrailingWhitespace suppresses the generation of a trailing
 	// whitespace characters (such as newlines) at the end of the indented
 	// document. Default: false.
@@ -167,15 +477,25 @@ func NewIndentSettings() *IndentSettings {
 	return &IndentSettings{
 		Spaces:                     4,
 		UseTabs:                    false,
+		IndentString:               "",
 		UseCRLF:                    false,
 		PreserveLeafWhitespace:     false,
 		SuppressTrailingWhitespace: false,
+		InlineSingleChild:          false,
+		IndentLeafText:             false,
 	}
 }
 
 type indentFunc func(depth int) string
 
 func getIndentFunc(s *IndentSettings) indentFunc {
+	if s.IndentString != "" && isIndentString(s.IndentString) {
+		unit, newline := s.IndentString, "\n"
+		if s.UseCRLF {
+			newline = "\r\n"
+		}
+		return func(depth int) string { return newline + strings.Repeat(unit, max(depth, 0)) }
+	}
 	if s.UseTabs {
 		if s.UseCRLF {
 			return func(depth int) string { return indentCRLF(depth, indentTabs) }
@@ -202,8 +522,8 @@ type Writer interface {
 }
 
 // A Token is an interface type used to represent XML elements, character
-// data, CDATA sections, XML comments, XML directives, and XML processing
-// instructions.
+// data, CDATA sections, XML comments, XML directives, XML processing
+// instructions, and unexpanded entity references.
 type Token interface {
 	Parent() *Element
 	Index() int
@@ -213,6 +533,102 @@ type Token interface {
 	setIndex(index int)
 }
 
+// Kind identifies the concrete type of a Token, as returned by TokenKind.
+type Kind byte
+
+const (
+	KindNone      Kind = iota // not a recognized token (for example, nil)
+	KindElement               // *Element
+	KindCharData              // *CharData, including CDATA sections
+	KindComment               // *Comment
+	KindDirective             // *Directive
+	KindProcInst              // *ProcInst
+	KindEntityRef             // *EntityRef
+)
+
+// String returns the name of the token kind.
+func (k Kind) String() string {
+	switch k {
+	case KindElement:
+		return "Element"
+	case KindCharData:
+		return "CharData"
+	case KindComment:
+		return "Comment"
+	case KindDirective:
+		return "Directive"
+	case KindProcInst:
+		return "ProcInst"
+	case KindEntityRef:
+		return "EntityRef"
+	default:
+		return "None"
+	}
+}
+
+// TokenKind returns the kind of the token 't'. It returns KindNone if 't'
+// is nil.
+func TokenKind(t Token) Kind {
+	switch t.(type) {
+	case *Element:
+		return KindElement
+	case *CharData:
+		return KindCharData
+	case *Comment:
+		return KindComment
+	case *Directive:
+		return KindDirective
+	case *ProcInst:
+		return KindProcInst
+	case *EntityRef:
+		return KindEntityRef
+	default:
+		return KindNone
+	}
+}
+
+// AsElement returns the token 't' as an element. The boolean result is
+// false if 't' is not an element.
+func AsElement(t Token) (*Element, bool) {
+	e, ok := t.(*Element)
+	return e, ok
+}
+
+// AsCharData returns the token 't' as character data. The boolean result is
+// false if 't' is not character data.
+func AsCharData(t Token) (*CharData, bool) {
+	c, ok := t.(*CharData)
+	return c, ok
+}
+
+// AsComment returns the token 't' as a comment. The boolean result is false
+// if 't' is not a comment.
+func AsComment(t Token) (*Comment, bool) {
+	c, ok := t.(*Comment)
+	return c, ok
+}
+
+// AsDirective returns the token 't' as a directive. The boolean result is
+// false if 't' is not a directive.
+func AsDirective(t Token) (*Directive, bool) {
+	d, ok := t.(*Directive)
+	return d, ok
+}
+
+// AsProcInst returns the token 't' as a processing instruction. The boolean
+// result is false if 't' is not a processing instruction.
+func AsProcInst(t Token) (*ProcInst, bool) {
+	p, ok := t.(*ProcInst)
+	return p, ok
+}
+
+// AsEntityRef returns the token 't' as an entity reference. The boolean
+// result is false if 't' is not an entity reference.
+func AsEntityRef(t Token) (*EntityRef, bool) {
+	r, ok := t.(*EntityRef)
+	return r, ok
+}
+
 // A Document is a container holding a complete XML tree.
 //
 // A document has a single embedded element, which contains zero or more child
@@ -230,12 +646,20 @@ type Document struct {
 }
 
 // An Element represents an XML element, its attributes, and its child tokens.
+//
+// The element's Space field holds the element's namespace prefix exactly as
+// it appears in the XML (e.g., "t" for the element <t:title>), not the
+// namespace URI. Use the NamespaceURI function to resolve the prefix to the
+// URI declared in scope.
 type Element struct {
-	Space, Tag string   // namespace prefix and tag
-	Attr       []Attr   // key-value attribute pairs
-	Child      []Token  // child tokens (elements, comments, etc.)
-	parent     *Element // parent element
-	index      int      // token index in parent's children
+	Space, Tag string                // namespace prefix and tag
+	Attr       []Attr                // key-value attribute pairs
+	Child      []Token               // child tokens (elements, comments, etc.)
+	parent     *Element              // parent element
+	index      int                   // token index in parent's children
+	srcStart   int64                 // input offset of the start tag, if read
+	srcEnd     int64                 // input offset following the end tag, if read
+	tagIndex   map[string][]*Element // child elements by tag, if indexed
 }
 
 // An Attr represents a key-value attribute within an XML element.
@@ -254,6 +678,12 @@ const (
 
 	// The CharData contains a CDATA section.
 	cdataFlag
+
+	// The CharData was inserted by an indent function.
+	indentFlag
+
+	// The CharData contains raw text that is written without escaping.
+	rawFlag
 )
 
 // CharData may be used to represent simple text data or a CDATA section
@@ -264,6 +694,7 @@ type CharData struct {
 	parent *Element
 	index  int
 	flags  charDataFlags
+	refs   []int // offsets in Data of characters read as character references
 }
 
 // A Comment represents an XML comment.
@@ -280,12 +711,40 @@ type Directive struct {
 	index  int
 }
 
+// An EntityRef represents a reference to an entity, such as &custom;, that
+// was not expanded when the document was read. It is written unchanged, as
+// an entity reference. See ReadSettings.PreserveUndefinedEntities.
+type EntityRef struct {
+	Name   string // the entity name, without the & and ; delimiters
+	parent *Element
+	index  int
+}
+
 // A ProcInst represents an XML processing instruction.
 type ProcInst struct {
 	Target string // the processing instruction target
 	Inst   string // the processing instruction value
 	parent *Element
 	index  int
+	space  string // preserved whitespace between target and value
+}
+
+// A Declaration holds the pseudo-attributes of a document's XML declaration
+// (<?xml version="1.0" encoding="UTF-8" standalone="yes"?>). A pseudo-attribute
+// that is absent from the declaration is represented by the empty string.
+type Declaration struct {
+	Version    string // the XML version, such as "1.0"
+	Encoding   string // the character encoding, such as "UTF-8"
+	Standalone string // the standalone document declaration: "yes" or "no"
+}
+
+// DocStats holds summary statistics about a document's element tree, as
+// returned by Document.Stats.
+type DocStats struct {
+	Elements   int // the number of elements in the document
+	Attributes int // the number of attributes on all elements
+	TextBytes  int // the number of bytes of character data, including CDATA
+	MaxDepth   int // the depth of the most deeply nested element (root is 1)
 }
 
 // NewDocument creates an XML document without a root element.
@@ -313,6 +772,22 @@ func (d *Document) Copy() *Document {
 	}
 }
 
+// Reset removes all of the document's child tokens and attributes, so that
+// the document may be reused to read another document without allocating a
+// new one. The removed child tokens are detached from the document, and the
+// storage holding them is retained for reuse. The document's ReadSettings
+// and WriteSettings are not reset.
+func (d *Document) Reset() {
+	for _, t := range d.Child {
+		t.setIndex(-1)
+		t.setParent(nil)
+	}
+	clear(d.Child)
+	d.Child = d.Child[:0]
+	d.Attr = d.Attr[:0]
+	d.tagIndex = nil
+}
+
 // Root returns the root element of the document. It returns nil if there is
 // no root element.
 func (d *Document) Root() *Element {
@@ -324,6 +799,61 @@ func (d *Document) Root() *Element {
 	return nil
 }
 
+// IsFragment returns true if the document's top-level tokens form an XML
+// fragment rather than a complete XML document. A document is a fragment if
+// it doesn't contain exactly one root element, or if it contains character
+// data other than whitespace outside its root element.
+func (d *Document) IsFragment() bool {
+	err := d.Validate()
+	return err == errNoRoot || err == errMultipleRoots || err == errTopLevelText
+}
+
+var (
+	errNoRoot           = ErrDocument("document has no root element.")
+	errMultipleRoots    = ErrDocument("document has multiple root elements.")
+	errTopLevelText     = ErrDocument("document has character data outside the root element.")
+	errMisplacedXMLDecl = ErrDocument("document has a misplaced XML declaration.")
+	errLateDirective    = ErrDocument("document has a directive following the root element.")
+)
+
+// Validate checks whether the document's top-level tokens satisfy the rules
+// for a well-formed XML document. The document must contain exactly one root
+// element and no character data other than whitespace outside of it. An XML
+// declaration, if present, must be the document's first token, and any
+// directive (such as a DOCTYPE) must precede the root element. Validate
+// returns an ErrDocument describing the first rule violation found, or nil
+// if there are none. The contents of the root element are not examined.
+func (d *Document) Validate() error {
+	var err error
+	roots := 0
+	for i, t := range d.Child {
+		switch t := t.(type) {
+		case *Element:
+			if roots++; roots > 1 {
+				return errMultipleRoots
+			}
+		case *CharData:
+			if t.IsCData() || !isWhitespace(t.Data) {
+				return errTopLevelText
+			}
+		case *EntityRef:
+			return errTopLevelText
+		case *ProcInst:
+			if i > 0 && t.Target == "xml" && err == nil {
+				err = errMisplacedXMLDecl
+			}
+		case *Directive:
+			if roots > 0 && err == nil {
+				err = errLateDirective
+			}
+		}
+	}
+	if roots == 0 {
+		return errNoRoot
+	}
+	return err
+}
+
 // SetRoot replaces the document's root element with the element 'e'. If the
 // document already has a root element when this function is called, then the
 // existing root element is unbound from the document. If the element 'e' is
@@ -350,20 +880,284 @@ func (d *Document) SetRoot(e *Element) {
 	p.addChild(e)
 }
 
-// ReadFrom reads XML from the reader 'r' into this document. The function
-// returns the number of bytes read and any error encountered.
-func (d *Document) ReadFrom(r io.Reader) (n int64, err error) {
-	if d.ReadSettings.ValidateInput {
-		b, err := io.ReadAll(r)
-		if err != nil {
-			return 0, err
+// Declaration returns the pseudo-attributes of the document's XML
+// declaration, along with a boolean indicating whether the document has an
+// XML declaration.
+func (d *Document) Declaration() (decl Declaration, ok bool) {
+	p := d.declaration()
+	if p == nil {
+		return Declaration{}, false
+	}
+	decl.Version, _ = pseudoAttrValue(p.Inst, "version")
+	decl.Encoding, _ = pseudoAttrValue(p.Inst, "encoding")
+	decl.Standalone, _ = pseudoAttrValue(p.Inst, "standalone")
+	return decl, true
+}
+
+// SetDeclaration replaces the document's XML declaration with one holding
+// the pseudo-attributes in 'decl'. If the document has no XML declaration,
+// one is inserted as the document's first token. If decl.Version is empty,
+// version "1.0" is used. Empty Encoding and Standalone values are omitted.
+//
+// The function returns ErrDeclaration, leaving the document unchanged, if
+// the version isn't of the form 1.x, the encoding isn't a legal encoding
+// name, or the standalone value is neither "yes" nor "no".
+func (d *Document) SetDeclaration(decl Declaration) error {
+	if decl.Version == "" {
+		decl.Version = "1.0"
+	}
+	if !isXMLVersion(decl.Version) ||
+		(decl.Encoding != "" && !isEncName(decl.Encoding)) ||
+		(decl.Standalone != "" && decl.Standalone != "yes" && decl.Standalone != "no") {
+		return ErrDeclaration
+	}
+	inst := `version="` + decl.Version + `"`
+	if decl.Encoding != "" {
+		inst += ` encoding="` + decl.Encoding + `"`
+	}
+	if decl.Standalone != "" {
+		inst += ` standalone="` + decl.Standalone + `"`
+	}
+
+	if p := d.declaration(); p != nil {
+		p.Inst = inst
+		return nil
+	}
+	d.InsertChildAt(0, NewProcInst("xml", inst))
+	return nil
+}
+
+// CreateDocType creates a DOCTYPE directive declaring the document's root
+// element name, along with its optional public and system identifiers and
+// internal DTD subset, and returns it. Empty identifiers and an empty
+// internal subset are omitted, so CreateDocType("html", "", "", "") produces
+// <!DOCTYPE html>. Each identifier is enclosed in double quotes unless it
+// contains a double quote, in which case single quotes are used. If the
+// document already has a DOCTYPE directive, its contents are replaced.
+// Otherwise the directive is inserted before the root element, or at the end
+// of the document if it has no root element.
+//
+// The function returns ErrInvalidName if 'rootName' isn't a legal XML name.
+// It returns ErrDocTypeID if 'publicID' contains a character not allowed in
+// a public identifier, such as a double quote, or if 'systemID' contains
+// both single and double quotes, since such an identifier cannot be quoted.
+// In either case the document is left unchanged.
+func (d *Document) CreateDocType(rootName, publicID, systemID, internalSubset string) (*Directive, error) {
+	if !isName(rootName) {
+		return nil, ErrInvalidName
+	}
+	if !isPubidLiteral(publicID) ||
+		(strings.IndexByte(systemID, '"') >= 0 && strings.IndexByte(systemID, '\'') >= 0) {
+		return nil, ErrDocTypeID
+	}
+
+	data := "DOCTYPE " + rootName
+	switch {
+	case publicID != "":
+		data += " PUBLIC " + quoteDocTypeID(publicID)
+		if systemID != "" {
+			data += " " + quoteDocTypeID(systemID)
 		}
-		if err := validateXML(bytes.NewReader(b), d.ReadSettings); err != nil {
-			return 0, err
+	case systemID != "":
+		data += " SYSTEM " + quoteDocTypeID(systemID)
+	}
+	if internalSubset != "" {
+		data += " [" + internalSubset + "]"
+	}
+
+	if dir := d.docType(); dir != nil {
+		dir.Data = data
+		return dir, nil
+	}
+	dir := NewDirective(data)
+	if root := d.Root(); root != nil {
+		d.InsertChildAt(root.Index(), dir)
+	} else {
+		d.AddChild(dir)
+	}
+	return dir, nil
+}
+
+// DocType returns the root element name and the public and system
+// identifiers declared by the document's DOCTYPE directive. Absent
+// identifiers are returned as empty strings. The boolean result is false if
+// the document has no well-formed DOCTYPE directive.
+func (d *Document) DocType() (rootName, publicID, systemID string, ok bool) {
+	dir := d.docType()
+	if dir == nil {
+		return "", "", "", false
+	}
+	return parseDocType(dir.Data)
+}
+
+// docType returns the document's DOCTYPE directive, or nil if the document
+// has none.
+func (d *Document) docType() *Directive {
+	for _, t := range d.Child {
+		if dir, ok := t.(*Directive); ok && strings.HasPrefix(dir.Data, "DOCTYPE") {
+			return dir
 		}
-		r = bytes.NewReader(b)
 	}
-	return d.Element.readFrom(r, d.ReadSettings)
+	return nil
+}
+
+// Prolog returns the document's top-level tokens preceding its root
+// element, such as its XML declaration, DOCTYPE directive, comments and
+// processing instructions. Whitespace character data is omitted. If the
+// document has no root element, all of its top-level tokens are considered
+// part of the prolog.
+func (d *Document) Prolog() []Token {
+	var tokens []Token
+	for _, t := range d.Child {
+		if _, ok := t.(*Element); ok {
+			break
+		}
+		if !IsWhitespaceToken(t) {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// Epilog returns the document's top-level tokens following its root
+// element, such as trailing comments and processing instructions.
+// Whitespace character data is omitted. If the document has no root
+// element, the epilog is empty.
+func (d *Document) Epilog() []Token {
+	root := d.Root()
+	if root == nil {
+		return nil
+	}
+	var tokens []Token
+	for _, t := range d.Child[root.index+1:] {
+		if !IsWhitespaceToken(t) {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// StripProlog removes all of the document's top-level tokens preceding its
+// root element, including any XML declaration, DOCTYPE directive and
+// whitespace. If the document has no root element, nothing is removed.
+func (d *Document) StripProlog() {
+	if root := d.Root(); root != nil {
+		d.removeChildRange(0, root.index)
+	}
+}
+
+// StripEpilog removes all of the document's top-level tokens following its
+// root element, including any whitespace. If the document has no root
+// element, nothing is removed.
+func (d *Document) StripEpilog() {
+	if root := d.Root(); root != nil {
+		d.removeChildRange(root.index+1, len(d.Child))
+	}
+}
+
+// ProcInsts returns the processing instructions appearing in the
+// document's prolog, before its root element, such as xml-stylesheet
+// instructions. The XML declaration is not included; use Declaration to
+// access it.
+func (d *Document) ProcInsts() []*ProcInst {
+	var list []*ProcInst
+	for _, p := range prologTokens[*ProcInst](d) {
+		if p.Target != "xml" {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// PrologComments returns the comments appearing in the document's prolog,
+// before its root element.
+func (d *Document) PrologComments() []*Comment {
+	return prologTokens[*Comment](d)
+}
+
+// AddProcInst creates a processing instruction with the requested 'target'
+// and 'inst' and adds it to the end of the document's prolog, immediately
+// before the root element. If the document has no root element, the
+// processing instruction is added to the end of the document. To remove or
+// reorder prolog tokens, use the document's RemoveChild and InsertChildAt
+// functions.
+func (d *Document) AddProcInst(target, inst string) *ProcInst {
+	p := NewProcInst(target, inst)
+	if root := d.Root(); root != nil {
+		d.InsertChildAt(root.Index(), p)
+	} else {
+		d.AddChild(p)
+	}
+	return p
+}
+
+// prologTokens returns the document's top-level tokens of type T preceding
+// its root element.
+func prologTokens[T Token](d *Document) []T {
+	var list []T
+	for _, t := range d.Child {
+		if _, ok := t.(*Element); ok {
+			break
+		}
+		if tt, ok := t.(T); ok {
+			list = append(list, tt)
+		}
+	}
+	return list
+}
+
+// declaration returns the document's XML declaration processing
+// instruction, or nil if the document has none.
+func (d *Document) declaration() *ProcInst {
+	for _, t := range d.Child {
+		switch t := t.(type) {
+		case *ProcInst:
+			if t.Target == "xml" {
+				return t
+			}
+		case *Element:
+			return nil
+		}
+	}
+	return nil
+}
+
+// FindElementFromRoot returns the first element matched by the XPath-like
+// 'path' string when evaluated from the document's root element. It returns
+// nil if the document has no root element or if no element is found using
+// the path. It panics if an invalid path string is supplied.
+//
+// Relative paths passed to the document's FindElement function are evaluated
+// against the document itself, whose children include the root element.
+// For example, doc.FindElement("book") matches only a root element named
+// "book". doc.FindElementFromRoot("book") instead matches the root element's
+// "book" children.
+func (d *Document) FindElementFromRoot(path string) *Element {
+	root := d.Root()
+	if root == nil {
+		return nil
+	}
+	return root.FindElement(path)
+}
+
+// FindElementsFromRoot returns a slice of elements matched by the XPath-like
+// 'path' string when evaluated from the document's root element. It returns
+// nil if the document has no root element or if no element is found using
+// the path. It panics if an invalid path string is supplied. See
+// FindElementFromRoot for the difference between this function and
+// FindElements.
+func (d *Document) FindElementsFromRoot(path string) []*Element {
+	root := d.Root()
+	if root == nil {
+		return nil
+	}
+	return root.FindElements(path)
+}
+
+// ReadFrom reads XML from the reader 'r' into this document. The function
+// returns the number of bytes read and any error encountered.
+func (d *Document) ReadFrom(r io.Reader) (n int64, err error) {
+	return d.Element.ReadFromWithSettings(r, d.ReadSettings)
 }
 
 // ReadFromFile reads XML from a local file at path 'filepath' into this
@@ -382,7 +1176,7 @@ func (d *Document) ReadFromFile(filepath string) error {
 // ReadFromBytes reads XML from the byte slice 'b' into the this document.
 func (d *Document) ReadFromBytes(b []byte) error {
 	if d.ReadSettings.ValidateInput {
-		if err := validateXML(bytes.NewReader(b), d.ReadSettings); err != nil {
+		if err := validateXML(b, d.ReadSettings); err != nil {
 			return err
 		}
 	}
@@ -393,7 +1187,7 @@ func (d *Document) ReadFromBytes(b []byte) error {
 // ReadFromString reads XML from the string 's' into this document.
 func (d *Document) ReadFromString(s string) error {
 	if d.ReadSettings.ValidateInput {
-		if err := validateXML(strings.NewReader(s), d.ReadSettings); err != nil {
+		if err := validateXML([]byte(s), d.ReadSettings); err != nil {
 			return err
 		}
 	}
@@ -401,13 +1195,17 @@ func (d *Document) ReadFromString(s string) error {
 	return err
 }
 
-// validateXML determines if the data read from the reader 'r' contains
-// well-formed XML according to the rules set by the go xml package.
-func validateXML(r io.Reader, settings ReadSettings) error {
-	dec := newDecoder(r, settings)
+// validateXML determines if the data 'b' contains well-formed XML according
+// to the rules set by the go xml package.
+func validateXML(b []byte, settings ReadSettings) error {
+	if settings.PreserveUndefinedEntities {
+		settings.Entity = undefinedEntities(b, settings.Entity)
+		settings.PreserveUndefinedEntities = false
+	}
+	dec := newDecoder(bytes.NewReader(b), settings)
 	err := dec.Decode(new(interface{}))
 	if err != nil {
-		return err
+		return wrapSyntaxError(err, dec, nil)
 	}
 
 	// If there are any trailing tokens after unmarshalling with Decode(),
@@ -419,6 +1217,26 @@ func validateXML(r io.Reader, settings ReadSettings) error {
 	return ErrXML
 }
 
+// wrapSyntaxError returns the error 'err' reported by the decoder 'dec'
+// wrapped in a ParseError if it is a syntax error. The error's excerpt is
+// provided by 'src', if it isn't nil. Other errors are returned unchanged.
+func wrapSyntaxError(err error, dec *xml.Decoder, src excerptSource) error {
+	if _, ok := err.(*xml.SyntaxError); !ok {
+		return err
+	}
+	line, column := dec.InputPos()
+	perr := &ParseError{
+		Offset: dec.InputOffset(),
+		Line:   line,
+		Column: column,
+		Err:    err,
+	}
+	if src != nil {
+		perr.Excerpt = src.Excerpt(perr.Offset, excerptRadius)
+	}
+	return perr
+}
+
 // newDecoder creates an XML decoder for the reader 'r' configured using
 // the provided read settings.
 func newDecoder(r io.Reader, settings ReadSettings) *xml.Decoder {
@@ -427,24 +1245,88 @@ func newDecoder(r io.Reader, settings ReadSettings) *xml.Decoder {
 	if d.CharsetReader == nil {
 		d.CharsetReader = defaultCharsetReader
 	}
-	d.Strict = !settings.Permissive
+	d.Strict = !settings.Permissive && !settings.LenientAttrs && !settings.PreserveUndefinedEntities
 	d.Entity = settings.Entity
 	d.AutoClose = settings.AutoClose
+	if settings.DecoderConfig != nil {
+		settings.DecoderConfig(d)
+	}
 	return d
 }
 
 // WriteTo serializes the document out to the writer 'w'. The function returns
 // the number of bytes written and any error encountered.
 func (d *Document) WriteTo(w io.Writer) (n int64, err error) {
-	xw := newXmlWriter(w)
+	var prefix string
+	if d.WriteSettings.WriteBOM {
+		prefix = byteOrderMark
+		if len(d.Child) > 0 {
+			if cd, ok := d.Child[0].(*CharData); ok && strings.HasPrefix(cd.Data, byteOrderMark) {
+				prefix = ""
+			}
+		}
+	}
+	return writeTokens(w, prefix, d.Child, &d.WriteSettings)
+}
+
+// writeTokens serializes the string 'prefix' followed by the tokens 'tokens'
+// out to the writer 'w' using the write settings 's'. It returns the number
+// of bytes written and any error encountered.
+func writeTokens(w io.Writer, prefix string, tokens []Token, s *WriteSettings) (n int64, err error) {
+	if s.ErrorOnInvalidChar {
+		// Check the tokens before writing, so that no partial output is
+		// produced.
+		for _, c := range tokens {
+			if !hasValidChars(c) {
+				return 0, ErrInvalidChar
+			}
+		}
+	}
+
+	xw := newXmlWriter(w, s.MaxBytes)
 	b := bufio.NewWriter(xw)
-	for _, c := range d.Child {
-		c.WriteTo(b, &d.WriteSettings)
+	b.WriteString(prefix)
+	for _, c := range tokens {
+		c.WriteTo(b, s)
 	}
 	err, n = b.Flush(), xw.bytes
 	return
 }
 
+// WritePrettyStable serializes a deterministic, review-friendly form of the
+// document out to the writer 'w'. Each element's attributes are sorted by
+// key, the document is indented with two spaces per level using linefeed
+// newlines, and the result is written using the document's WriteSettings,
+// with the fields set by PrettyStableSettings overridden. Other write
+// settings, such as MaxBytes, apply as usual. The document itself is not
+// modified. The function returns the number of bytes written and any error
+// encountered.
+func (d *Document) WritePrettyStable(w io.Writer) (n int64, err error) {
+	c := d.Copy()
+	stable := PrettyStableSettings()
+	c.WriteSettings.CanonicalEndTags = stable.CanonicalEndTags
+	c.WriteSettings.CanonicalText = stable.CanonicalText
+	c.WriteSettings.CanonicalAttrVal = stable.CanonicalAttrVal
+	c.WriteSettings.AttrSingleQuote = stable.AttrSingleQuote
+	c.WriteSettings.EscapeAttrWhitespace = stable.EscapeAttrWhitespace
+	c.WriteSettings.UseCRLF = false
+	var sortAttrs func(e *Element)
+	sortAttrs = func(e *Element) {
+		e.SortAttrs()
+		for _, t := range e.Child {
+			if ce, ok := t.(*Element); ok {
+				sortAttrs(ce)
+			}
+		}
+	}
+	sortAttrs(&c.Element)
+
+	s := NewIndentSettings()
+	s.Spaces = 2
+	c.IndentWithSettings(s)
+	return c.WriteTo(w)
+}
+
 // WriteToFile serializes the document out to the file at path 'filepath'.
 func (d *Document) WriteToFile(filepath string) error {
 	f, err := os.Create(filepath)
@@ -474,6 +1356,21 @@ func (d *Document) WriteToString() (s string, err error) {
 	return string(b), nil
 }
 
+// Reader returns a reader that serializes the document on demand as its
+// data is read, using the document's write settings. Serialization takes
+// place in a separate goroutine, so the document must not be modified until
+// the reader has returned io.EOF or has been closed. Callers that stop
+// reading before reaching io.EOF should call Close to release the
+// serializing goroutine.
+func (d *Document) Reader() io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := d.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
 // Indent modifies the document's element tree by inserting character data
 // tokens containing newlines and spaces for indentation. The amount of
 // indentation per depth level is given by the 'spaces' parameter. Other than
@@ -494,6 +1391,22 @@ func (d *Document) IndentTabs() {
 	d.IndentWithSettings(s)
 }
 
+// IndentWith modifies the document's element tree by inserting character
+// data tokens containing newlines and indentation. The string 'unit' is
+// inserted once for each indentation level, and it must contain only spaces
+// and tabs. If it contains any other characters, ErrIndentString is
+// returned and the document is not modified. Other than the indentation
+// string, default IndentSettings are used.
+func (d *Document) IndentWith(unit string) error {
+	if !isIndentString(unit) {
+		return ErrIndentString
+	}
+	s := NewIndentSettings()
+	s.Spaces, s.IndentString = 0, unit
+	d.IndentWithSettings(s)
+	return nil
+}
+
 // IndentWithSettings modifies the document's element tree by inserting
 // character data tokens containing newlines and indentation. The behavior
 // of the indentation algorithm is configured by the indent settings.
@@ -504,7 +1417,7 @@ func (d *Document) IndentWithSettings(s *IndentSettings) {
 		s.UseCRLF = true
 	}
 
-	d.Element.indent(0, getIndentFunc(s), s)
+	d.Element.indent(0, getIndentFunc(s), s, false)
 
 	if s.SuppressTrailingWhitespace {
 		d.Element.stripTrailingWhitespace()
@@ -520,6 +1433,30 @@ func (d *Document) Unindent() {
 	d.IndentWithSettings(s)
 }
 
+// Stats computes summary statistics for the document's element tree in a
+// single traversal.
+func (d *Document) Stats() DocStats {
+	var stats DocStats
+	d.Element.addStats(&stats, 0)
+	return stats
+}
+
+// addStats accumulates statistics for the tokens descending from element e,
+// which is found at the given depth.
+func (e *Element) addStats(stats *DocStats, depth int) {
+	for _, t := range e.Child {
+		switch t := t.(type) {
+		case *Element:
+			stats.Elements++
+			stats.Attributes += len(t.Attr)
+			stats.MaxDepth = max(stats.MaxDepth, depth+1)
+			t.addStats(stats, depth+1)
+		case *CharData:
+			stats.TextBytes += len(t.Data)
+		}
+	}
+}
+
 // NewElement creates an unparented element with the specified tag (i.e.,
 // name). The tag may include a namespace prefix followed by a colon.
 func NewElement(tag string) *Element {
@@ -552,13 +1489,54 @@ func (e *Element) Copy() *Element {
 	return e.dup(nil).(*Element)
 }
 
-// FullTag returns the element e's complete tag, including namespace prefix if
-// present.
-func (e *Element) FullTag() string {
-	if e.Space == "" {
-		return e.Tag
+// CloneAfter creates a recursive, deep copy of the element and inserts it
+// into the element's parent just after the element itself, returning the
+// copy. If the element has no parent, the copy is returned without being
+// added to any element.
+func (e *Element) CloneAfter() *Element {
+	c := e.Copy()
+	if e.parent != nil {
+		e.parent.InsertChildAt(e.index+1, c)
 	}
-	return e.Space + ":" + e.Tag
+	return c
+}
+
+// SetTag sets the element's tag (i.e., name). The tag may include a namespace
+// prefix followed by a colon, in which case both the element's Space and Tag
+// are updated; otherwise the element's namespace prefix is removed. The
+// function returns ErrInvalidName, leaving the element unchanged, if the
+// prefix or the unprefixed tag isn't a legal XML name.
+func (e *Element) SetTag(tag string) error {
+	space, stag := spaceDecompose(tag)
+	hasPrefix := strings.IndexByte(tag, ':') >= 0
+	if !isNCName(stag) || (hasPrefix && !isNCName(space)) {
+		return ErrInvalidName
+	}
+	e.Space, e.Tag = space, stag
+	if e.parent != nil {
+		e.parent.tagIndex = nil
+	}
+	return nil
+}
+
+// SetNamespace sets the element's namespace prefix. An empty prefix removes
+// the element's namespace prefix. The function returns ErrInvalidName,
+// leaving the element unchanged, if the prefix isn't a legal XML name.
+func (e *Element) SetNamespace(prefix string) error {
+	if prefix != "" && !isNCName(prefix) {
+		return ErrInvalidName
+	}
+	e.Space = prefix
+	return nil
+}
+
+// FullTag returns the element e's complete tag, including namespace prefix if
+// present.
+func (e *Element) FullTag() string {
+	if e.Space == "" {
+		return e.Tag
+	}
+	return e.Space + ":" + e.Tag
 }
 
 // NamespaceURI returns the XML namespace URI associated with the element. If
@@ -602,8 +1580,81 @@ func (e *Element) findDefaultNamespaceURI() string {
 	return e.parent.findDefaultNamespaceURI()
 }
 
-// namespacePrefix returns the namespace prefix associated with the element.
-func (e *Element) namespacePrefix() string {
+// NamespacesInScope returns the namespace bindings in scope at the element,
+// mapping each prefix to its namespace URI. The default namespace, if any,
+// is stored under the empty string key. Bindings are gathered from the
+// xmlns and xmlns:* attributes of the element and its ancestors, with
+// declarations on nearer elements shadowing those on farther ones. A
+// declaration with an empty URI, such as xmlns="", removes the binding. The
+// implicit "xml" prefix binding is not included.
+func (e *Element) NamespacesInScope() map[string]string {
+	ns := make(map[string]string)
+	for ; e != nil; e = e.parent {
+		for _, a := range e.Attr {
+			var prefix string
+			switch {
+			case a.Space == "xmlns":
+				prefix = a.Key
+			case a.Space == "" && a.Key == "xmlns":
+				prefix = ""
+			default:
+				continue
+			}
+			if _, ok := ns[prefix]; !ok {
+				ns[prefix] = a.Value
+			}
+		}
+	}
+	for prefix, uri := range ns {
+		if uri == "" {
+			delete(ns, prefix)
+		}
+	}
+	return ns
+}
+
+// ResolveURI resolves the URI reference 'ref', such as a relative URI found
+// in one of the element's attribute values, against the base URI in scope at
+// the element. The base URI is determined by the xml:base attributes of the
+// element and its ancestors, with each relative xml:base value resolved
+// against the base URI in scope at its parent. If no xml:base attribute is in
+// scope, or if a URI can't be parsed, 'ref' is returned unchanged.
+func (e *Element) ResolveURI(ref string) string {
+	var bases []string
+	for p := e; p != nil; p = p.parent {
+		for _, a := range p.Attr {
+			if a.Space == "xml" && a.Key == "base" {
+				bases = append(bases, a.Value)
+				break
+			}
+		}
+	}
+	if len(bases) == 0 {
+		return ref
+	}
+
+	base, err := url.Parse(bases[len(bases)-1])
+	if err != nil {
+		return ref
+	}
+	for i := len(bases) - 2; i >= 0; i-- {
+		u, err := url.Parse(bases[i])
+		if err != nil {
+			return ref
+		}
+		base = base.ResolveReference(u)
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+// Prefix returns the namespace prefix associated with the element. This is
+// the same value stored in the element's Space field. It returns the empty
+// string if the element's tag has no prefix.
+func (e *Element) Prefix() string {
 	return e.Space
 }
 
@@ -651,12 +1702,35 @@ func (e *Element) SetText(text string) {
 	e.replaceText(0, text, 0)
 }
 
+// WithText replaces all character data immediately following an element's
+// opening tag with the requested string, and then returns the element. It
+// is useful for building elements with chained function calls.
+func (e *Element) WithText(text string) *Element {
+	e.SetText(text)
+	return e
+}
+
 // SetCData replaces all character data immediately following an element's
 // opening tag with a CDATA section.
 func (e *Element) SetCData(text string) {
 	e.replaceText(0, text, cdataFlag)
 }
 
+// SetTextAuto replaces all character data immediately following an
+// element's opening tag with the requested string, choosing the more
+// readable representation. If the text contains any of the characters <, &
+// or >, which would otherwise be escaped, it is stored as a CDATA section,
+// as with SetCData. Otherwise, or if the text contains the "]]>" sequence
+// that terminates a CDATA section, it is stored as simple text, as with
+// SetText.
+func (e *Element) SetTextAuto(text string) {
+	if strings.ContainsAny(text, "<&>") && !strings.Contains(text, "]]>") {
+		e.SetCData(text)
+	} else {
+		e.SetText(text)
+	}
+}
+
 // Tail returns all character data immediately following the element's end
 // tag.
 func (e *Element) Tail() string {
@@ -713,7 +1787,7 @@ func (e *Element) replaceText(i int, text string, flags charDataFlags) {
 		} else {
 			// replace the first and only character token at index i
 			cd := e.Child[i].(*CharData)
-			cd.Data, cd.flags = text, flags
+			cd.Data, cd.flags, cd.refs = text, flags, nil
 		}
 
 	default:
@@ -729,7 +1803,7 @@ func (e *Element) replaceText(i int, text string, flags charDataFlags) {
 			// replace the first chardata token at index i and remove all
 			// subsequent chardata tokens
 			cd := e.Child[i].(*CharData)
-			cd.Data, cd.flags = text, flags
+			cd.Data, cd.flags, cd.refs = text, flags, nil
 			copy(e.Child[i+1:], e.Child[end:])
 			removed := end - (i + 1)
 			e.Child = e.Child[:len(e.Child)-removed]
@@ -759,6 +1833,36 @@ func (e *Element) CreateElement(tag string) *Element {
 	return newElement(space, stag, e)
 }
 
+// CreateElementBefore creates a new element with the specified tag (i.e.,
+// name) and inserts it into this element's list of child tokens just before
+// the existing child element 'ref'. The tag may include a prefix followed by
+// a colon. If 'ref' is not a child of this element, no element is created
+// and the function returns nil.
+func (e *Element) CreateElementBefore(ref *Element, tag string) *Element {
+	if ref == nil || ref.parent != e {
+		return nil
+	}
+	space, stag := spaceDecompose(tag)
+	c := newElement(space, stag, nil)
+	e.InsertChildAt(ref.index, c)
+	return c
+}
+
+// CreateElementAfter creates a new element with the specified tag (i.e.,
+// name) and inserts it into this element's list of child tokens just after
+// the existing child element 'ref'. The tag may include a prefix followed by
+// a colon. If 'ref' is not a child of this element, no element is created
+// and the function returns nil.
+func (e *Element) CreateElementAfter(ref *Element, tag string) *Element {
+	if ref == nil || ref.parent != e {
+		return nil
+	}
+	space, stag := spaceDecompose(tag)
+	c := newElement(space, stag, nil)
+	e.InsertChildAt(ref.index+1, c)
+	return c
+}
+
 // AddChild adds the token 't' as the last child of the element. If token 't'
 // was already the child of another element, it is first removed from its
 // parent element.
@@ -769,6 +1873,16 @@ func (e *Element) AddChild(t Token) {
 	e.addChild(t)
 }
 
+// AddChildren adds the tokens 'tokens' as the last children of the element,
+// in order, and returns the element. Any token that was already the child of
+// another element is first removed from its parent element.
+func (e *Element) AddChildren(tokens ...Token) *Element {
+	for _, t := range tokens {
+		e.AddChild(t)
+	}
+	return e
+}
+
 // InsertChild inserts the token 't' into this element's list of children just
 // before the element's existing child token 'ex'. If the existing element
 // 'ex' does not appear in this element's list of child tokens, then 't' is
@@ -802,7 +1916,9 @@ func (e *Element) InsertChild(ex Token, t Token) {
 // InsertChildAt inserts the token 't' into this element's list of child
 // tokens just before the requested 'index'. If the index is greater than or
 // equal to the length of the list of child tokens, then the token 't' is
-// added to the end of the list of child tokens.
+// added to the end of the list of child tokens. If token 't' is already the
+// child of another element, it is first removed from the other element's list
+// of child tokens.
 func (e *Element) InsertChildAt(index int, t Token) {
 	if index >= len(e.Child) {
 		e.AddChild(t)
@@ -855,9 +1971,161 @@ func (e *Element) RemoveChildAt(index int) Token {
 	return t
 }
 
+// Clear removes all of this element's child tokens and attributes, leaving
+// an empty element with the same tag. The removed child tokens are detached
+// from this element.
+func (e *Element) Clear() {
+	e.ClearContent()
+	e.Attr = nil
+}
+
+// ClearContent removes all of this element's child tokens, including any
+// text, while leaving its attributes intact. The removed child tokens are
+// detached from this element.
+func (e *Element) ClearContent() {
+	for _, t := range e.Child {
+		t.setIndex(-1)
+		t.setParent(nil)
+	}
+	e.Child = nil
+}
+
+// TransferChildren moves all of this element's child tokens to the end of
+// the 'dst' element's list of child tokens, preserving their order. This
+// element is left with no children. If 'dst' is nil, this element or one of
+// its descendants, no children are moved.
+func (e *Element) TransferChildren(dst *Element) {
+	if dst == nil || dst == e {
+		return
+	}
+	for p := dst.parent; p != nil; p = p.parent {
+		if p == e {
+			return
+		}
+	}
+
+	children := e.Child
+	e.Child = nil
+	for _, t := range children {
+		dst.addChild(t)
+	}
+}
+
+// Unwrap replaces this element within its parent's list of child tokens
+// with the element's own child tokens, preserving their order. The element
+// is then detached from its parent and left with no children. If the
+// element has no parent, Unwrap does nothing.
+func (e *Element) Unwrap() {
+	p := e.parent
+	if p == nil {
+		return
+	}
+
+	index := e.index
+	children := e.Child
+	e.Child = nil
+	p.RemoveChildAt(index)
+
+	newChild := make([]Token, 0, len(p.Child)+len(children))
+	newChild = append(newChild, p.Child[:index]...)
+	newChild = append(newChild, children...)
+	newChild = append(newChild, p.Child[index:]...)
+	p.Child = newChild
+
+	for _, t := range children {
+		t.setParent(p)
+	}
+	for j := index; j < len(p.Child); j++ {
+		p.Child[j].setIndex(j)
+	}
+}
+
+// ReadFromWithSettings reads XML from the reader 'r' using the provided
+// read settings, and it adds the tokens it reads to the end of this
+// element's list of child tokens. The XML may contain any number of
+// top-level tokens, so it is possible to read an XML fragment into an
+// existing element tree, unless settings.ValidateInput is true, in which
+// case the XML must form a complete document. The function returns the
+// number of bytes read and any error encountered. If an error is
+// encountered, none of the tokens read are added, and the element is left
+// unchanged.
+func (e *Element) ReadFromWithSettings(r io.Reader, settings ReadSettings) (n int64, err error) {
+	if settings.ValidateInput {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return 0, err
+		}
+		if err := validateXML(b, settings); err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	count := len(e.Child)
+	n, err = e.readFrom(r, settings)
+	if err != nil {
+		e.removeChildRange(count, len(e.Child))
+	}
+	return n, err
+}
+
+// InnerXML serializes this element's child tokens, without the element's
+// own start and end tags, using the default write settings.
+func (e *Element) InnerXML() (string, error) {
+	var b strings.Builder
+	if _, err := e.WriteInnerXMLTo(&b, WriteSettings{}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// WriteInnerXMLTo serializes this element's child tokens, without the
+// element's own start and end tags, out to the writer 'w' using the provided
+// write settings. The function returns the number of bytes written and any
+// error encountered.
+func (e *Element) WriteInnerXMLTo(w io.Writer, settings WriteSettings) (n int64, err error) {
+	return writeTokens(w, "", e.Child, &settings)
+}
+
+// SetInnerXML parses the XML fragment 's' and replaces this element's child
+// tokens with the tokens it contains. The fragment may contain any number
+// of top-level tokens. If the fragment cannot be parsed, an error is
+// returned and the element is left unchanged.
+func (e *Element) SetInnerXML(s string) error {
+	tmp := newElement("", "", nil)
+	if _, err := tmp.readFrom(strings.NewReader(s), ReadSettings{}); err != nil {
+		return err
+	}
+	e.ClearContent()
+	tmp.TransferChildren(e)
+	return nil
+}
+
+// AddFromReader reads XML from the reader 'r' using the provided read
+// settings, and it adds the tokens it reads to the end of this element's
+// list of child tokens, in the same manner as ReadFromWithSettings. It
+// returns the top-level elements that were added. If an error is
+// encountered, none of the tokens read are added, and the element is left
+// unchanged.
+func (e *Element) AddFromReader(r io.Reader, settings ReadSettings) ([]*Element, error) {
+	n := len(e.Child)
+	if _, err := e.ReadFromWithSettings(r, settings); err != nil {
+		return nil, err
+	}
+
+	var elements []*Element
+	for _, t := range e.Child[n:] {
+		if c, ok := t.(*Element); ok {
+			elements = append(elements, c)
+		}
+	}
+	return elements, nil
+}
+
 // autoClose analyzes the stack's top element and the current token to decide
-// whether the top element should be closed.
-func (e *Element) autoClose(stack *stack[*Element], t xml.Token, tags []string) {
+// whether the top element should be closed. The 'offset' is the input offset
+// of the current token.
+func (e *Element) autoClose(stack *stack[*Element], t xml.Token, tags []string, offset int64) {
 	if stack.empty() {
 		return
 	}
@@ -869,7 +2137,7 @@ func (e *Element) autoClose(stack *stack[*Element], t xml.Token, tags []string)
 			if e, ok := t.(xml.EndElement); !ok ||
 				!strings.EqualFold(e.Name.Space, top.Space) ||
 				!strings.EqualFold(e.Name.Local, top.Tag) {
-				stack.pop()
+				stack.pop().srcEnd = offset
 			}
 			break
 		}
@@ -879,6 +2147,41 @@ func (e *Element) autoClose(stack *stack[*Element], t xml.Token, tags []string)
 // ReadFrom reads XML from the reader 'ri' and stores the result as a new
 // child of this element.
 func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err error) {
+	// Text is never coalesced with the element's existing child tokens, so
+	// that they are unaffected by a read that fails.
+	base := len(e.Child)
+
+	// Input held in memory provides excerpts for parse errors directly, but
+	// other input must be retained as it is read.
+	var src excerptSource
+	if xs := newXmlReaderAtSource(ri); xs != nil {
+		src = xs
+	}
+
+	var hasBOM bool
+	if settings.StripBOM {
+		br := bufio.NewReader(ri)
+		b, _ := br.Peek(len(byteOrderMark))
+		hasBOM, ri = string(b) == byteOrderMark, br
+	}
+
+	if src == nil {
+		tail := newXmlTailReader(ri)
+		src, ri = tail, tail
+	}
+
+	// Entity references must be checked when the decoder's non-strict mode
+	// is used without tolerating malformed references, and attributes must
+	// be checked when it is used without tolerating lenient attributes.
+	checkRefs := (settings.LenientAttrs || settings.PreserveUndefinedEntities) && !settings.Permissive
+	checkAttrs := checkRefs && !settings.LenientAttrs
+
+	var rec *xmlRecordReader
+	if settings.PreserveCharRefs || settings.PreserveUndefinedEntities || settings.PreserveProcInstSpacing || checkRefs {
+		rec = newXmlRecordReader(ri)
+		ri = rec
+	}
+
 	var r xmlReader
 	var pr *xmlPeekReader
 	if settings.PreserveCData {
@@ -894,14 +2197,29 @@ func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err er
 	var stack stack[*Element]
 	stack.push(e)
 	for {
+		offset := dec.InputOffset()
 		if pr != nil {
-			pr.PeekPrepare(dec.InputOffset(), len(cdataPrefix))
+			pr.PeekPrepare(offset, len(cdataPrefix))
+		}
+		if rec != nil {
+			rec.Discard(offset)
 		}
 
 		t, err := dec.RawToken()
+		if err == nil && checkRefs {
+			raw := rec.Recorded(offset, dec.InputOffset())
+			msg := badEntityRef(t, raw, dec.Entity, settings.PreserveUndefinedEntities)
+			if _, ok := t.(xml.StartElement); ok && msg == "" && checkAttrs {
+				msg = badAttr(raw)
+			}
+			if msg != "" {
+				line, _ := dec.InputPos()
+				err = &xml.SyntaxError{Msg: msg, Line: line}
+			}
+		}
 
-		if settings.Permissive && settings.AutoClose != nil {
-			e.autoClose(&stack, t, settings.AutoClose)
+		if dec.AutoClose != nil {
+			e.autoClose(&stack, t, dec.AutoClose, offset)
 		}
 
 		switch {
@@ -911,7 +2229,7 @@ func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err er
 			}
 			return r.Bytes(), nil
 		case err != nil:
-			return r.Bytes(), err
+			return r.Bytes(), wrapSyntaxError(err, dec, src)
 		case stack.empty():
 			return r.Bytes(), ErrXML
 		}
@@ -921,6 +2239,7 @@ func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err er
 		switch t := t.(type) {
 		case xml.StartElement:
 			e := newElement(t.Name.Space, t.Name.Local, top)
+			e.srcStart = offset
 			if settings.PreserveDuplicateAttrs || len(t.Attr) < 2 {
 				for _, a := range t.Attr {
 					e.addAttr(a.Name.Space, a.Name.Local, a.Value)
@@ -937,16 +2256,38 @@ func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err er
 			}
 			stack.push(e)
 		case xml.EndElement:
-			if top.Tag != t.Name.Local || top.Space != t.Name.Space {
-				return r.Bytes(), ErrXML
+			// The bottom of the stack is the element receiving the input,
+			// which can't be closed by the input.
+			open := len(stack.data) > 1
+			if !open || top.Tag != t.Name.Local || top.Space != t.Name.Space {
+				if !settings.StrictEndTags {
+					return r.Bytes(), ErrXML
+				}
+				endErr := &EndTagError{Actual: t.Name.Local, Offset: dec.InputOffset()}
+				if t.Name.Space != "" {
+					endErr.Actual = t.Name.Space + ":" + endErr.Actual
+				}
+				if open {
+					endErr.Expected = top.FullTag()
+				}
+				return r.Bytes(), endErr
 			}
+			top.srcEnd = dec.InputOffset()
 			stack.pop()
 		case xml.CharData:
 			data := string(t)
+			var bomLen int
+			if hasBOM && offset == 0 {
+				// Discard the byte order mark at the start of the input.
+				bomLen = len(byteOrderMark)
+				if data = data[bomLen:]; data == "" {
+					break
+				}
+			}
 			var flags charDataFlags
-			if pr != nil {
+			if settings.PreserveCData {
 				peekBuf := pr.PeekFinalize()
-				if bytes.Equal(peekBuf, cdataPrefix) {
+				if bytes.HasPrefix(peekBuf, cdataPrefix) {
 					flags = cdataFlag
 				} else if isWhitespace(data) {
 					flags = whitespaceFlag
@@ -956,13 +2297,44 @@ func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err er
 					flags = whitespaceFlag
 				}
 			}
-			newCharData(data, flags, top)
+			var refs, ents []int
+			if (settings.PreserveCharRefs || settings.PreserveUndefinedEntities) && flags != cdataFlag {
+				raw := rec.Recorded(offset+int64(bomLen), dec.InputOffset())
+				if !bytes.HasPrefix(raw, cdataPrefix) {
+					refs, ents = findRefs(raw, data, dec.Entity)
+				}
+				if !settings.PreserveCharRefs {
+					refs = nil
+				}
+				if !settings.PreserveUndefinedEntities {
+					ents = nil
+				}
+			}
+			if settings.TrimText && flags == 0 {
+				start := len(data) - len(strings.TrimLeft(data, whitespace))
+				data = strings.Trim(data, whitespace)
+				refs = trimCharRefs(refs, start, len(data))
+				ents = trimCharRefs(ents, start, len(data))
+			}
+			coalesce := settings.CoalesceText && (top != e || len(e.Child) > base)
+			addText(top, data, flags, refs, ents, coalesce)
 		case xml.Comment:
 			newComment(string(t), top)
 		case xml.Directive:
 			newDirective(string(t), top)
 		case xml.ProcInst:
-			newProcInst(t.Target, string(t.Inst), top)
+			p := newProcInst(t.Target, string(t.Inst), top)
+			if settings.PreserveProcInstSpacing {
+				// The raw token is "<?" + target + space + inst + "?>".
+				raw := rec.Recorded(offset, dec.InputOffset())
+				start := 2 + len(t.Target)
+				end := len(raw) - 2 - len(t.Inst)
+				if start <= end {
+					if space := string(raw[start:end]); isWhitespace(space) {
+						p.space = space
+					}
+				}
+			}
 		}
 	}
 }
@@ -971,14 +2343,42 @@ func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err er
 // found, returns a pointer to the matching attribute. The function returns
 // nil if no matching attribute is found. The key may include a namespace
 // prefix followed by a colon.
+//
+// The returned pointer refers to an entry in the element's Attr slice, so it
+// may become stale when attributes are later added, removed or sorted. Don't
+// retain it across such changes; use AttrIndex to look up the attribute
+// again instead.
 func (e *Element) SelectAttr(key string) *Attr {
+	if i := e.AttrIndex(key); i >= 0 {
+		return &e.Attr[i]
+	}
+	return nil
+}
+
+// AttrCount returns the number of attributes on the element.
+func (e *Element) AttrCount() int {
+	return len(e.Attr)
+}
+
+// HasAttr returns true if the element has an attribute matching the
+// requested 'key'. The key may include a namespace prefix followed by a
+// colon.
+func (e *Element) HasAttr(key string) bool {
+	return e.AttrIndex(key) >= 0
+}
+
+// AttrIndex finds an element attribute matching the requested 'key' and, if
+// found, returns its index within the element's Attr slice. The function
+// returns -1 if no matching attribute is found. The key may include a
+// namespace prefix followed by a colon.
+func (e *Element) AttrIndex(key string) int {
 	space, skey := spaceDecompose(key)
 	for i, a := range e.Attr {
 		if spaceMatch(space, a.Space) && skey == a.Key {
-			return &e.Attr[i]
+			return i
 		}
 	}
-	return nil
+	return -1
 }
 
 // SelectAttrValue finds an element attribute matching the requested 'key' and
@@ -1006,11 +2406,147 @@ func (e *Element) ChildElements() []*Element {
 	return elements
 }
 
+// FirstChildElement returns the first child token of this element that is
+// an element, skipping any character data, comments and other tokens. It
+// returns nil if the element has no child elements.
+func (e *Element) FirstChildElement() *Element {
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// LastChildElement returns the last child token of this element that is an
+// element, skipping any character data, comments and other tokens. It
+// returns nil if the element has no child elements.
+func (e *Element) LastChildElement() *Element {
+	for i := len(e.Child) - 1; i >= 0; i-- {
+		if c, ok := e.Child[i].(*Element); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// HasChildElements returns true if this element has at least one child
+// element. Unlike ChildElements, it performs no allocations.
+func (e *Element) HasChildElements() bool {
+	for _, t := range e.Child {
+		if _, ok := t.(*Element); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// EachAttr calls the function 'fn' with a pointer to each of this
+// element's attributes, in order. The pointer refers to the attribute held
+// by the element, so 'fn' may modify its value in place. The function 'fn'
+// should not add or remove attributes, since doing so may cause attributes
+// to be skipped or visited more than once.
+func (e *Element) EachAttr(fn func(a *Attr)) {
+	for i := 0; i < len(e.Attr); i++ {
+		fn(&e.Attr[i])
+	}
+}
+
+// EachChildElement calls the function 'fn' with each element that is a
+// child of this element, in order. Unlike ChildElements, it performs no
+// allocations. The function 'fn' should not add, remove or reorder this
+// element's child tokens, since doing so may cause children to be skipped
+// or visited more than once.
+func (e *Element) EachChildElement(fn func(c *Element)) {
+	for i := 0; i < len(e.Child); i++ {
+		if c, ok := e.Child[i].(*Element); ok {
+			fn(c)
+		}
+	}
+}
+
+// IsEmpty returns true if this element has no child tokens of any kind.
+func (e *Element) IsEmpty() bool {
+	return len(e.Child) == 0
+}
+
+// IsLeaf returns true if this element has no child elements. A leaf element
+// may still contain other child tokens, such as character data or comments.
+func (e *Element) IsLeaf() bool {
+	return !e.HasChildElements()
+}
+
+// FindComments returns all comments descending from this element, in
+// document order.
+func (e *Element) FindComments() []*Comment {
+	return collectTokens[*Comment](e, nil)
+}
+
+// FindProcInsts returns all processing instructions descending from this
+// element, in document order.
+func (e *Element) FindProcInsts() []*ProcInst {
+	return collectTokens[*ProcInst](e, nil)
+}
+
+// FindDirectives returns all directives descending from this element, in
+// document order.
+func (e *Element) FindDirectives() []*Directive {
+	return collectTokens[*Directive](e, nil)
+}
+
+// collectTokens recursively appends all tokens of type T descending from
+// the element 'e' to the list, in document order.
+func collectTokens[T Token](e *Element, list []T) []T {
+	for _, t := range e.Child {
+		if tt, ok := t.(T); ok {
+			list = append(list, tt)
+		}
+		if c, ok := t.(*Element); ok {
+			list = collectTokens(c, list)
+		}
+	}
+	return list
+}
+
+// CountDescendants returns the total number of elements descending from
+// this element, not including the element itself. Unlike
+// FindElements("//*"), it performs no allocations.
+func (e *Element) CountDescendants() int {
+	n := 0
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok {
+			n += 1 + c.CountDescendants()
+		}
+	}
+	return n
+}
+
+// CountTokens returns the total number of tokens of any kind descending from
+// this element, including elements, character data, comments, directives
+// and processing instructions. The element itself is not counted.
+func (e *Element) CountTokens() int {
+	n := len(e.Child)
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok {
+			n += c.CountTokens()
+		}
+	}
+	return n
+}
+
 // SelectElement returns the first child element with the given 'tag' (i.e.,
 // name). The function returns nil if no child element matching the tag is
 // found. The tag may include a namespace prefix followed by a colon.
 func (e *Element) SelectElement(tag string) *Element {
 	space, stag := spaceDecompose(tag)
+	if list, ok := e.indexedElements(stag); ok {
+		for _, c := range list {
+			if spaceMatch(space, c.Space) {
+				return c
+			}
+		}
+		return nil
+	}
 	for _, t := range e.Child {
 		if c, ok := t.(*Element); ok && spaceMatch(space, c.Space) && stag == c.Tag {
 			return c
@@ -1024,6 +2560,14 @@ func (e *Element) SelectElement(tag string) *Element {
 func (e *Element) SelectElements(tag string) []*Element {
 	space, stag := spaceDecompose(tag)
 	var elements []*Element
+	if list, ok := e.indexedElements(stag); ok {
+		for _, c := range list {
+			if spaceMatch(space, c.Space) {
+				elements = append(elements, c)
+			}
+		}
+		return elements
+	}
 	for _, t := range e.Child {
 		if c, ok := t.(*Element); ok && spaceMatch(space, c.Space) && stag == c.Tag {
 			elements = append(elements, c)
@@ -1032,11 +2576,89 @@ func (e *Element) SelectElements(tag string) []*Element {
 	return elements
 }
 
+// BuildTagIndex builds an index of this element's child elements by tag,
+// which SelectElement and SelectElements consult to find child elements
+// without scanning all of the element's child tokens. This can speed up
+// repeated lookups on an element with many children. The index is
+// discarded when a child element is added to this element or when a child's
+// tag is changed with SetTag. After modifying the Child slice, or the Tag
+// field of a child element, directly, call BuildTagIndex again or
+// DropTagIndex.
+func (e *Element) BuildTagIndex() {
+	e.tagIndex = make(map[string][]*Element)
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok {
+			e.tagIndex[c.Tag] = append(e.tagIndex[c.Tag], c)
+		}
+	}
+}
+
+// DropTagIndex discards the index built by BuildTagIndex, if any.
+func (e *Element) DropTagIndex() {
+	e.tagIndex = nil
+}
+
+// indexedElements returns the child elements with the unprefixed tag
+// 'stag' from the element's tag index, along with a boolean indicating
+// whether the index was used. A stale index is not used, so that the caller
+// falls back to scanning the element's child tokens.
+func (e *Element) indexedElements(stag string) ([]*Element, bool) {
+	if e.tagIndex == nil {
+		return nil, false
+	}
+	list := e.tagIndex[stag]
+	for _, c := range list {
+		if c.parent != e || c.Tag != stag {
+			return nil, false
+		}
+	}
+	return list, true
+}
+
+// SelectElementsFunc returns a slice of all child elements for which the
+// predicate function 'pred' returns true. Only direct child elements are
+// considered.
+func (e *Element) SelectElementsFunc(pred func(c *Element) bool) []*Element {
+	var elements []*Element
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok && pred(c) {
+			elements = append(elements, c)
+		}
+	}
+	return elements
+}
+
+// FilterChildren returns a slice of all child tokens, of any type, for which
+// the predicate function 'pred' returns true.
+func (e *Element) FilterChildren(pred func(t Token) bool) []Token {
+	var tokens []Token
+	for _, t := range e.Child {
+		if pred(t) {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// ChildText returns the text of the first child element with the given
+// 'tag' (i.e., name), along with a boolean indicating whether such a child
+// element was found. If no matching child element is found, the function
+// returns the empty string and false. The tag may include a namespace prefix
+// followed by a colon.
+func (e *Element) ChildText(tag string) (string, bool) {
+	if c := e.SelectElement(tag); c != nil {
+		return c.Text(), true
+	}
+	return "", false
+}
+
 // FindElement returns the first element matched by the XPath-like 'path'
 // string. The function returns nil if no child element is found using the
-// path. It panics if an invalid path string is supplied.
+// path. It panics if an invalid path string is supplied. Recently compiled
+// path strings are cached, so repeated calls with the same path avoid
+// recompiling it.
 func (e *Element) FindElement(path string) *Element {
-	return e.FindElementPath(MustCompilePath(path))
+	return e.FindElementPath(mustCompileCachedPath(path))
 }
 
 // FindElementPath returns the first element matched by the 'path' object. The
@@ -1050,11 +2672,37 @@ func (e *Element) FindElementPath(path Path) *Element {
 	return nil
 }
 
+// FindText returns the text of the first element matched by the XPath-like
+// 'path' string, along with a boolean indicating whether such an element was
+// found. If no element is found using the path, the function returns the
+// empty string and false. It panics if an invalid path string is supplied.
+func (e *Element) FindText(path string) (string, bool) {
+	if c := e.FindElement(path); c != nil {
+		return c.Text(), true
+	}
+	return "", false
+}
+
+// FindElementChecked returns the first element matched by the XPath-like
+// 'path' string. Unlike FindElement, it returns an error instead of
+// panicking if an invalid path string is supplied, making it suitable for
+// paths built from user input. The function returns nil and no error if no
+// element is found using the path.
+func (e *Element) FindElementChecked(path string) (*Element, error) {
+	p, err := CompilePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return e.FindElementPath(p), nil
+}
+
 // FindElements returns a slice of elements matched by the XPath-like 'path'
 // string. The function returns nil if no child element is found using the
-// path. It panics if an invalid path string is supplied.
+// path. It panics if an invalid path string is supplied. Recently compiled
+// path strings are cached, so repeated calls with the same path avoid
+// recompiling it.
 func (e *Element) FindElements(path string) []*Element {
-	return e.FindElementsPath(MustCompilePath(path))
+	return e.FindElementsPath(mustCompileCachedPath(path))
 }
 
 // FindElementsPath returns a slice of elements matched by the 'path' object.
@@ -1063,6 +2711,155 @@ func (e *Element) FindElementsPath(path Path) []*Element {
 	return p.traverse(e, path)
 }
 
+// FindElementsFrom evaluates the 'path' object against each of the provided
+// starting elements and returns the combined slice of matching elements.
+// Results appear in the order they were found, and an element matched from
+// more than one starting element appears only once.
+func FindElementsFrom(elements []*Element, path Path) []*Element {
+	p := newPather()
+	for _, e := range elements {
+		p.traverse(e, path)
+	}
+	return p.results
+}
+
+// FindElementsChecked returns a slice of elements matched by the XPath-like
+// 'path' string. Unlike FindElements, it returns an error instead of
+// panicking if an invalid path string is supplied.
+func (e *Element) FindElementsChecked(path string) ([]*Element, error) {
+	p, err := CompilePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return e.FindElementsPath(p), nil
+}
+
+// FindTokens returns a slice of tokens matched by the XPath-like 'path'
+// string, which must end with a node test such as comment() for any tokens
+// to be found. The function returns nil if no token is found using the path.
+// It panics if an invalid path string is supplied.
+func (e *Element) FindTokens(path string) []Token {
+	return e.FindTokensPath(mustCompileCachedPath(path))
+}
+
+// FindTokensPath returns a slice of tokens matched by the 'path' object. The
+// path must end with a node test such as comment() for any tokens to be
+// found. The tokens are returned in document order within each element
+// selected by the rest of the path.
+func (e *Element) FindTokensPath(path Path) []Token {
+	if path.test == nil {
+		return nil
+	}
+
+	elements := []*Element{e}
+	if len(path.segments) > 0 {
+		p := newPather()
+		elements = p.traverse(e, Path{segments: path.segments})
+	}
+
+	var tokens []Token
+	for _, c := range elements {
+		for _, t := range c.Child {
+			if path.test(t) {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+// FindCharData returns the character data tokens matched by the final node
+// test of the XPath-like 'path' string, such as text() in //title/text() or
+// node() in //title/node(). Tokens of other kinds matched by the node test
+// are omitted, and a path without a final node test finds no tokens. The
+// returned tokens may be modified using their SetData functions to edit the
+// text in place. The function returns
+// nil if no token is found using the path. It panics if an invalid path
+// string is supplied.
+func (e *Element) FindCharData(path string) []*CharData {
+	return e.FindCharDataPath(mustCompileCachedPath(path))
+}
+
+// FindCharDataPath returns the character data tokens matched by the final
+// node test of the 'path' object. Tokens of other kinds matched by the node
+// test are omitted, and a path without a final node test finds no tokens.
+func (e *Element) FindCharDataPath(path Path) []*CharData {
+	var list []*CharData
+	for _, t := range e.FindTokensPath(path) {
+		if cd, ok := t.(*CharData); ok {
+			list = append(list, cd)
+		}
+	}
+	return list
+}
+
+// FindAncestor evaluates the XPath-like 'path' string against this element
+// and then against each of its ancestors in turn, nearest first, and
+// returns the first element matched. The function returns nil if no element
+// is found using the path. It panics if an invalid path string is supplied.
+//
+// For example, e.FindAncestor("default") returns the nearest "default"
+// element that is a child of this element or of one of its ancestors.
+func (e *Element) FindAncestor(path string) *Element {
+	return e.FindAncestorPath(mustCompileCachedPath(path))
+}
+
+// FindAncestorPath evaluates the 'path' object against this element and then
+// against each of its ancestors in turn, nearest first, and returns the
+// first element matched. The function returns nil if no element is found
+// using the path.
+func (e *Element) FindAncestorPath(path Path) *Element {
+	for a := e; a != nil; a = a.parent {
+		if found := a.FindElementPath(path); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Matches returns true if this element would be selected by the XPath-like
+// 'path' string when the path is evaluated from this element or from any of
+// its ancestors. For example, an element matches the path item[@active] if
+// it is an item element with an active attribute, since the path selects it
+// when evaluated from its parent, and every element in a document matches
+// the path //*. It panics if an invalid path string is supplied.
+func (e *Element) Matches(path string) bool {
+	return e.MatchesPath(mustCompileCachedPath(path))
+}
+
+// MatchesPath returns true if this element would be selected by the 'path'
+// object when the path is evaluated from this element or from any of its
+// ancestors. The ancestors are evaluated together, and where possible only
+// the elements leading to this element are searched.
+func (e *Element) MatchesPath(path Path) bool {
+	return newPather().match(e, path)
+}
+
+// FindElementPathVars returns the first element matched by the 'path'
+// object, using the 'vars' map to supply the values of any $variables
+// appearing in the path's filters. A filter referencing a variable missing
+// from the map matches no elements. The function returns nil if no element
+// is found using the path.
+func (e *Element) FindElementPathVars(path Path, vars map[string]string) *Element {
+	p := newPather()
+	p.vars = vars
+	elements := p.traverse(e, path)
+	if len(elements) > 0 {
+		return elements[0]
+	}
+	return nil
+}
+
+// FindElementsPathVars returns a slice of elements matched by the 'path'
+// object, using the 'vars' map to supply the values of any $variables
+// appearing in the path's filters. A filter referencing a variable missing
+// from the map matches no elements.
+func (e *Element) FindElementsPathVars(path Path, vars map[string]string) []*Element {
+	p := newPather()
+	p.vars = vars
+	return p.traverse(e, path)
+}
+
 // NotNil returns the receiver element if it isn't nil; otherwise, it returns
 // an unparented element with an empty string tag. This function simplifies
 // the task of writing code to ignore not-found results from element queries.
@@ -1100,6 +2897,32 @@ func (e *Element) GetPath() string {
 	return "/" + strings.Join(path, "/")
 }
 
+// CompiledPath returns a compiled path that selects this element, starting
+// from the root of its element tree. Unlike the string returned by GetPath,
+// which may match other elements sharing the same tags, each step of the
+// path selects a child by tag and position. The path identifies the
+// element's current location, so it may select a different element, or no
+// element at all, once the tree is modified.
+func (e *Element) CompiledPath() Path {
+	var segments []segment
+	for seg := e; seg.parent != nil; seg = seg.parent {
+		pos := 1
+		for _, t := range seg.parent.Child[:seg.index] {
+			if c, ok := t.(*Element); ok && spaceMatch(seg.Space, c.Space) && seg.Tag == c.Tag {
+				pos++
+			}
+		}
+		segments = append(segments, segment{
+			sel:     &selectChildrenByTag{space: seg.Space, tag: seg.Tag},
+			filters: []filter{newFilterPos(pos)},
+			exprs:   []string{strconv.Itoa(pos)},
+		})
+	}
+	segments = append(segments, segment{sel: new(selectRoot), filters: []filter{}})
+	slices.Reverse(segments)
+	return Path{segments: segments}
+}
+
 // GetRelativePath returns the path of this element relative to the 'source'
 // element. If the two elements are not part of the same element tree, then
 // the function returns the empty string.
@@ -1165,31 +2988,168 @@ func (e *Element) GetRelativePath(source *Element) string {
 	for i := 0; i < climb; i++ {
 		parts = append(parts, "..")
 	}
-	for i := len(path) - 1; i >= 0; i-- {
-		parts = append(parts, path[i].Tag)
+	for i := len(path) - 1; i >= 0; i-- {
+		parts = append(parts, path[i].Tag)
+	}
+	return strings.Join(parts, "/")
+}
+
+// IndentWithSettings modifies the element and its child tree by inserting
+// character data tokens containing newlines and indentation. The behavior of
+// the indentation algorithm is configured by the indent settings. Because
+// this function indents the element as if it were at the root of a document,
+// it is most useful when called just before writing the element as an XML
+// fragment using WriteTo.
+func (e *Element) IndentWithSettings(s *IndentSettings) {
+	preserve := e.parent != nil && e.parent.inheritedSpacePreserve()
+	e.indent(1, getIndentFunc(s), s, preserve)
+}
+
+// ReindentSelf replaces the whitespace immediately surrounding the element
+// with the indentation the Document's Indent* functions would produce for
+// it, using the indent settings 's'. The run of whitespace character data
+// preceding the element is replaced by a single newline and indentation
+// matching the element's depth. If the element is its parent's last child
+// other than character data, the whitespace following it is likewise
+// replaced by the indentation for its parent's end tag. Neither the
+// element's child tokens nor its siblings are reindented, and whitespace
+// adjacent to non-whitespace text is left alone. ReindentSelf is useful for
+// tidying the indentation around an element after it has been inserted or
+// after a neighboring element has been removed.
+func (e *Element) ReindentSelf(s *IndentSettings) {
+	p := e.parent
+	if p == nil || p.inheritedSpacePreserve() {
+		return
+	}
+
+	// A document's embedded element has no tag and isn't itself indented.
+	depth := 0
+	for a := p; a != nil; a = a.parent {
+		if a.parent != nil || a.Tag != "" {
+			depth++
+		}
+	}
+	indent := getIndentFunc(s)
+
+	end := e.index + 1
+	for end < len(p.Child) && isIndentWhitespace(p.Child[end]) {
+		end++
+	}
+	if end == len(p.Child) {
+		if depth == 0 && s.SuppressTrailingWhitespace {
+			p.replaceWhitespace(e.index+1, end, "")
+		} else {
+			p.replaceWhitespace(e.index+1, end, indent(depth-1))
+		}
+	}
+
+	start := e.index
+	for start > 0 && isIndentWhitespace(p.Child[start-1]) {
+		start--
+	}
+	if start > 0 && isTextToken(p.Child[start-1]) {
+		return
+	}
+	if depth == 0 && start == 0 {
+		// The first top-level token of a document isn't indented.
+		p.replaceWhitespace(start, e.index, "")
+	} else {
+		p.replaceWhitespace(start, e.index, indent(depth))
+	}
+}
+
+// removeChildRange removes the element's child tokens between the 'start'
+// and 'end' indexes, detaching them from the element.
+func (e *Element) removeChildRange(start, end int) {
+	for _, t := range e.Child[start:end] {
+		t.setIndex(-1)
+		t.setParent(nil)
+	}
+	e.Child = append(e.Child[:start], e.Child[end:]...)
+	for i := start; i < len(e.Child); i++ {
+		e.Child[i].setIndex(i)
+	}
+}
+
+// isIndentWhitespace returns true if the token 't' is character data, other
+// than a CDATA section, containing only whitespace.
+func isIndentWhitespace(t Token) bool {
+	cd, ok := t.(*CharData)
+	return ok && !cd.IsCData() && isWhitespace(cd.Data)
+}
+
+// replaceWhitespace replaces the element's child tokens between the 'start'
+// and 'end' indexes with a single character data token holding the
+// indentation whitespace 'ws'. If 'ws' is empty, the tokens are removed.
+func (e *Element) replaceWhitespace(start, end int, ws string) {
+	e.removeChildRange(start, end)
+	if ws != "" {
+		e.InsertChildAt(start, newCharData(ws, whitespaceFlag|indentFlag, nil))
 	}
-	return strings.Join(parts, "/")
 }
 
-// IndentWithSettings modifies the element and its child tree by inserting
-// character data tokens containing newlines and indentation. The behavior of
-// the indentation algorithm is configured by the indent settings. Because
-// this function indents the element as if it were at the root of a document,
-// it is most useful when called just before writing the element as an XML
-// fragment using WriteTo.
-func (e *Element) IndentWithSettings(s *IndentSettings) {
-	e.indent(1, getIndentFunc(s), s)
+// IndentedString returns an indented copy of the element and its child tree
+// serialized as an XML fragment. The fragment is indented with 'spaces'
+// spaces per level, as if the element appeared at depth 'startDepth' of a
+// larger document, so each of its lines, including the first, begins with
+// the indentation for its depth. This allows the fragment to be embedded
+// within a document indented in the same way. The element itself is not
+// modified.
+func (e *Element) IndentedString(spaces, startDepth int) string {
+	s := NewIndentSettings()
+	s.Spaces = spaces
+	indent := getIndentFunc(s)
+
+	c := e.Copy()
+	preserve := e.parent != nil && e.parent.inheritedSpacePreserve()
+	c.indent(startDepth+1, indent, s, preserve)
+
+	var b bytes.Buffer
+	b.WriteString(strings.TrimLeft(indent(startDepth), "\r\n"))
+	c.WriteTo(&b, &WriteSettings{})
+	return b.String()
 }
 
 // indent recursively inserts proper indentation between an XML element's
-// child tokens.
-func (e *Element) indent(depth int, indent indentFunc, s *IndentSettings) {
+// child tokens. The whitespace within an element whose xml:space attribute
+// is "preserve" (or that inherits "preserve" from an ancestor) is left
+// untouched.
+func (e *Element) indent(depth int, indent indentFunc, s *IndentSettings, preserve bool) {
+	preserve = e.spacePreserve(preserve)
+	if preserve {
+		// An xml:space="default" descendant may still require indentation.
+		for _, c := range e.Child {
+			if ce, ok := c.(*Element); ok {
+				ce.indent(depth+1, indent, s, preserve)
+			}
+		}
+		return
+	}
+
 	e.stripIndent(s)
 	n := len(e.Child)
 	if n == 0 {
 		return
 	}
 
+	// Place leaf text on its own line when requested.
+	if s.IndentLeafText && depth > 0 && e.hasOnlyCharData() && e.hasText() {
+		if ws := indent(depth); ws != "" {
+			e.InsertChildAt(0, newCharData(ws, whitespaceFlag|indentFlag, nil))
+			newCharData(indent(depth-1), whitespaceFlag|indentFlag, e)
+		}
+		return
+	}
+
+	// Keep a lone child element holding only character data on the same
+	// line as its parent.
+	if s.InlineSingleChild && depth > 0 && n == 1 {
+		if ce, ok := e.Child[0].(*Element); ok && ce.hasOnlyCharData() {
+			ce.indent(depth+1, indent, s, preserve)
+			return
+		}
+	}
+
 	oldChild := e.Child
 	e.Child = make([]Token, 0, n*2+1)
 	isCharData, firstNonCharData := false, true
@@ -1197,12 +3157,12 @@ func (e *Element) indent(depth int, indent indentFunc, s *IndentSettings) {
 		// Insert NL+indent before child if it's not character data.
 		// Exceptions: when it's the first non-character-data child, or when
 		// the child is at root depth.
-		_, isCharData = c.(*CharData)
+		isCharData = isTextToken(c)
 		if !isCharData {
 			if !firstNonCharData || depth > 0 {
 				s := indent(depth)
 				if s != "" {
-					newCharData(s, whitespaceFlag, e)
+					newCharData(s, whitespaceFlag|indentFlag, e)
 				}
 			}
 			firstNonCharData = false
@@ -1212,7 +3172,7 @@ func (e *Element) indent(depth int, indent indentFunc, s *IndentSettings) {
 
 		// Recursively process child elements.
 		if ce, ok := c.(*Element); ok {
-			ce.indent(depth+1, indent, s)
+			ce.indent(depth+1, indent, s, preserve)
 		}
 	}
 
@@ -1221,33 +3181,132 @@ func (e *Element) indent(depth int, indent indentFunc, s *IndentSettings) {
 		if !firstNonCharData || depth > 0 {
 			s := indent(depth - 1)
 			if s != "" {
-				newCharData(s, whitespaceFlag, e)
+				newCharData(s, whitespaceFlag|indentFlag, e)
+			}
+		}
+	}
+}
+
+// hasText returns true if any of the element's child tokens is character
+// data other than whitespace or an entity reference.
+func (e *Element) hasText() bool {
+	for _, c := range e.Child {
+		if cd, ok := c.(*CharData); ok && !cd.IsWhitespace() {
+			return true
+		}
+		if _, ok := c.(*EntityRef); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOnlyCharData returns true if all of the element's child tokens are
+// character data or entity references.
+func (e *Element) hasOnlyCharData() bool {
+	for _, c := range e.Child {
+		if !isTextToken(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// isTextToken returns true if the token 't' is part of an element's text,
+// meaning it is character data or an entity reference.
+func isTextToken(t Token) bool {
+	switch t.(type) {
+	case *CharData, *EntityRef:
+		return true
+	}
+	return false
+}
+
+// adjoinsEntityRef returns true if the element's child token at index 'i'
+// is adjacent to an entity reference.
+func (e *Element) adjoinsEntityRef(i int) bool {
+	if i > 0 {
+		if _, ok := e.Child[i-1].(*EntityRef); ok {
+			return true
+		}
+	}
+	if i+1 < len(e.Child) {
+		if _, ok := e.Child[i+1].(*EntityRef); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// spacePreserve returns true if the element's whitespace should be preserved
+// according to its xml:space attribute. If the element has no valid xml:space
+// attribute, the 'inherited' value is returned.
+func (e *Element) spacePreserve(inherited bool) bool {
+	for _, a := range e.Attr {
+		if a.Space == "xml" && a.Key == "space" {
+			switch a.Value {
+			case "preserve":
+				return true
+			case "default":
+				return false
 			}
 		}
 	}
+	return inherited
+}
+
+// inheritedSpacePreserve returns true if the element or one of its ancestors
+// requests whitespace preservation using the xml:space attribute.
+func (e *Element) inheritedSpacePreserve() bool {
+	inherited := e.parent != nil && e.parent.inheritedSpacePreserve()
+	return e.spacePreserve(inherited)
 }
 
 // stripIndent removes any previously inserted indentation.
 func (e *Element) stripIndent(s *IndentSettings) {
+	// Whitespace next to an entity reference is part of the element's text,
+	// unless it was inserted by a previous indent call.
+	isIndent := func(i int) bool {
+		cd, ok := e.Child[i].(*CharData)
+		return ok && cd.IsWhitespace() && (cd.flags&indentFlag != 0 || !e.adjoinsEntityRef(i))
+	}
+
 	// Count the number of non-indent child tokens
 	n := len(e.Child)
-	for _, c := range e.Child {
-		if cd, ok := c.(*CharData); ok && cd.IsWhitespace() {
+	for i := range e.Child {
+		if isIndent(i) {
 			n--
 		}
 	}
 	if n == len(e.Child) {
 		return
 	}
-	if n == 0 && len(e.Child) == 1 && s.PreserveLeafWhitespace {
-		return
+
+	// When preserving leaf whitespace, discard only the indentation inserted
+	// by a previous indent call, so that a single pre-existing whitespace
+	// token survives re-indentation.
+	keep := -1
+	if n == 0 && s.PreserveLeafWhitespace {
+		for i, c := range e.Child {
+			if c.(*CharData).flags&indentFlag != 0 {
+				continue
+			}
+			if keep >= 0 {
+				keep = -1
+				break
+			}
+			keep = i
+		}
+		if keep >= 0 {
+			n = 1
+		}
 	}
 
 	// Strip out indent CharData
 	newChild := make([]Token, n)
 	j := 0
-	for _, c := range e.Child {
-		if cd, ok := c.(*CharData); ok && cd.IsWhitespace() {
+	for i, c := range e.Child {
+		if isIndent(i) && i != keep {
 			continue
 		}
 		newChild[j] = c
@@ -1268,6 +3327,39 @@ func (e *Element) stripTrailingWhitespace() {
 	}
 }
 
+// Normalize merges all adjacent simple text CharData tokens within the
+// element and its descendants into a single CharData token, and it removes
+// all empty simple text CharData tokens. CDATA sections are neither merged
+// nor removed. Normalizing an element does not change its serialized form,
+// but it does simplify iteration over the element's child tokens.
+func (e *Element) Normalize() {
+	var prev *CharData
+	j := 0
+	for _, c := range e.Child {
+		if cd, ok := c.(*CharData); ok && !cd.IsCData() {
+			if cd.Data == "" || prev != nil {
+				if prev != nil {
+					prev.SetData(prev.Data + cd.Data)
+				}
+				cd.setParent(nil)
+				cd.setIndex(-1)
+				continue
+			}
+			prev = cd
+		} else {
+			prev = nil
+			if ce, ok := c.(*Element); ok {
+				ce.Normalize()
+			}
+		}
+		c.setIndex(j)
+		e.Child[j] = c
+		j++
+	}
+	clear(e.Child[j:])
+	e.Child = e.Child[:j]
+}
+
 // dup duplicates the element.
 func (e *Element) dup(parent *Element) Token {
 	ne := &Element{
@@ -1313,12 +3405,56 @@ func (e *Element) PrevSibling() *Element {
 	return nil
 }
 
+// SiblingIndex returns the position of this element among its parent's
+// child elements, ignoring any other kinds of child tokens. Unlike Index,
+// which counts all child tokens, the first child element has a sibling index
+// of 0. If this element has no parent, then the function returns -1.
+func (e *Element) SiblingIndex() int {
+	if e.parent == nil {
+		return -1
+	}
+	n := 0
+	for i := 0; i < e.index; i++ {
+		if _, ok := e.parent.Child[i].(*Element); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// SourceSpan returns the span of input bytes from which this element was
+// read. The 'start' offset is the offset of the first byte of the element's
+// start tag, and the 'end' offset is the offset of the byte following the
+// element's end tag. Offsets are relative to the start of the input passed to
+// the ReadFrom* function that read the element. If the element was not read
+// from XML input, 'ok' is false. Source spans are not retained by copies of
+// the element.
+func (e *Element) SourceSpan() (start, end int64, ok bool) {
+	if e.srcEnd == 0 {
+		return 0, 0, false
+	}
+	return e.srcStart, e.srcEnd, true
+}
+
 // Parent returns this element's parent element. It returns nil if this
 // element has no parent.
 func (e *Element) Parent() *Element {
 	return e.parent
 }
 
+// Root returns the top-most ancestor of this element, found by following
+// the chain of parent elements. It returns the element itself if it has no
+// parent. Note that if this element is part of a Document, the top-most
+// ancestor is the document's embedded element and not the document's root
+// element.
+func (e *Element) Root() *Element {
+	root := e
+	for root.parent != nil {
+		root = root.parent
+	}
+	return root
+}
+
 // Index returns the index of this element within its parent element's
 // list of child tokens. If this element has no parent, then the function
 // returns -1.
@@ -1330,20 +3466,28 @@ func (e *Element) Index() int {
 func (e *Element) WriteTo(w Writer, s *WriteSettings) {
 	w.WriteByte('<')
 	w.WriteString(e.FullTag())
-	for _, a := range e.Attr {
-		w.WriteByte(' ')
-		a.WriteTo(w, s)
+	if s.MaxAttrWidth > 0 && len(e.Attr) > 1 {
+		e.writeWrappedAttrs(w, s)
+	} else {
+		for _, a := range e.Attr {
+			w.WriteByte(' ')
+			a.WriteTo(w, s)
+		}
 	}
 	if len(e.Child) > 0 {
 		w.WriteByte('>')
-		for _, c := range e.Child {
+		children := e.Child
+		if s.SortChildrenByTag {
+			children = e.sortedChildren()
+		}
+		for _, c := range children {
 			c.WriteTo(w, s)
 		}
 		w.Write([]byte{'<', '/'})
 		w.WriteString(e.FullTag())
 		w.WriteByte('>')
 	} else {
-		if s.CanonicalEndTags {
+		if !e.selfClosing(s) {
 			w.Write([]byte{'>', '<', '/'})
 			w.WriteString(e.FullTag())
 			w.WriteByte('>')
@@ -1353,9 +3497,133 @@ func (e *Element) WriteTo(w Writer, s *WriteSettings) {
 	}
 }
 
+// sortedChildren returns the element's child tokens with its child elements
+// stably sorted by full tag. Each child element is moved along with the
+// non-element tokens preceding it. If the element has mixed content, its
+// child tokens are returned in their original order.
+func (e *Element) sortedChildren() []Token {
+	var groups [][]Token
+	start := 0
+	for i, c := range e.Child {
+		switch c := c.(type) {
+		case *CharData:
+			if c.IsCData() || !isWhitespace(c.Data) {
+				return e.Child
+			}
+		case *Element:
+			groups = append(groups, e.Child[start:i+1])
+			start = i + 1
+		}
+	}
+	if len(groups) < 2 {
+		return e.Child
+	}
+
+	tag := func(g []Token) string { return g[len(g)-1].(*Element).FullTag() }
+	slices.SortStableFunc(groups, func(a, b []Token) int {
+		return strings.Compare(tag(a), tag(b))
+	})
+
+	children := make([]Token, 0, len(e.Child))
+	for _, g := range groups {
+		children = append(children, g...)
+	}
+	return append(children, e.Child[start:]...)
+}
+
+// selfClosing returns true if the element should be written as a
+// self-closing tag, as in <tag/>.
+func (e *Element) selfClosing(s *WriteSettings) bool {
+	return len(e.Child) == 0 && !s.CanonicalEndTags && !slices.Contains(s.ExplicitCloseTags, e.Tag)
+}
+
+// writeWrappedAttrs writes the element's attributes to the writer w. If the
+// start tag would exceed the maximum attribute width, each attribute after
+// the first is written on a separate line.
+func (e *Element) writeWrappedAttrs(w Writer, s *WriteSettings) {
+	var buf bytes.Buffer
+	ends := make([]int, len(e.Attr))
+	for i := range e.Attr {
+		e.Attr[i].WriteTo(&buf, s)
+		ends[i] = buf.Len()
+	}
+
+	newline, indent := e.lineIndent(s)
+	width := len(indent) + 1 + len(e.FullTag()) + len(e.Attr) + buf.Len() + 1
+	if e.selfClosing(s) {
+		width++
+	}
+
+	attrs, start := buf.Bytes(), 0
+	if width <= s.MaxAttrWidth {
+		for _, end := range ends {
+			w.WriteByte(' ')
+			w.Write(attrs[start:end])
+			start = end
+		}
+		return
+	}
+
+	cont := newline + indent + strings.Repeat(" ", len(e.FullTag())+2)
+	for i, end := range ends {
+		if i == 0 {
+			w.WriteByte(' ')
+		} else {
+			w.WriteString(cont)
+		}
+		w.Write(attrs[start:end])
+		start = end
+	}
+}
+
+// lineIndent returns the newline sequence and indentation whitespace that
+// precede the element's start tag, as determined by the character data
+// token preceding it. Any non-whitespace characters on the start tag's line
+// are replaced by spaces in the returned indentation. If the newline sequence
+// can't be determined from the preceding token, the character data tokens
+// surrounding the element's first child are examined instead.
+func (e *Element) lineIndent(s *WriteSettings) (newline, indent string) {
+	newline = "\n"
+	if s.UseCRLF {
+		newline = "\r\n"
+	}
+
+	var prev string
+	if e.parent != nil && e.index > 0 && e.index < len(e.parent.Child) {
+		if cd, ok := e.parent.Child[e.index-1].(*CharData); ok {
+			prev = cd.Data
+		}
+	}
+
+	i := strings.LastIndexByte(prev, '\n')
+	if i < 0 {
+		for _, c := range e.Child {
+			if cd, ok := c.(*CharData); ok && strings.Contains(cd.Data, "\r\n") {
+				newline = "\r\n"
+				break
+			}
+		}
+		return newline, ""
+	}
+
+	if i > 0 && prev[i-1] == '\r' {
+		newline = "\r\n"
+	}
+	indent = strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
+		}
+		return ' '
+	}, prev[i+1:])
+	return newline, indent
+}
+
 // setParent replaces this element token's parent.
 func (e *Element) setParent(parent *Element) {
 	e.parent = parent
+	if parent != nil {
+		parent.tagIndex = nil
+	}
 }
 
 // setIndex sets this element token's index within its parent's Child slice.
@@ -1376,15 +3644,59 @@ func (e *Element) addChild(t Token) {
 // prefix followed by a colon.
 func (e *Element) CreateAttr(key, value string) *Attr {
 	space, skey := spaceDecompose(key)
+	return e.createAttr(space, skey, value)
+}
+
+// DeclareNamespace adds a namespace declaration binding the namespace
+// 'prefix' to 'uri' to this element, unless the same binding is already in
+// scope at the element, in which case the declaration would be redundant and
+// nothing is added. An empty prefix declares the default namespace (xmlns).
+// It returns the added declaration attribute, or nil if none was added.
+// Unlike CreateAttr, it prevents repeated declarations when many elements are
+// created with the same namespace bindings.
+func (e *Element) DeclareNamespace(prefix, uri string) *Attr {
+	if prefix == "" {
+		if uri == e.findDefaultNamespaceURI() {
+			return nil
+		}
+		return e.createAttr("", "xmlns", uri)
+	}
+	if uri == e.findLocalNamespaceURI(prefix) {
+		return nil
+	}
+	return e.createAttr("xmlns", prefix, uri)
+}
+
+// WithAttr creates an attribute with the specified 'key' and 'value' in the
+// same manner as CreateAttr, and then returns the element. It is useful for
+// building elements with chained function calls.
+func (e *Element) WithAttr(key, value string) *Element {
+	e.CreateAttr(key, value)
+	return e
+}
+
+// SetAttrs creates or updates multiple attributes on this element in a
+// single call. Each attribute in 'attrs' is processed in order as if passed
+// to CreateAttr: if an attribute with the same namespace prefix and key
+// already exists on this element, then its value is replaced; otherwise a
+// new attribute is appended.
+func (e *Element) SetAttrs(attrs ...Attr) {
+	for _, a := range attrs {
+		e.createAttr(a.Space, a.Key, a.Value)
+	}
+}
 
+// createAttr is a helper function that creates an attribute or, if it already
+// exists, replaces its value.
+func (e *Element) createAttr(space, key, value string) *Attr {
 	for i, a := range e.Attr {
-		if space == a.Space && skey == a.Key {
+		if space == a.Space && key == a.Key {
 			e.Attr[i].Value = value
 			return &e.Attr[i]
 		}
 	}
 
-	i := e.addAttr(space, skey, value)
+	i := e.addAttr(space, key, value)
 	return &e.Attr[i]
 }
 
@@ -1421,6 +3733,42 @@ func (e *Element) RemoveAttr(key string) *Attr {
 	return nil
 }
 
+// RemoveAttrsBySpace removes all attributes of this element whose namespace
+// prefix exactly matches 'space', and it returns copies of the removed
+// attributes in their original order. An empty 'space' removes attributes
+// without a namespace prefix. Namespace declarations, such as xmlns:space,
+// are not considered part of the namespace they declare and are not
+// removed.
+func (e *Element) RemoveAttrsBySpace(space string) []Attr {
+	var removed []Attr
+	kept := e.Attr[:0]
+	for _, a := range e.Attr {
+		if a.Space == space {
+			a.element = nil
+			removed = append(removed, a)
+		} else {
+			kept = append(kept, a)
+		}
+	}
+	clear(e.Attr[len(kept):])
+	e.Attr = kept
+	return removed
+}
+
+// RemoveAttrsBySpaceRecursive removes all attributes whose namespace prefix
+// exactly matches 'space' from this element and all of its descendant
+// elements, in the same manner as RemoveAttrsBySpace. It returns the number
+// of attributes removed.
+func (e *Element) RemoveAttrsBySpaceRecursive(space string) int {
+	n := len(e.RemoveAttrsBySpace(space))
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok {
+			n += c.RemoveAttrsBySpaceRecursive(space)
+		}
+	}
+	return n
+}
+
 // SortAttrs sorts this element's attributes lexicographically by key.
 func (e *Element) SortAttrs() {
 	slices.SortFunc(e.Attr, func(a, b Attr) int {
@@ -1431,6 +3779,60 @@ func (e *Element) SortAttrs() {
 	})
 }
 
+// SortAttrsCanonical sorts this element's attributes in the order required
+// by XML canonicalization (C14N). Namespace declarations appear first, with
+// the default namespace declaration preceding the others and the rest
+// sorted by prefix. All other attributes follow, sorted by namespace URI and
+// then by local key. Attributes without a namespace URI precede those with
+// one.
+func (e *Element) SortAttrsCanonical() {
+	slices.SortStableFunc(e.Attr, func(a, b Attr) int {
+		aDecl, bDecl := a.isNamespaceDecl(), b.isNamespaceDecl()
+		switch {
+		case aDecl && bDecl:
+			return strings.Compare(a.declaredPrefix(), b.declaredPrefix())
+		case aDecl:
+			return -1
+		case bDecl:
+			return 1
+		}
+		if v := strings.Compare(a.canonicalNamespaceURI(), b.canonicalNamespaceURI()); v != 0 {
+			return v
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+}
+
+// isNamespaceDecl returns true if the attribute is a namespace declaration.
+func (a *Attr) isNamespaceDecl() bool {
+	return a.Space == "xmlns" || (a.Space == "" && a.Key == "xmlns")
+}
+
+// declaredPrefix returns the namespace prefix declared by a namespace
+// declaration attribute, or the empty string for a default namespace
+// declaration.
+func (a *Attr) declaredPrefix() string {
+	if a.Space == "xmlns" {
+		return a.Key
+	}
+	return ""
+}
+
+// canonicalNamespaceURI returns the namespace URI of the attribute, taking
+// into account the implicitly declared "xml" prefix.
+func (a *Attr) canonicalNamespaceURI() string {
+	switch {
+	case a.Space == "":
+		return ""
+	case a.Space == "xml":
+		return "http://www.w3.org/XML/1998/namespace"
+	case a.element == nil:
+		return ""
+	default:
+		return a.NamespaceURI()
+	}
+}
+
 // FullKey returns this attribute's complete key, including namespace prefix
 // if present.
 func (a *Attr) FullKey() string {
@@ -1457,16 +3859,23 @@ func (a *Attr) NamespaceURI() string {
 
 // WriteTo serializes the attribute to the writer.
 func (a *Attr) WriteTo(w Writer, s *WriteSettings) {
-	w.WriteString(a.FullKey())
+	key := a.FullKey()
+	w.WriteString(key)
+	if (a.Value == "" || a.Value == key) && slices.Contains(s.MinimizeBoolAttrs, key) {
+		return
+	}
 	if s.AttrSingleQuote {
 		w.WriteString(`='`)
 	} else {
 		w.WriteString(`="`)
 	}
 	var m escapeMode
-	if s.CanonicalAttrVal && !s.AttrSingleQuote {
+	switch {
+	case s.CanonicalAttrVal && !s.AttrSingleQuote:
 		m = escapeCanonicalAttr
-	} else {
+	case s.EscapeAttrWhitespace:
+		m = escapeNormalAttrWhitespace
+	default:
 		m = escapeNormal
 	}
 	escapeString(w, a.Value, m)
@@ -1477,6 +3886,87 @@ func (a *Attr) WriteTo(w Writer, s *WriteSettings) {
 	}
 }
 
+// EscapeMode selects the escaping rules applied by EscapeString.
+type EscapeMode byte
+
+const (
+	// EscapeNormal escapes the characters &, <, >, ' and ", as is done for
+	// text and attribute values by default.
+	EscapeNormal EscapeMode = EscapeMode(escapeNormal)
+
+	// EscapeAttrWhitespace escapes the same characters as EscapeNormal, along
+	// with tab, newline and carriage return characters, as is done for
+	// attribute values when WriteSettings.EscapeAttrWhitespace is true.
+	EscapeAttrWhitespace EscapeMode = EscapeMode(escapeNormalAttrWhitespace)
+
+	// EscapeCanonicalText escapes the characters &, <, > and carriage
+	// return, as is done for text when WriteSettings.CanonicalText is true.
+	EscapeCanonicalText EscapeMode = EscapeMode(escapeCanonicalText)
+
+	// EscapeCanonicalAttr escapes the characters &, <, ", tab, newline and
+	// carriage return, as is done for attribute values when
+	// WriteSettings.CanonicalAttrVal is true.
+	EscapeCanonicalAttr EscapeMode = EscapeMode(escapeCanonicalAttr)
+)
+
+// EscapeString returns a copy of the string 's' with characters replaced by
+// XML character references according to the escaping rules of 'mode', in
+// the same way the document's WriteTo* functions escape text and attribute
+// values. Characters outside the range of legal XML characters are replaced
+// by the Unicode replacement character (U+FFFD).
+func EscapeString(s string, mode EscapeMode) string {
+	var b strings.Builder
+	escapeString(&b, s, escapeMode(mode))
+	return b.String()
+}
+
+// UnescapeString returns a copy of the string 's' with the predefined XML
+// entity references (&amp;, &lt;, &gt;, &apos; and &quot;) and numeric
+// character references (such as &#10; or &#xA;) replaced by the characters
+// they represent. Any other entity references, or malformed references, are
+// left unchanged.
+func UnescapeString(s string) string {
+	var b strings.Builder
+	last := 0
+	for i := strings.IndexByte(s, '&'); i >= 0; i = strings.IndexByte(s[last:], '&') {
+		i += last
+		end := strings.IndexByte(s[i:], ';')
+		if end < 0 {
+			break
+		}
+		name := s[i+1 : i+end]
+		var r string
+		switch name {
+		case "amp":
+			r = "&"
+		case "lt":
+			r = "<"
+		case "gt":
+			r = ">"
+		case "apos":
+			r = "'"
+		case "quot":
+			r = `"`
+		default:
+			if c, ok := strings.CutPrefix(name, "#"); ok {
+				if ch, ok := parseCharRef(c); ok && isInCharacterRange(ch) {
+					r = string(ch)
+				}
+			}
+		}
+		if r == "" {
+			b.WriteString(s[last : i+1])
+			last = i + 1
+			continue
+		}
+		b.WriteString(s[last:i])
+		b.WriteString(r)
+		last = i + end + 1
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
 // NewText creates an unparented CharData token containing simple text data.
 func NewText(text string) *CharData {
 	return newCharData(text, 0, nil)
@@ -1488,6 +3978,17 @@ func NewCData(data string) *CharData {
 	return newCharData(data, cdataFlag, nil)
 }
 
+// NewRawText creates an unparented CharData token containing raw text,
+// which is written exactly as provided, without escaping any characters.
+// This is useful for inserting text that has already been escaped, or
+// partially serialized XML content. Because the text is not escaped, raw
+// text can easily produce malformed XML, and it should never contain
+// untrusted input. When a document containing raw text is read back, the
+// raw text is decoded like any other text or markup.
+func NewRawText(text string) *CharData {
+	return newCharData(text, rawFlag, nil)
+}
+
 // NewCharData creates an unparented CharData token containing simple text
 // data.
 //
@@ -1525,6 +4026,13 @@ func (e *Element) CreateCData(data string) *CharData {
 	return newCharData(data, cdataFlag, e)
 }
 
+// CreateRawText creates a CharData token containing raw text and adds it to
+// the end of this element's list of child tokens. Raw text is written
+// without escaping any characters; see NewRawText.
+func (e *Element) CreateRawText(text string) *CharData {
+	return newCharData(text, rawFlag, e)
+}
+
 // CreateCharData creates a CharData token containing simple text data and
 // adds it to the end of this element's list of child tokens.
 //
@@ -1540,6 +4048,8 @@ func (e *Element) CreateCharData(data string) *CharData {
 // content is modified.
 func (c *CharData) SetData(text string) {
 	c.Data = text
+	c.flags &^= indentFlag
+	c.refs = nil
 	if isWhitespace(text) {
 		c.flags |= whitespaceFlag
 	} else {
@@ -1553,11 +4063,40 @@ func (c *CharData) IsCData() bool {
 	return (c.flags & cdataFlag) != 0
 }
 
+// SetCData changes whether this CharData token is serialized as a CDATA
+// section (if 'cdata' is true) or as simple text (if 'cdata' is false). The
+// token's data is not modified, but raw text becomes ordinary escaped text.
+func (c *CharData) SetCData(cdata bool) {
+	c.refs = nil
+	if cdata {
+		c.flags = cdataFlag
+	} else if isWhitespace(c.Data) {
+		c.flags = whitespaceFlag
+	} else {
+		c.flags = 0
+	}
+}
+
+// IsRaw returns true if this CharData token contains raw text that is
+// written without escaping.
+func (c *CharData) IsRaw() bool {
+	return (c.flags & rawFlag) != 0
+}
+
 // IsWhitespace returns true if this CharData token contains only whitespace.
 func (c *CharData) IsWhitespace() bool {
 	return (c.flags & whitespaceFlag) != 0
 }
 
+// IsWhitespaceToken returns true if the token 't' is a CharData token
+// containing only whitespace, such as the indentation inserted by the Indent
+// functions. CDATA sections are considered significant and always cause the
+// function to return false.
+func IsWhitespaceToken(t Token) bool {
+	cd, ok := t.(*CharData)
+	return ok && cd.IsWhitespace() && !cd.IsCData()
+}
+
 // Parent returns this CharData token's parent element, or nil if it has no
 // parent.
 func (c *CharData) Parent() *Element {
@@ -1571,12 +4110,16 @@ func (c *CharData) Index() int {
 	return c.index
 }
 
-// WriteTo serializes character data to the writer.
+// WriteTo serializes character data to the writer. If a CDATA section's
+// data contains the "]]>" terminator, the data is split across multiple
+// adjacent CDATA sections.
 func (c *CharData) WriteTo(w Writer, s *WriteSettings) {
 	if c.IsCData() {
 		w.WriteString(`<![CDATA[`)
-		w.WriteString(c.Data)
+		w.WriteString(strings.ReplaceAll(c.Data, "]]>", "]]]]><![CDATA[>"))
 		w.WriteString(`]]>`)
+	} else if c.IsRaw() {
+		w.WriteString(c.Data)
 	} else {
 		var m escapeMode
 		if s.CanonicalText {
@@ -1584,7 +4127,16 @@ func (c *CharData) WriteTo(w Writer, s *WriteSettings) {
 		} else {
 			m = escapeNormal
 		}
-		escapeString(w, c.Data, m)
+		last := 0
+		for _, i := range c.refs {
+			if i < last || i >= len(c.Data) || !isCharRefByte(c.Data[i]) {
+				continue
+			}
+			escapeString(w, c.Data[last:i], m)
+			writeCharRef(w, c.Data[i])
+			last = i + 1
+		}
+		escapeString(w, c.Data[last:], m)
 	}
 }
 
@@ -1593,6 +4145,7 @@ func (c *CharData) dup(parent *Element) Token {
 	return &CharData{
 		Data:   c.Data,
 		flags:  c.flags,
+		refs:   slices.Clone(c.refs),
 		parent: parent,
 		index:  c.index,
 	}
@@ -1614,7 +4167,7 @@ func NewComment(comment string) *Comment {
 	return newComment(comment, nil)
 }
 
-// NewComment creates a comment token and sets its parent element to 'parent'.
+// newComment creates a comment token and sets its parent element to 'parent'.
 func newComment(comment string, parent *Element) *Comment {
 	c := &Comment{
 		Data:   comment,
@@ -1628,11 +4181,24 @@ func newComment(comment string, parent *Element) *Comment {
 }
 
 // CreateComment creates a comment token using the specified 'comment' string
-// and adds it as the last child token of this element.
+// and adds it as the last child token of this element. To add a comment at
+// another position, create it with NewComment and add it with InsertChildAt.
 func (e *Element) CreateComment(comment string) *Comment {
 	return newComment(comment, e)
 }
 
+// CreateCommentStrict creates a comment token using the specified 'comment'
+// string and adds it as the last child token of this element. Unlike
+// CreateComment, it first validates the comment string and returns
+// ErrComment if the string contains "--" or ends with "-", either of which
+// would produce an invalid XML comment when serialized.
+func (e *Element) CreateCommentStrict(comment string) (*Comment, error) {
+	if !isValidComment(comment) {
+		return nil, ErrComment
+	}
+	return newComment(comment, e), nil
+}
+
 // dup duplicates the comment.
 func (c *Comment) dup(parent *Element) Token {
 	return &Comment{
@@ -1737,6 +4303,71 @@ func (d *Directive) setIndex(index int) {
 	d.index = index
 }
 
+// NewEntityRef creates an unparented reference to the entity 'name'.
+func NewEntityRef(name string) *EntityRef {
+	return newEntityRef(name, nil)
+}
+
+// newEntityRef creates an entity reference and binds it to a parent element.
+// If parent is nil, the EntityRef remains unbound.
+func newEntityRef(name string, parent *Element) *EntityRef {
+	r := &EntityRef{
+		Name:   name,
+		parent: nil,
+		index:  -1,
+	}
+	if parent != nil {
+		parent.addChild(r)
+	}
+	return r
+}
+
+// CreateEntityRef creates a reference to the entity 'name' and adds it as
+// the last child token of this element.
+func (e *Element) CreateEntityRef(name string) *EntityRef {
+	return newEntityRef(name, e)
+}
+
+// dup duplicates the entity reference.
+func (r *EntityRef) dup(parent *Element) Token {
+	return &EntityRef{
+		Name:   r.Name,
+		parent: parent,
+		index:  r.index,
+	}
+}
+
+// Parent returns the entity reference token's parent element, or nil if it
+// has no parent.
+func (r *EntityRef) Parent() *Element {
+	return r.parent
+}
+
+// Index returns the index of this EntityRef token within its parent
+// element's list of child tokens. If this EntityRef token has no parent,
+// then the function returns -1.
+func (r *EntityRef) Index() int {
+	return r.index
+}
+
+// WriteTo serializes the entity reference to the writer.
+func (r *EntityRef) WriteTo(w Writer, s *WriteSettings) {
+	w.WriteByte('&')
+	w.WriteString(r.Name)
+	w.WriteByte(';')
+}
+
+// setParent replaces the entity reference token's parent.
+func (r *EntityRef) setParent(parent *Element) {
+	r.parent = parent
+}
+
+// setIndex sets the EntityRef token's index within its parent element's
+// Child slice.
+func (r *EntityRef) setIndex(index int) {
+	r.index = index
+}
+
 // NewProcInst creates an unparented XML processing instruction.
 func NewProcInst(target, inst string) *ProcInst {
 	return newProcInst(target, inst, nil)
@@ -1771,6 +4402,7 @@ func (p *ProcInst) dup(parent *Element) Token {
 		Inst:   p.Inst,
 		parent: parent,
 		index:  p.index,
+		space:  p.space,
 	}
 }
 
@@ -1787,13 +4419,34 @@ func (p *ProcInst) Index() int {
 	return p.index
 }
 
-// WriteTo serializes the processing instruction to the writer.
+// WriteTo serializes the processing instruction to the writer. Unless the
+// processing instruction was read with ReadSettings.PreserveProcInstSpacing,
+// a single space separates the target from a non-empty instruction, and no
+// space follows the target when the instruction is empty (<?target?>). An
+// XML declaration is always written in a standard form, with its
+// pseudo-attributes separated by single spaces and their values enclosed in
+// double quotes, as in <?xml version="1.0" encoding="UTF-8"?>.
 func (p *ProcInst) WriteTo(w Writer, s *WriteSettings) {
+	inst, space := p.Inst, p.space
+	if p.Target == "xml" {
+		if s.ForceStandalone != nil {
+			if *s.ForceStandalone {
+				inst = setPseudoAttrValue(inst, "standalone", "yes")
+			} else {
+				inst = setPseudoAttrValue(inst, "standalone", "no")
+			}
+		}
+		inst, space = normalizePseudoAttrs(inst), ""
+	}
+
 	w.WriteString("<?")
 	w.WriteString(p.Target)
-	if p.Inst != "" {
+	if space != "" {
+		w.WriteString(space)
+		w.WriteString(inst)
+	} else if inst != "" {
 		w.WriteByte(' ')
-		w.WriteString(p.Inst)
+		w.WriteString(inst)
 	}
 	w.WriteString("?>")
 }
@@ -13,6 +13,7 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -248,6 +249,107 @@ func TestImbalancedXML(t *testing.T) {
 	}
 }
 
+func TestEndTagError(t *testing.T) {
+	cases := []struct {
+		in, expected, actual, msg string
+	}{
+		{`<test></test2>`, "test", "test2", "etree: mismatched end tag: expected </test>, found </test2>"},
+		{`<doc xmlns:p="xyz"><p:test></test></doc>`, "p:test", "test", "etree: mismatched end tag: expected </p:test>, found </test>"},
+		{`<doc xmlns:p="xyz"><test></p:test></doc>`, "test", "p:test", "etree: mismatched end tag: expected </test>, found </p:test>"},
+		{`<test></test></test>`, "", "test", "etree: unexpected end tag </test>"},
+	}
+	for _, c := range cases {
+		// Without StrictEndTags, the ErrXML sentinel itself is returned.
+		doc := NewDocument()
+		if err := doc.ReadFromString(c.in); err != ErrXML {
+			t.Errorf("etree: expected ErrXML for %s, got %v", c.in, err)
+		}
+
+		doc.ReadSettings.StrictEndTags = true
+		err := doc.ReadFromString(c.in)
+		var endErr *EndTagError
+		if !errors.As(err, &endErr) {
+			t.Errorf("etree: expected EndTagError for %s, got %v", c.in, err)
+			continue
+		}
+		checkStrEq(t, endErr.Expected, c.expected)
+		checkStrEq(t, endErr.Actual, c.actual)
+		checkStrEq(t, err.Error(), c.msg)
+		checkBoolEq(t, errors.Is(err, ErrXML), true)
+		checkStrEq(t, c.in[endErr.Offset-int64(len(c.actual))-3:endErr.Offset], "</"+c.actual+">")
+	}
+
+	// An end tag closing the element receiving a fragment is unexpected,
+	// since the element wasn't opened by the input.
+	root := NewElement("root")
+	_, err := root.AddFromReader(strings.NewReader(`<a/></root>`), ReadSettings{StrictEndTags: true})
+	var endErr *EndTagError
+	if !errors.As(err, &endErr) {
+		t.Fatalf("etree: expected EndTagError, got %v", err)
+	}
+	checkStrEq(t, endErr.Expected, "")
+	checkStrEq(t, endErr.Actual, "root")
+	checkStrEq(t, err.Error(), "etree: unexpected end tag </root>")
+	checkIntEq(t, len(root.Child), 0)
+
+	_, err = root.ReadFromWithSettings(strings.NewReader(`<a></b></a>`), ReadSettings{StrictEndTags: true})
+	if !errors.As(err, &endErr) {
+		t.Fatalf("etree: expected EndTagError, got %v", err)
+	}
+	checkStrEq(t, endErr.Expected, "a")
+	checkStrEq(t, endErr.Actual, "b")
+}
+
+func TestParseError(t *testing.T) {
+	s := "<root>\n\t<a>one</a>\n\t<b x=1>two</b>\n</root>"
+	doc := NewDocument()
+	err := doc.ReadFromString(s)
+
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("etree: expected ParseError, got %v", err)
+	}
+	var serr *xml.SyntaxError
+	checkBoolEq(t, errors.As(err, &serr), true)
+	checkIntEq(t, perr.Line, 3)
+	checkIntEq(t, int(perr.Offset), strings.Index(s, "1>")+1)
+	checkStrEq(t, perr.Excerpt, "<b x=1>two</b>")
+	checkStrEq(t, err.Error(), `XML syntax error on line 3: unquoted or missing attribute value in element (column 8, near "<b x=1>two</b>")`)
+
+	// The excerpt is available for errors deep within large inputs.
+	large := "<root>" + strings.Repeat("<item>text</item>\n", 2000) + "<bad attr=></root>"
+	err = doc.ReadFromString(large)
+	if !errors.As(err, &perr) {
+		t.Fatalf("etree: expected ParseError, got %v", err)
+	}
+	checkIntEq(t, perr.Line, 2001)
+	checkStrEq(t, perr.Excerpt, "<bad attr=></root>")
+
+	// Streamed input provides the excerpt from recently read bytes.
+	_, err = doc.ReadFrom(struct{ io.Reader }{strings.NewReader(large)})
+	if !errors.As(err, &perr) {
+		t.Fatalf("etree: expected ParseError, got %v", err)
+	}
+	checkStrEq(t, perr.Excerpt, "<bad attr=></root>")
+
+	// Input validation errors are also reported as a ParseError, but
+	// without an excerpt, so their messages are the decoder's own.
+	doc.ReadSettings.ValidateInput = true
+	err = doc.ReadFromString(s)
+	if !errors.As(err, &perr) {
+		t.Fatalf("etree: expected ParseError, got %v", err)
+	}
+	checkIntEq(t, perr.Line, 3)
+	checkIntEq(t, perr.Column, 8)
+	checkStrEq(t, perr.Excerpt, "")
+	checkStrEq(t, err.Error(), "XML syntax error on line 3: unquoted or missing attribute value in element")
+	doc.ReadSettings.ValidateInput = false
+
+	// Errors from the reader itself are not wrapped.
+	err = doc.ReadFromString("<root>")
+	checkBoolEq(t, errors.As(err, &perr), false)
+}
+
 func TestDocumentCharsetReader(t *testing.T) {
 	s := `<?xml version="1.0" encoding="lowercase"?>
 <Store>
@@ -316,6 +418,61 @@ func TestDocumentReadPermissive(t *testing.T) {
 	}
 }
 
+func TestDocumentReadLenientAttrs(t *testing.T) {
+	settings := ReadSettings{LenientAttrs: true}
+	doc := newDocumentFromString2(t, `<select disabled><option value=x>&amp;&#65;&#x42;<![CDATA[&c]]></option></select>`, settings)
+	checkStrEq(t, doc.Root().SelectAttrValue("disabled", ""), "disabled")
+	checkStrEq(t, doc.FindElement("//option").SelectAttrValue("value", ""), "x")
+	checkStrEq(t, doc.FindElement("//option").Text(), "&AB&c")
+
+	errTests := []struct {
+		input string
+		msg   string
+	}{
+		{`<a>&foo;</a>`, "invalid character entity &foo;"},
+		{`<a x="&bogus;"/>`, "invalid character entity &bogus;"},
+		{`<a>x & y</a>`, "invalid character entity & y (no semicolon)"},
+		{`<a>&#xD800;</a>`, "invalid character entity &#xD800;"},
+	}
+	for _, test := range errTests {
+		doc := NewDocument()
+		doc.ReadSettings = settings
+		err := doc.ReadFromString(test.input)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("etree: reading %s returned %v, wanted a ParseError", test.input, err)
+			continue
+		}
+		var serr *xml.SyntaxError
+		if errors.As(err, &serr) {
+			checkStrEq(t, serr.Msg, test.msg)
+			checkIntEq(t, serr.Line, 1)
+		}
+
+		// Permissive reading accepts the references as literal text.
+		doc.ReadSettings.Permissive = true
+		if err := doc.ReadFromString(test.input); err != nil {
+			t.Errorf("etree: permissive reading of %s failed: %v", test.input, err)
+		}
+	}
+
+	// Entities listed in the Entity map are accepted.
+	settings.Entity = map[string]string{"foo": "F"}
+	doc = newDocumentFromString2(t, `<a b=1>&foo;</a>`, settings)
+	checkStrEq(t, doc.Root().Text(), "F")
+
+	// Mismatched end tags are still reported.
+	doc = NewDocument()
+	doc.ReadSettings = settings
+	if err := doc.ReadFromString(`<a><b></a>`); err == nil {
+		t.Error("etree: expected an end tag error")
+	}
+
+	// AutoClose applies without Permissive.
+	doc = newDocumentFromString2(t, `<p>a<br>b</p>`, ReadSettings{AutoClose: []string{"br"}})
+	checkDocEq(t, doc, `<p>a<br/>b</p>`)
+}
+
 func TestEmbeddedComment(t *testing.T) {
 	s := `<a>123<!-- test -->456</a>`
 
@@ -329,6 +486,37 @@ func TestEmbeddedComment(t *testing.T) {
 	checkStrEq(t, a.Text(), "123456")
 }
 
+func TestCreateCommentStrict(t *testing.T) {
+	tests := []struct {
+		comment string
+		valid   bool
+	}{
+		{"", true},
+		{" comment ", true},
+		{"a-b-c", true},
+		{"-leading", true},
+		{"trailing-", false},
+		{"double--dash", false},
+		{"early -->", false},
+		{"-", false},
+	}
+
+	for _, test := range tests {
+		doc := NewDocument()
+		root := doc.CreateElement("root")
+		c, err := root.CreateCommentStrict(test.comment)
+		if test.valid {
+			if err != nil || c == nil || c.Data != test.comment || len(root.Child) != 1 {
+				t.Errorf("etree: CreateCommentStrict(%q) failed unexpectedly", test.comment)
+			}
+		} else {
+			if err != ErrComment || c != nil || len(root.Child) != 0 {
+				t.Errorf("etree: CreateCommentStrict(%q) succeeded unexpectedly", test.comment)
+			}
+		}
+	}
+}
+
 func TestDocumentReadHTMLEntities(t *testing.T) {
 	s := `<store>
 	<book lang="en">
@@ -389,6 +577,159 @@ Book: Great Expectations<br/>`},
 	}
 }
 
+func TestReadSettingsDecoderConfig(t *testing.T) {
+	doc := NewDocument()
+	doc.ReadSettings.DecoderConfig = func(d *xml.Decoder) {
+		d.Strict = false
+		d.AutoClose = []string{"br"}
+	}
+	err := doc.ReadFromString(`<p>a<br>b</p>`)
+	if err != nil {
+		t.Fatal("etree: ReadFromString() error = ", err)
+	}
+	checkDocEq(t, doc, `<p>a<br/>b</p>`)
+
+	// The hook's settings override those derived from ReadSettings.
+	doc = NewDocument()
+	doc.ReadSettings.Permissive = true
+	doc.ReadSettings.DecoderConfig = func(d *xml.Decoder) {
+		d.Strict = true
+	}
+	err = doc.ReadFromString(`<p>a<br>b</p>`)
+	if err == nil {
+		t.Error("etree: expected strict decoding error")
+	}
+}
+
+func TestWriteSortChildrenByTag(t *testing.T) {
+	s := `<root>
+	<c/>
+	<!--about b-->
+	<b id="1"/>
+	<a><z/><y/></a>
+	<b id="2"/>
+	<p>text <i/> and <b/></p>
+</root>`
+	doc := newDocumentFromString(t, s)
+	doc.WriteSettings.SortChildrenByTag = true
+
+	expected := `<root>
+	<a><y/><z/></a>
+	<!--about b-->
+	<b id="1"/>
+	<b id="2"/>
+	<c/>
+	<p>text <i/> and <b/></p>
+</root>`
+	out, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal("etree: WriteToString failed:", err)
+	}
+	checkStrEq(t, out, expected)
+
+	// The document itself is unchanged.
+	doc.WriteSettings.SortChildrenByTag = false
+	out, _ = doc.WriteToString()
+	checkStrEq(t, out, s)
+}
+
+func TestMinimizeBoolAttrs(t *testing.T) {
+	doc := NewDocument()
+	doc.ReadSettings.Permissive = true
+	err := doc.ReadFromString(`<select disabled name="s"><option selected>a</option><option value="">b</option></select>`)
+	if err != nil {
+		t.Fatal("etree: ReadFromString() error = ", err)
+	}
+	doc.FindElement("//option[2]").CreateAttr("selected", "")
+
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, `<select disabled="disabled" name="s"><option selected="selected">a</option><option value="" selected="">b</option></select>`)
+
+	doc.WriteSettings.MinimizeBoolAttrs = []string{"disabled", "selected", "name"}
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<select disabled name="s"><option selected>a</option><option value="" selected>b</option></select>`)
+
+	// Values are compared with the attribute's full key.
+	doc = newDocumentFromString(t, `<a p:flag="flag" q:flag="q:flag" flag="p:flag"/>`)
+	doc.WriteSettings.MinimizeBoolAttrs = []string{"p:flag", "q:flag", "flag"}
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<a p:flag="flag" q:flag flag="p:flag"/>`)
+}
+
+func TestPreserveCharRefs(t *testing.T) {
+	tests := []struct {
+		input, expected string
+	}{
+		{"<a>x&#10;y</a>", "<a>x&#xA;y</a>"},
+		{"<a>&#x9;&#xa;&#13;\n&#65;&amp;&ent;&#233;\r\n&#10;</a>", "<a>&#x9;&#xA;&#xD;\nA&amp;entityé\n&#xA;</a>"},
+		{"<a b='&#10;'>x</a>", "<a b=\"\n\">x</a>"},
+		{"<a>\n</a>", "<a>\n</a>"},
+		{"<a><![CDATA[&#10;]]>&#10;</a>", "<a>&amp;#10;&#xA;</a>"},
+		{"<a>&#10;<b>&#9;</b>&#10;</a>", "<a>&#xA;<b>&#x9;</b>&#xA;</a>"},
+	}
+
+	for _, test := range tests {
+		settings := ReadSettings{
+			PreserveCharRefs: true,
+			Entity:           map[string]string{"ent": "entity"},
+		}
+		doc := newDocumentFromString2(t, test.input, settings)
+		s, err := doc.WriteToString()
+		if err != nil {
+			t.Fatal("etree: failed to write document")
+		}
+		checkStrEq(t, s, test.expected)
+
+		s, _ = doc.Copy().WriteToString()
+		checkStrEq(t, s, test.expected)
+	}
+
+	// References survive text coalescing and are dropped when text changes.
+	settings := ReadSettings{PreserveCharRefs: true, PreserveCData: true, CoalesceText: true}
+	doc := newDocumentFromString2(t, "<a>x&#10;<!--c-->y&#10;z&#9;</a>", settings)
+	doc.Root().RemoveChildAt(1)
+	doc.Root().Normalize()
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, "<a>x\ny\nz\t</a>")
+
+	doc = newDocumentFromString2(t, "<a>x&#10;y&#10;<![CDATA[c]]></a>", settings)
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<a>x&#xA;y&#xA;<![CDATA[c]]></a>")
+	doc.Root().Child[0].(*CharData).SetData("x\ny")
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<a>x\ny<![CDATA[c]]></a>")
+
+	// Large inputs are handled across read buffer boundaries.
+	long := "<a>" + strings.Repeat("<b>t&#10;u</b>", 1000) + strings.Repeat("v&#9;", 2000) + "</a>"
+	doc = newDocumentFromString2(t, long, ReadSettings{PreserveCharRefs: true})
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, strings.ReplaceAll(strings.ReplaceAll(long, "&#10;", "&#xA;"), "&#9;", "&#x9;"))
+
+	// Replacing text or tail text discards stale references.
+	doc = newDocumentFromString2(t, "<r>abc&#10;<b/>d&#10;</r>", ReadSettings{PreserveCharRefs: true})
+	doc.Root().SetText("x")
+	doc.Root().SelectElement("b").SetTail("y")
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<r>x<b/>y</r>")
+	doc = newDocumentFromString2(t, "<r>abc&#10;</r>", ReadSettings{PreserveCharRefs: true})
+	doc.Root().SetText("abcdefgh")
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<r>abcdefgh</r>")
+
+	// Copies do not share references with the original.
+	doc = newDocumentFromString2(t, "<r>a&#10;b&#10;</r>", ReadSettings{PreserveCharRefs: true})
+	cp := doc.Copy()
+	cd := doc.Root().Child[0].(*CharData)
+	cd.refs[0] = 0
+	s, _ = cp.WriteToString()
+	checkStrEq(t, s, "<r>a&#xA;b&#xA;</r>")
+
+	// Without the setting, references are decoded.
+	doc = newDocumentFromString(t, "<a>x&#10;y</a>")
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<a>x\ny</a>")
+}
+
 func TestEscapeCodes(t *testing.T) {
 	cases := []struct {
 		input         string
@@ -479,6 +820,272 @@ func TestCanonical(t *testing.T) {
 	checkStrEq(t, s, expected)
 }
 
+func TestStripBOM(t *testing.T) {
+	BOM := "\xef\xbb\xbf"
+	input := BOM + `<?xml version="1.0"?><root>x</root>`
+
+	doc := newDocumentFromString(t, input)
+	cd, ok := doc.Child[0].(*CharData)
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, cd.Data, BOM)
+
+	doc = newDocumentFromString2(t, input, ReadSettings{StripBOM: true})
+	_, ok = doc.Child[0].(*ProcInst)
+	checkBoolEq(t, ok, true)
+	checkIntEq(t, len(doc.Child), 2)
+	start, _, _ := doc.Root().SourceSpan()
+	checkIntEq(t, int(start), len(BOM)+21)
+	checkDocEq(t, doc, `<?xml version="1.0"?><root>x</root>`)
+
+	doc.WriteSettings.WriteBOM = true
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatalf("etree: WriteToString failed: %v", err)
+	}
+	checkStrEq(t, s, input)
+
+	// A BOM followed by text keeps the text.
+	doc = newDocumentFromString2(t, BOM+"\n<root/>", ReadSettings{StripBOM: true, PreserveCharRefs: true})
+	cd, ok = doc.Child[0].(*CharData)
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, cd.Data, "\n")
+	checkBoolEq(t, cd.IsWhitespace(), true)
+
+	// Without a leading BOM, StripBOM changes nothing, and WriteBOM doesn't
+	// write a second BOM when the document already begins with one.
+	doc = newDocumentFromString2(t, "<root>"+BOM+"</root>", ReadSettings{StripBOM: true})
+	checkStrEq(t, doc.Root().Text(), BOM)
+	doc = newDocumentFromString(t, input)
+	doc.WriteSettings.WriteBOM = true
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, input)
+}
+
+func TestPreserveUndefinedEntities(t *testing.T) {
+	input := `<root a="x &amp; y">Hello &name;, &amp; &bar;&bar;<b>&name;</b></root>`
+
+	doc := NewDocument()
+	if err := doc.ReadFromString(input); err == nil {
+		t.Error("etree: expected an error reading undefined entities")
+	}
+
+	settings := ReadSettings{PreserveUndefinedEntities: true}
+	doc = newDocumentFromString2(t, input, settings)
+	root := doc.Root()
+	checkStrEq(t, root.SelectAttrValue("a", ""), "x & y")
+	checkIntEq(t, len(root.Child), 6)
+	checkStrEq(t, root.Text(), "Hello ")
+
+	kinds := []string{}
+	for _, c := range root.Child {
+		kinds = append(kinds, TokenKind(c).String())
+	}
+	checkStrEq(t, strings.Join(kinds, ","), "CharData,EntityRef,CharData,EntityRef,EntityRef,Element")
+
+	ref, ok := AsEntityRef(root.Child[1])
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, ref.Name, "name")
+	checkIntEq(t, ref.Index(), 1)
+	checkBoolEq(t, ref.Parent() == root, true)
+
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatalf("etree: WriteToString failed: %v", err)
+	}
+	checkStrEq(t, s, input)
+
+	// Copies keep their entity references.
+	checkStrEq(t, root.Copy().SelectElement("b").Child[0].(*EntityRef).Name, "name")
+
+	// Input read from a stream is handled in the same way.
+	doc = NewDocument()
+	doc.ReadSettings = settings
+	if _, err := doc.ReadFrom(strings.NewReader(input)); err != nil {
+		t.Fatalf("etree: ReadFrom failed: %v", err)
+	}
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, input)
+
+	// Entities listed in the Entity map are still expanded.
+	settings.Entity = map[string]string{"name": "N"}
+	settings.ValidateInput = true
+	doc = newDocumentFromString2(t, input, settings)
+	checkStrEq(t, doc.Root().SelectElement("b").Text(), "N")
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<root a="x &amp; y">Hello N, &amp; &bar;&bar;<b>N</b></root>`)
+
+	// Text around references is trimmed and coalesced.
+	settings = ReadSettings{PreserveUndefinedEntities: true, TrimText: true, CoalesceText: true, PreserveCharRefs: true}
+	doc = newDocumentFromString2(t, "<r>\n  a<!---->b &x;&#10; c&y;  \n</r>", settings)
+	doc.Root().RemoveChildAt(1)
+	kinds = kinds[:0]
+	for _, c := range doc.Root().Child {
+		kinds = append(kinds, TokenKind(c).String())
+	}
+	checkStrEq(t, strings.Join(kinds, ","), "CharData,CharData,EntityRef,CharData,EntityRef")
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<r>ab &x;&#xA; c&y;</r>")
+
+	// Indentation leaves text containing references unchanged.
+	settings = ReadSettings{PreserveUndefinedEntities: true}
+	doc = newDocumentFromString2(t, "<r><p>Hello &name; world</p><p>&a; &b;</p><p>&a;<b/></p></r>", settings)
+	for i := 0; i < 2; i++ {
+		doc.Indent(2)
+		s, _ = doc.WriteToString()
+		checkStrEq(t, s, "<r>\n  <p>Hello &name; world</p>\n  <p>&a; &b;</p>\n  <p>&a;\n    <b/>\n  </p>\n</r>\n")
+	}
+	checkStrEq(t, doc.FindElement("r/p").Text(), "Hello ")
+	indent := NewIndentSettings()
+	indent.Spaces = 2
+	doc.FindElement("r/p[3]/b").ReindentSelf(indent)
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<r>\n  <p>Hello &name; world</p>\n  <p>&a; &b;</p>\n  <p>&a;\n    <b/>\n  </p>\n</r>\n")
+
+	// References within attribute values and malformed references are
+	// reported, unless the input is permissive.
+	for _, bad := range []string{`<r a="&x;"/>`, `<r>&x y;</r>`, `<r>&#xZ;</r>`, `<r a=x/>`, `<r a/>`} {
+		doc = NewDocument()
+		doc.ReadSettings = ReadSettings{PreserveUndefinedEntities: true}
+		if err := doc.ReadFromString(bad); err == nil {
+			t.Errorf("etree: expected an error reading %s", bad)
+		}
+	}
+	settings = ReadSettings{PreserveUndefinedEntities: true, Permissive: true}
+	doc = newDocumentFromString2(t, `<r a="&x;">&y;</r>`, settings)
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<r a="&amp;x;">&y;</r>`)
+	settings = ReadSettings{PreserveUndefinedEntities: true, LenientAttrs: true}
+	doc = newDocumentFromString2(t, `<r a b=c>&y;</r>`, settings)
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<r a="a" b="c">&y;</r>`)
+
+	doc = NewDocument()
+	doc.CreateElement("p").CreateEntityRef("nbsp")
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<p>&nbsp;</p>`)
+}
+
+func TestExplicitCloseTags(t *testing.T) {
+	doc := newDocumentFromString(t, `<html><head><script src="a.js"/><h:script/><meta/></head><div/><div>x</div></html>`)
+	doc.WriteSettings.ExplicitCloseTags = []string{"script", "div"}
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal("etree: failed to write document")
+	}
+	checkStrEq(t, s, `<html><head><script src="a.js"></script><h:script></h:script><meta/></head><div></div><div>x</div></html>`)
+
+	doc.WriteSettings.ExplicitCloseTags = nil
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<html><head><script src="a.js"/><h:script/><meta/></head><div/><div>x</div></html>`)
+}
+
+func TestEscapeAttrWhitespace(t *testing.T) {
+	doc := NewDocument()
+	e := doc.CreateElement("e")
+	e.CreateAttr("ws", "a\tb\nc\r\nd <'\">&")
+	e.SetText("x\ty\nz")
+
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, "<e ws=\"a\tb\nc\r\nd &lt;&apos;&quot;&gt;&amp;\">x\ty\nz</e>")
+
+	doc.WriteSettings.EscapeAttrWhitespace = true
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<e ws="a&#x9;b&#xA;c&#xD;&#xA;d &lt;&apos;&quot;&gt;&amp;">x`+"\ty\nz</e>")
+
+	doc.WriteSettings.AttrSingleQuote = true
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<e ws='a&#x9;b&#xA;c&#xD;&#xA;d &lt;&apos;&quot;&gt;&amp;'>x`+"\ty\nz</e>")
+
+	// Round-trip the attribute value through the parser.
+	doc2 := newDocumentFromString(t, s)
+	checkStrEq(t, doc2.Root().SelectAttrValue("ws", ""), "a\tb\nc\r\nd <'\">&")
+}
+
+func TestEscapeString(t *testing.T) {
+	s := "a&b<c>d'e\"f\tg\nh\ri"
+	checkStrEq(t, EscapeString(s, EscapeNormal), "a&amp;b&lt;c&gt;d&apos;e&quot;f\tg\nh\ri")
+	checkStrEq(t, EscapeString(s, EscapeAttrWhitespace), "a&amp;b&lt;c&gt;d&apos;e&quot;f&#x9;g&#xA;h&#xD;i")
+	checkStrEq(t, EscapeString(s, EscapeCanonicalText), "a&amp;b&lt;c&gt;d'e\"f\tg\nh&#xD;i")
+	checkStrEq(t, EscapeString(s, EscapeCanonicalAttr), "a&amp;b&lt;c>d'e&quot;f&#x9;g&#xA;h&#xD;i")
+	checkStrEq(t, EscapeString("a\x00b", EscapeNormal), "a�b")
+
+	for _, mode := range []EscapeMode{EscapeNormal, EscapeAttrWhitespace, EscapeCanonicalText, EscapeCanonicalAttr} {
+		checkStrEq(t, UnescapeString(EscapeString(s, mode)), s)
+	}
+
+	tests := []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"&lt;a&gt; &amp;&amp; &quot;b&apos;", `<a> && "b'`},
+		{"&#65;&#x42;&#X43;", "AB&#X43;"},
+		{"&&amp;", "&&"},
+		{"&unknown; &amp", "&unknown; &amp"},
+		{"&#0; &#xFFFFFFFF; &#;", "&#0; &#xFFFFFFFF; &#;"},
+	}
+	for _, test := range tests {
+		checkStrEq(t, UnescapeString(test.in), test.out)
+	}
+}
+
+func TestErrorOnInvalidChar(t *testing.T) {
+	tests := []struct {
+		text, attr string
+		valid      bool
+	}{
+		{"ok \uFFFD text", "ok", true},
+		{"bad \u0001 text", "ok", false},
+		{"ok", "bad \x1f attr", false},
+		{"bad \xff utf-8", "ok", false},
+	}
+
+	for _, test := range tests {
+		doc := NewDocument()
+		root := doc.CreateElement("root")
+		root.CreateAttr("a", test.attr)
+		root.SetText(test.text)
+
+		s, err := doc.WriteToString()
+		if err != nil {
+			t.Errorf("etree: unexpected error with default settings: %v", err)
+		}
+		checkBoolEq(t, strings.Contains(s, "\uFFFD"), !test.valid || strings.Contains(test.text, "\uFFFD"))
+
+		doc.WriteSettings.ErrorOnInvalidChar = true
+		_, err = doc.WriteToString()
+		if test.valid && err != nil {
+			t.Errorf("etree: unexpected error: %v", err)
+		}
+		if !test.valid && err != ErrInvalidChar {
+			t.Errorf("etree: expected ErrInvalidChar for %q, got %v", test.text+test.attr, err)
+		}
+	}
+
+	// Other kinds of tokens are checked, and nothing is written on error.
+	tokens := []Token{
+		NewCData("bad \u0001"),
+		NewComment("bad \u0001"),
+		NewDirective("bad \u0001"),
+		NewProcInst("pi", "bad \u0001"),
+	}
+	for _, tok := range tokens {
+		doc := NewDocument()
+		doc.WriteSettings.ErrorOnInvalidChar = true
+		root := doc.CreateElement("root")
+		root.CreateText(strings.Repeat("x", 8192))
+		root.AddChild(tok)
+
+		var b bytes.Buffer
+		n, err := doc.WriteTo(&b)
+		if err != ErrInvalidChar {
+			t.Errorf("etree: expected ErrInvalidChar for %s, got %v", TokenKind(tok), err)
+		}
+		checkIntEq(t, int(n), 0)
+		checkIntEq(t, b.Len(), 0)
+	}
+}
+
 func TestCopy(t *testing.T) {
 	s := `<store>
 	<book lang="en">
@@ -521,6 +1128,58 @@ func TestCopy(t *testing.T) {
 	}
 }
 
+func TestCloneAfter(t *testing.T) {
+	doc := newDocumentFromString(t, `<table><tr id="1"><td>a</td></tr><tr id="2"/></table>`)
+	row := doc.FindElement("//tr[@id='1']")
+
+	c := row.CloneAfter()
+	checkBoolEq(t, c.Parent() == row.Parent(), true)
+	checkIntEq(t, c.Index(), 1)
+	c.SelectAttr("id").Value = "1b"
+	c.FindElement("td").SetText("b")
+	checkDocEq(t, doc, `<table><tr id="1"><td>a</td></tr><tr id="1b"><td>b</td></tr><tr id="2"/></table>`)
+	checkIndexes(t, &doc.Element)
+
+	last := doc.FindElement("//tr[@id='2']").CloneAfter()
+	checkIntEq(t, last.Index(), 3)
+	checkDocEq(t, doc, `<table><tr id="1"><td>a</td></tr><tr id="1b"><td>b</td></tr><tr id="2"/><tr id="2"/></table>`)
+
+	orphan := NewElement("orphan")
+	c = orphan.CloneAfter()
+	checkBoolEq(t, c != orphan, true)
+	checkBoolEq(t, c.Parent() == nil, true)
+	checkStrEq(t, c.Tag, "orphan")
+}
+
+func TestDocumentReset(t *testing.T) {
+	doc := NewDocument()
+	doc.ReadSettings.TrimText = true
+	doc.WriteSettings.CanonicalEndTags = true
+	if err := doc.ReadFromString(`<?pi x?><!--c--><root><a> text </a></root>`); err != nil {
+		t.Fatalf("etree: failed to read document: %v", err)
+	}
+	old := doc.Root()
+	capacity := cap(doc.Child)
+
+	doc.Reset()
+	checkIntEq(t, len(doc.Child), 0)
+	checkIntEq(t, cap(doc.Child), capacity)
+	checkBoolEq(t, doc.Root() == nil, true)
+	checkBoolEq(t, old.Parent() == nil, true)
+	checkIntEq(t, old.Index(), -1)
+
+	if err := doc.ReadFromString(`<other><b> more </b></other>`); err != nil {
+		t.Fatalf("etree: failed to read document: %v", err)
+	}
+	checkStrEq(t, doc.FindElement("//b").Text(), "more")
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, `<other><b>more</b></other>`)
+	checkIndexes(t, &doc.Element)
+
+	// The detached tree is unaffected.
+	checkStrEq(t, old.SelectElement("a").Text(), "text")
+}
+
 func TestGetPath(t *testing.T) {
 	s := `<a>
  <b1>
@@ -581,6 +1240,32 @@ func TestGetPath(t *testing.T) {
 	}
 }
 
+func TestCompiledPath(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><b/><p:b/><b><c/><c/></b><x:c/></a>`)
+
+	// Each element is located by its compiled path, from any element.
+	for _, e := range append(doc.FindElements("//*"), &doc.Element) {
+		p := e.CompiledPath()
+		checkElementEq(t, doc.FindElementPath(p), e)
+		checkElementEq(t, doc.FindElement("//c").FindElementPath(p), e)
+		checkIntEq(t, len(doc.FindElementsPath(p)), 1)
+	}
+
+	// Unparented trees are supported.
+	root := NewElement("r")
+	child := root.CreateElement("s")
+	root.CreateElement("s")
+	checkElementEq(t, root.FindElementPath(child.CompiledPath()), child)
+	checkElementEq(t, root.FindElementPath(root.CompiledPath()), root)
+
+	// Paths resolve against copies of the tree.
+	c := doc.FindElements("//b/c")[1]
+	cp := doc.Copy()
+	found := cp.FindElementPath(c.CompiledPath())
+	checkIntEq(t, found.Index(), 1)
+	checkStrEq(t, found.GetPath(), "/a/b/c")
+}
+
 func TestInsertChild(t *testing.T) {
 	s := `<book lang="en">
   <t:title>Great Expectations</t:title>
@@ -672,6 +1357,44 @@ func TestCdata(t *testing.T) {
 	}
 }
 
+func TestCoalesceText(t *testing.T) {
+	var tests = []struct {
+		in                string
+		text              string
+		tokens            int
+		tokensPreserve    int
+		textPreserve      string
+		outputPreserve    string
+		firstIsWhitespace bool
+	}{
+		{`<tag>1234567</tag>`, "1234567", 1, 1, "1234567", `<tag>1234567</tag>`, false},
+		{`<tag><![CDATA[1234567]]></tag>`, "1234567", 1, 1, "1234567", `<tag><![CDATA[1234567]]></tag>`, false},
+		{`<tag>1<![CDATA[2]]>3<![CDATA[4]]>5<![CDATA[6]]>7</tag>`, "1234567", 1, 7, "1234567", `<tag>1<![CDATA[2]]>3<![CDATA[4]]>5<![CDATA[6]]>7</tag>`, false},
+		{`<tag>1<![CDATA[2]]>3<inner>4</inner>5<![CDATA[6]]>7</tag>`, "123", 3, 7, "123", `<tag>1<![CDATA[2]]>3<inner>4</inner>5<![CDATA[6]]>7</tag>`, false},
+		{`<tag>1<inner>4</inner>5<![CDATA[6]]>7</tag>`, "1", 3, 5, "1", `<tag>1<inner>4</inner>5<![CDATA[6]]>7</tag>`, false},
+		{`<tag><![CDATA[1]]><inner>4</inner>5<![CDATA[6]]>7</tag>`, "1", 3, 5, "1", `<tag><![CDATA[1]]><inner>4</inner>5<![CDATA[6]]>7</tag>`, false},
+		{`<tag> <![CDATA[ ]]> <inner/></tag>`, "   ", 2, 4, "   ", `<tag> <![CDATA[ ]]> <inner/></tag>`, true},
+		{`<tag><![CDATA[1]]><![CDATA[2]]></tag>`, "12", 1, 1, "12", `<tag><![CDATA[12]]></tag>`, false},
+	}
+
+	for _, test := range tests {
+		doc := newDocumentFromString2(t, test.in, ReadSettings{CoalesceText: true})
+		tag := doc.FindElement("tag")
+		checkStrEq(t, tag.Text(), test.text)
+		checkIntEq(t, len(tag.Child), test.tokens)
+		checkBoolEq(t, tag.Child[0].(*CharData).IsWhitespace(), test.firstIsWhitespace)
+		checkIndexes(t, &doc.Element)
+
+		doc = newDocumentFromString2(t, test.in, ReadSettings{CoalesceText: true, PreserveCData: true})
+		tag = doc.FindElement("tag")
+		checkStrEq(t, tag.Text(), test.textPreserve)
+		checkIntEq(t, len(tag.Child), test.tokensPreserve)
+		checkIndexes(t, &doc.Element)
+		output, _ := doc.WriteToString()
+		checkStrEq(t, output, test.outputPreserve)
+	}
+}
+
 func TestAddChild(t *testing.T) {
 	s := `<book lang="en">
   <t:title>Great Expectations</t:title>
@@ -703,36 +1426,368 @@ func TestAddChild(t *testing.T) {
 	checkStrEq(t, s2, expected2)
 }
 
-func TestSetRoot(t *testing.T) {
-	s := `<?test a="wow"?>
-<book>
-  <title>Great Expectations</title>
-  <author>Charles Dickens</author>
-</book>
-`
-	doc := newDocumentFromString(t, s)
+func TestAddChildReparent(t *testing.T) {
+	s := `<root><a/><b><c/></b><d/></root>`
+	doc1 := newDocumentFromString(t, s)
+	doc2 := newDocumentFromString(t, `<dest><x/></dest>`)
+
+	src := doc1.Root()
+	dest := doc2.Root()
+
+	// Move an element between trees using AddChild.
+	c := doc1.FindElement("//c")
+	b := c.Parent()
+	dest.AddChild(c)
+	checkElementEq(t, c.Parent(), dest)
+	checkIntEq(t, c.Index(), 1)
+	checkIntEq(t, len(b.Child), 0)
+	checkIndexes(t, &doc1.Element)
+	checkIndexes(t, &doc2.Element)
+	if doc1.FindElement("//c") != nil {
+		t.Error("etree: AddChild failed to detach token from source tree")
+	}
 
-	origroot := doc.Root()
-	if origroot.Parent() != &doc.Element {
-		t.Error("Root incorrect")
+	// Move an element between trees using InsertChildAt.
+	a := src.SelectElement("a")
+	dest.InsertChildAt(0, a)
+	checkElementEq(t, a.Parent(), dest)
+	checkIntEq(t, a.Index(), 0)
+	checkIntEq(t, len(src.Child), 2)
+	checkIndexes(t, &doc1.Element)
+	checkIndexes(t, &doc2.Element)
+	if src.SelectElement("a") != nil {
+		t.Error("etree: InsertChildAt failed to detach token from source tree")
 	}
 
-	newroot := NewElement("root")
-	doc.SetRoot(newroot)
+	// Move an element within the same parent.
+	dest.InsertChildAt(len(dest.Child), a)
+	checkIntEq(t, len(dest.Child), 3)
+	checkIntEq(t, a.Index(), 2)
+	checkIndexes(t, &doc2.Element)
 
-	if doc.Root() != newroot {
-		t.Error("doc.Root() != newroot")
+	checkDocEq(t, doc1, `<root><b/><d/></root>`)
+	checkDocEq(t, doc2, `<dest><x/><c/><a/></dest>`)
+}
+
+func TestInsertUnparentedTokens(t *testing.T) {
+	doc := newDocumentFromString(t, `<config><a/><b/></config>`)
+	root := doc.Root()
+
+	b := root.SelectElement("b")
+	root.InsertChildAt(b.Index(), NewComment("about b"))
+	root.InsertChildAt(0, NewProcInst("pi", "data"))
+	root.InsertChildAt(0, NewDirective("DOCTYPE x"))
+	checkIndexes(t, &doc.Element)
+	checkDocEq(t, doc, `<config><!DOCTYPE x><?pi data?><a/><!--about b--><b/></config>`)
+}
+
+func TestCreateElementBeforeAfter(t *testing.T) {
+	doc := newDocumentFromString(t, `<root>text<a/><!--c--><b/></root>`)
+	root := doc.Root()
+	a := root.SelectElement("a")
+	b := root.SelectElement("b")
+
+	x := root.CreateElementBefore(a, "x")
+	x.CreateText("1")
+	y := root.CreateElementAfter(a, "p:y")
+	z := root.CreateElementAfter(b, "z")
+	checkDocEq(t, doc, `<root>text<x>1</x><a/><p:y/><!--c--><b/><z/></root>`)
+
+	checkElementEq(t, y.Parent(), root)
+	checkStrEq(t, y.Space, "p")
+	checkIndexes(t, &doc.Element)
+	checkIntEq(t, x.Index(), 1)
+	checkIntEq(t, z.Index(), 6)
+
+	// Nothing is created when the reference element is not a child.
+	other := NewElement("other")
+	if e := root.CreateElementBefore(other, "w"); e != nil {
+		t.Errorf("etree: CreateElementBefore with a non-child returned %v, wanted nil", e.Tag)
 	}
-	if origroot.Parent() != nil {
-		t.Error("origroot.Parent() != nil")
+	if e := root.CreateElementAfter(nil, "v"); e != nil {
+		t.Errorf("etree: CreateElementAfter with a nil element returned %v, wanted nil", e.Tag)
+	}
+	if e := doc.CreateElementAfter(x, "u"); e != nil {
+		t.Errorf("etree: CreateElementAfter with a grandchild returned %v, wanted nil", e.Tag)
 	}
+	checkIntEq(t, len(doc.Child), 1)
+	checkIntEq(t, len(root.Child), 7)
+}
 
-	expected1 := `<?test a="wow"?>
-<root/>
-`
-	doc.Indent(2)
-	s1, _ := doc.WriteToString()
-	checkStrEq(t, s1, expected1)
+func TestTransferChildren(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a>text<b/><!--c--><d/></a><e><f/></e></root>`)
+	a := doc.FindElement("//a")
+	e := doc.FindElement("//e")
+
+	a.TransferChildren(e)
+	checkIntEq(t, len(a.Child), 0)
+	checkIntEq(t, len(e.Child), 5)
+	for _, c := range e.Child {
+		if c.Parent() != e {
+			t.Error("etree: TransferChildren failed to reparent child")
+		}
+	}
+	checkIndexes(t, &doc.Element)
+	checkDocEq(t, doc, `<root><a/><e><f/>text<b/><!--c--><d/></e></root>`)
+
+	// Transferring to nil, self or a descendant is a no-op.
+	root := doc.Root()
+	root.TransferChildren(nil)
+	root.TransferChildren(root)
+	root.TransferChildren(e)
+	checkDocEq(t, doc, `<root><a/><e><f/>text<b/><!--c--><d/></e></root>`)
+}
+
+func TestUnwrap(t *testing.T) {
+	doc := newDocumentFromString(t, `<root>
+  <x/>
+  <div>
+    <a/>
+    text
+    <b/>
+  </div>
+  <y/>
+</root>`)
+	div := doc.FindElement("//div")
+	div.Unwrap()
+	checkIntEq(t, len(div.Child), 0)
+	if div.Parent() != nil {
+		t.Error("etree: Unwrap failed to detach wrapper element")
+	}
+	for _, c := range doc.Root().Child {
+		if c.Parent() != doc.Root() {
+			t.Error("etree: Unwrap failed to reparent child")
+		}
+	}
+	checkIndexes(t, &doc.Element)
+
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal("etree: failed to write document")
+	}
+	checkStrEq(t, s, `<root>
+  <x/>
+  
+    <a/>
+    text
+    <b/>
+  
+  <y/>
+</root>`)
+
+	// Unwrapping a detached element does nothing.
+	e := NewElement("e")
+	e.CreateElement("f")
+	e.Unwrap()
+	checkIntEq(t, len(e.Child), 1)
+}
+
+func TestClear(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><p:a x="1" y="2">text<b/><!--c--></p:a></root>`)
+	a := doc.FindElement("//a")
+	b := a.SelectElement("b")
+
+	a.ClearContent()
+	checkDocEq(t, doc, `<root><p:a x="1" y="2"/></root>`)
+	checkIntEq(t, len(a.Child), 0)
+	checkBoolEq(t, b.Parent() == nil, true)
+	checkIntEq(t, b.Index(), -1)
+
+	a.CreateText("more")
+	a.Clear()
+	checkDocEq(t, doc, `<root><p:a/></root>`)
+	checkStrEq(t, a.FullTag(), "p:a")
+	checkIntEq(t, len(a.Attr), 0)
+
+	// A cleared element may be reused.
+	a.CreateAttr("z", "3")
+	b.SetText("b")
+	a.AddChild(b)
+	checkDocEq(t, doc, `<root><p:a z="3"><b>b</b></p:a></root>`)
+	checkIndexes(t, &doc.Element)
+}
+
+func TestInnerXML(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a x="1">text<b>&amp;</b><!--c--></a></root>`)
+	a := doc.FindElement("//a")
+
+	s, err := a.InnerXML()
+	if err != nil {
+		t.Fatalf("etree: InnerXML failed: %v", err)
+	}
+	checkStrEq(t, s, `text<b>&amp;</b><!--c-->`)
+
+	var buf bytes.Buffer
+	n, err := a.WriteInnerXMLTo(&buf, WriteSettings{CanonicalEndTags: true})
+	if err != nil {
+		t.Fatalf("etree: WriteInnerXMLTo failed: %v", err)
+	}
+	checkIntEq(t, int(n), buf.Len())
+	checkStrEq(t, buf.String(), `text<b>&amp;</b><!--c-->`)
+
+	s, err = NewElement("empty").InnerXML()
+	if err != nil {
+		t.Fatalf("etree: InnerXML failed: %v", err)
+	}
+	checkStrEq(t, s, "")
+
+	old := a.SelectElement("b")
+	err = a.SetInnerXML(`new <c y="2"/><d>d</d>`)
+	if err != nil {
+		t.Fatalf("etree: SetInnerXML failed: %v", err)
+	}
+	checkDocEq(t, doc, `<root><a x="1">new <c y="2"/><d>d</d></a></root>`)
+	checkBoolEq(t, old.Parent() == nil, true)
+	checkIndexes(t, &doc.Element)
+
+	// A malformed fragment leaves the element unchanged.
+	err = a.SetInnerXML(`<e>`)
+	if err == nil {
+		t.Error("etree: SetInnerXML accepted a malformed fragment")
+	}
+	checkDocEq(t, doc, `<root><a x="1">new <c y="2"/><d>d</d></a></root>`)
+}
+
+func TestTokenKind(t *testing.T) {
+	doc := newDocumentFromString(t, `<?pi x?><!DOCTYPE r><root>text<!--c--><a/></root>`)
+	root := doc.Root()
+
+	kinds := []Kind{}
+	for _, c := range doc.Child {
+		kinds = append(kinds, TokenKind(c))
+	}
+	for _, c := range root.Child {
+		kinds = append(kinds, TokenKind(c))
+	}
+	want := []Kind{KindProcInst, KindDirective, KindElement, KindCharData, KindComment, KindElement}
+	checkIntEq(t, len(kinds), len(want))
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Errorf("etree: token %d has kind %v, wanted %v", i, kinds[i], want[i])
+		}
+	}
+	checkStrEq(t, TokenKind(nil).String(), "None")
+	checkStrEq(t, KindCharData.String(), "CharData")
+
+	e, ok := AsElement(root.Child[2])
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, e.Tag, "a")
+	_, ok = AsElement(root.Child[0])
+	checkBoolEq(t, ok, false)
+
+	cd, ok := AsCharData(root.Child[0])
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, cd.Data, "text")
+	cm, ok := AsComment(root.Child[1])
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, cm.Data, "c")
+	d, ok := AsDirective(doc.Child[1])
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, d.Data, "DOCTYPE r")
+	p, ok := AsProcInst(doc.Child[0])
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, p.Target, "pi")
+	_, ok = AsProcInst(nil)
+	checkBoolEq(t, ok, false)
+}
+
+func TestEachAttrAndChild(t *testing.T) {
+	doc := newDocumentFromString(t, `<root a="1" p:b="2">text<x/><!--c--><y/></root>`)
+	root := doc.Root()
+
+	var keys []string
+	root.EachAttr(func(a *Attr) {
+		keys = append(keys, a.FullKey())
+		a.Value += "0"
+	})
+	checkStrEq(t, strings.Join(keys, ","), "a,p:b")
+	checkDocEq(t, doc, `<root a="10" p:b="20">text<x/><!--c--><y/></root>`)
+
+	var tags []string
+	root.EachChildElement(func(c *Element) {
+		tags = append(tags, c.Tag)
+	})
+	checkStrEq(t, strings.Join(tags, ","), "x,y")
+
+	NewElement("empty").EachChildElement(func(c *Element) {
+		t.Error("etree: EachChildElement visited a child of an empty element")
+	})
+}
+
+func TestFirstLastChildElement(t *testing.T) {
+	doc := newDocumentFromString(t, `<list>
+	<!--items-->
+	<item id="1"/>
+	<item id="2"/>
+	<item id="3"/>
+	text
+</list>`)
+	list := doc.Root()
+	checkStrEq(t, list.FirstChildElement().SelectAttrValue("id", ""), "1")
+	checkStrEq(t, list.LastChildElement().SelectAttrValue("id", ""), "3")
+
+	only := NewElement("only")
+	c := only.CreateElement("c")
+	checkBoolEq(t, only.FirstChildElement() == c, true)
+	checkBoolEq(t, only.LastChildElement() == c, true)
+
+	empty := NewElement("empty")
+	empty.CreateText("text")
+	checkBoolEq(t, empty.FirstChildElement() == nil, true)
+	checkBoolEq(t, empty.LastChildElement() == nil, true)
+}
+
+func TestAddChildren(t *testing.T) {
+	old := newDocumentFromString(t, `<old><moved/></old>`)
+	moved := old.FindElement("//moved")
+
+	doc := NewDocument()
+	root := doc.CreateElement("root").AddChildren(
+		NewElement("a").WithAttr("x", "1").WithAttr("y", "2").WithText("text"),
+		NewComment("comment"),
+		NewElement("b").AddChildren(
+			NewElement("c").WithText("c1").WithText("c2"),
+			moved,
+		),
+	)
+
+	checkElementEq(t, doc.Root(), root)
+	checkElementEq(t, moved.Parent(), root.SelectElement("b"))
+	checkIntEq(t, len(old.Root().Child), 0)
+	checkIndexes(t, &doc.Element)
+	checkDocEq(t, doc, `<root><a x="1" y="2">text</a><!--comment--><b><c>c2</c><moved/></b></root>`)
+}
+
+func TestSetRoot(t *testing.T) {
+	s := `<?test a="wow"?>
+<book>
+  <title>Great Expectations</title>
+  <author>Charles Dickens</author>
+</book>
+`
+	doc := newDocumentFromString(t, s)
+
+	origroot := doc.Root()
+	if origroot.Parent() != &doc.Element {
+		t.Error("Root incorrect")
+	}
+
+	newroot := NewElement("root")
+	doc.SetRoot(newroot)
+
+	if doc.Root() != newroot {
+		t.Error("doc.Root() != newroot")
+	}
+	if origroot.Parent() != nil {
+		t.Error("origroot.Parent() != nil")
+	}
+
+	expected1 := `<?test a="wow"?>
+<root/>
+`
+	doc.Indent(2)
+	s1, _ := doc.WriteToString()
+	checkStrEq(t, s1, expected1)
 
 	doc.SetRoot(origroot)
 	doc.Indent(2)
@@ -770,6 +1825,35 @@ func TestSortAttrs(t *testing.T) {
 	checkStrEq(t, out, `<el AAA="1" Foo="2" a01="3" aaa="4" foo="5" z="6" สวัสดี="7" a:AAA="8" a:ZZZ="9"/>`+"\n")
 }
 
+func TestSortAttrsCanonical(t *testing.T) {
+	s := `<root xmlns:z="urn:a" xmlns:a="urn:z"><el z:b="1" a:a="2" b="3" xml:lang="en" xmlns:c="urn:m" a="4" c:a="5" xmlns="urn:default" z:a="6"/></root>`
+	doc := newDocumentFromString(t, s)
+	el := doc.FindElement("//el")
+	el.SortAttrsCanonical()
+	out, _ := doc.WriteToString()
+	checkStrEq(t, out, `<root xmlns:z="urn:a" xmlns:a="urn:z"><el xmlns="urn:default" xmlns:c="urn:m" a="4" b="3" xml:lang="en" z:a="6" z:b="1" c:a="5" a:a="2"/></root>`)
+}
+
+func TestSetAttrs(t *testing.T) {
+	doc := newDocumentFromString(t, `<el b="0"/>`)
+	el := doc.Root()
+	el.SetAttrs(
+		Attr{Key: "a", Value: "1"},
+		Attr{Key: "b", Value: "2"},
+		Attr{Space: "x", Key: "b", Value: "3"},
+		Attr{Key: "a", Value: "4"},
+	)
+	checkIntEq(t, len(el.Attr), 3)
+	for _, a := range el.Attr {
+		if a.Element() != el {
+			t.Errorf("etree: attribute %s has incorrect parent", a.FullKey())
+		}
+	}
+
+	out, _ := doc.WriteToString()
+	checkStrEq(t, out, `<el b="2" a="4" x:b="3"/>`)
+}
+
 func TestCharsetReaderDefaultSetting(t *testing.T) {
 	// Test encodings where the default pass-through charset conversion
 	// should work for common single-byte character encodings.
@@ -817,6 +1901,60 @@ func TestCharData(t *testing.T) {
 	}
 }
 
+func TestCharDataSetCData(t *testing.T) {
+	doc := NewDocument()
+	root := doc.CreateElement("root")
+	cd := root.CreateText("a < b ]]> c")
+	ws := root.CreateText(" ")
+	ws.SetData(" ")
+
+	cd.SetCData(true)
+	checkBoolEq(t, cd.IsCData(), true)
+	checkStrEq(t, cd.Data, "a < b ]]> c")
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, `<root><![CDATA[a < b ]]]]><![CDATA[> c]]> </root>`)
+
+	doc2 := newDocumentFromString(t, s)
+	checkStrEq(t, doc2.Root().Text(), "a < b ]]> c ")
+
+	cd.SetCData(false)
+	checkBoolEq(t, cd.IsCData(), false)
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<root>a &lt; b ]]&gt; c </root>`)
+
+	ws.SetCData(true)
+	checkBoolEq(t, ws.IsWhitespace(), false)
+	ws.SetCData(false)
+	checkBoolEq(t, ws.IsWhitespace(), true)
+}
+
+func TestCharDataRawText(t *testing.T) {
+	doc := NewDocument()
+	root := doc.CreateElement("root")
+	root.CreateText("a & b ")
+	raw := root.CreateRawText("c &amp; <b>d</b>")
+	checkBoolEq(t, raw.IsRaw(), true)
+
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, `<root>a &amp; b c &amp; <b>d</b></root>`)
+
+	doc2 := newDocumentFromString(t, s)
+	checkStrEq(t, doc2.Root().Text(), "a & b c & ")
+	checkStrEq(t, doc2.FindElement("//b").Text(), "d")
+
+	raw.SetData("x < y")
+	checkBoolEq(t, raw.IsRaw(), true)
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<root>a &amp; b x < y</root>`)
+
+	raw.SetCData(false)
+	checkBoolEq(t, raw.IsRaw(), false)
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<root>a &amp; b x &lt; y</root>`)
+
+	checkBoolEq(t, NewRawText("&lt;").dup(nil).(*CharData).IsRaw(), true)
+}
+
 func TestIndentSimple(t *testing.T) {
 	doc := NewDocument()
 	root := doc.CreateElement("root")
@@ -1006,6 +2144,314 @@ func TestIndentPreserveWhitespace(t *testing.T) {
 	}
 }
 
+func TestIndentLeafWhitespace(t *testing.T) {
+	doc := newDocumentFromString(t, "<book><editor>\n\t\t</editor><title/></book>")
+	checkStrEq(t, doc.FindElement("//editor").Text(), "\n\t\t")
+
+	// Whitespace content survives repeated indentation when leaf whitespace
+	// is preserved.
+	s := NewIndentSettings()
+	s.Spaces = 2
+	s.PreserveLeafWhitespace = true
+	for i := 0; i < 2; i++ {
+		doc.IndentWithSettings(s)
+		checkStrEq(t, doc.FindElement("//editor").Text(), "\n\t\t")
+		output, _ := doc.WriteToString()
+		checkStrEq(t, output, "<book>\n  <editor>\n\t\t</editor>\n  <title/>\n</book>\n")
+	}
+}
+
+func TestIndentPreserveWhitespaceReindent(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a><b/></a></root>`)
+
+	s := NewIndentSettings()
+	s.Spaces = 2
+	s.PreserveLeafWhitespace = true
+	s.SuppressTrailingWhitespace = true
+	doc.IndentWithSettings(s)
+
+	// Replace the child element with meaningful whitespace. The indentation
+	// inserted after the removed child must not cause that whitespace to be
+	// discarded when the document is indented again.
+	a := doc.FindElement("root/a")
+	a.SetText("   ")
+	a.RemoveChild(a.SelectElement("b"))
+	doc.IndentWithSettings(s)
+
+	output, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal("etree: failed to write string")
+	}
+	checkStrEq(t, output, "<root>\n  <a>   </a>\n</root>")
+
+	doc.IndentWithSettings(s)
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\n  <a>   </a>\n</root>")
+}
+
+func TestIndentInlineSingleChild(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><name><first>John</first></name><a><b><c/></b></a><d><e/><f/></d><g><h/></g></root>`)
+
+	s := NewIndentSettings()
+	s.Spaces = 2
+	s.InlineSingleChild = true
+	s.SuppressTrailingWhitespace = true
+	doc.IndentWithSettings(s)
+
+	expected := `<root>
+  <name><first>John</first></name>
+  <a>
+    <b><c/></b>
+  </a>
+  <d>
+    <e/>
+    <f/>
+  </d>
+  <g><h/></g>
+</root>`
+	output, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal("etree: failed to write string")
+	}
+	checkStrEq(t, output, expected)
+
+	// Re-indenting without the setting breaks the inline elements.
+	s.InlineSingleChild = false
+	doc.IndentWithSettings(s)
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\n  <name>\n    <first>John</first>\n  </name>\n  <a>\n    <b>\n      <c/>\n    </b>\n  </a>\n  <d>\n    <e/>\n    <f/>\n  </d>\n  <g>\n    <h/>\n  </g>\n</root>")
+}
+
+func TestIndentLeafText(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><name>John</name><empty/><ws> </ws><mixed>a<b/></mixed></root>`)
+
+	s := NewIndentSettings()
+	s.Spaces = 2
+	s.IndentLeafText = true
+	doc.IndentWithSettings(s)
+	expected := "<root>\n  <name>\n    John\n  </name>\n  <empty/>\n  <ws/>\n  <mixed>a\n    <b/>\n  </mixed>\n</root>\n"
+	output, _ := doc.WriteToString()
+	checkStrEq(t, output, expected)
+
+	// The inserted whitespace becomes part of the text, including for
+	// consumers of the written document.
+	checkStrEq(t, doc.FindElement("//name").Text(), "\n    John\n  ")
+	checkStrEq(t, newDocumentFromString(t, output).FindElement("//name").Text(), "\n    John\n  ")
+
+	// Re-indenting is stable, and turning the setting off again removes the
+	// inserted whitespace.
+	doc.IndentWithSettings(s)
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, expected)
+
+	s.IndentLeafText = false
+	doc.IndentWithSettings(s)
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\n  <name>John</name>\n  <empty/>\n  <ws/>\n  <mixed>a\n    <b/>\n  </mixed>\n</root>\n")
+	checkStrEq(t, doc.FindElement("//name").Text(), "John")
+
+	// A root element holding only text is also affected.
+	doc = newDocumentFromString(t, `<root>text</root>`)
+	s.IndentLeafText = true
+	doc.IndentWithSettings(s)
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\n  text\n</root>\n")
+}
+
+func TestIndentWith(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a><b/></a></root>`)
+
+	err := doc.IndentWith("\t  ")
+	if err != nil {
+		t.Fatalf("etree: IndentWith failed: %v", err)
+	}
+	output, _ := doc.WriteToString()
+	checkStrEq(t, output, "<root>\n\t  <a>\n\t  \t  <b/>\n\t  </a>\n</root>\n")
+
+	err = doc.IndentWith("")
+	if err != nil {
+		t.Fatalf("etree: IndentWith failed: %v", err)
+	}
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\n<a>\n<b/>\n</a>\n</root>\n")
+
+	// A string containing non-indent characters is rejected.
+	for _, unit := range []string{"x", " \n", "\u00a0"} {
+		if err := doc.IndentWith(unit); err != ErrIndentString {
+			t.Errorf("etree: IndentWith(%q) returned %v, wanted ErrIndentString", unit, err)
+		}
+	}
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\n<a>\n<b/>\n</a>\n</root>\n")
+
+	// The IndentString setting takes precedence over Spaces and UseTabs,
+	// unless it is invalid.
+	s := NewIndentSettings()
+	s.UseTabs = true
+	s.UseCRLF = true
+	s.IndentString = "  "
+	s.SuppressTrailingWhitespace = true
+	doc.IndentWithSettings(s)
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\r\n  <a>\r\n    <b/>\r\n  </a>\r\n</root>")
+
+	s.IndentString = "-"
+	doc.IndentWithSettings(s)
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\r\n\t<a>\r\n\t\t<b/>\r\n\t</a>\r\n</root>")
+}
+
+func TestReindentSelf(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><list><a/><b/><c/></list><p>text <i/> more</p></root>`)
+	doc.Indent(2)
+	s := NewIndentSettings()
+	s.Spaces = 2
+
+	list := doc.FindElement("//list")
+
+	// Removing an element leaves its leading whitespace behind.
+	list.RemoveChild(list.SelectElement("b"))
+	c := list.SelectElement("c")
+	c.ReindentSelf(s)
+	output, _ := doc.WriteToString()
+	checkStrEq(t, output, "<root>\n  <list>\n    <a/>\n    <c/>\n  </list>\n  <p>text \n    <i/> more</p>\n</root>\n")
+
+	// An appended element receives leading and trailing indentation.
+	d := list.CreateElement("d")
+	d.CreateElement("e")
+	d.ReindentSelf(s)
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\n  <list>\n    <a/>\n    <c/>\n    <d><e/></d>\n  </list>\n  <p>text \n    <i/> more</p>\n</root>\n")
+
+	// Removing the last element leaves the previous one to fix up.
+	list.RemoveChild(d)
+	c.ReindentSelf(s)
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\n  <list>\n    <a/>\n    <c/>\n  </list>\n  <p>text \n    <i/> more</p>\n</root>\n")
+	checkIndexes(t, &doc.Element)
+
+	// Whitespace next to text is left alone.
+	doc.FindElement("//i").ReindentSelf(s)
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\n  <list>\n    <a/>\n    <c/>\n  </list>\n  <p>text \n    <i/> more</p>\n</root>\n")
+
+	// The root element of a document isn't indented.
+	doc.InsertChildAt(0, NewText("\n\n"))
+	doc.Root().ReindentSelf(s)
+	output, _ = doc.WriteToString()
+	checkStrEq(t, output, "<root>\n  <list>\n    <a/>\n    <c/>\n  </list>\n  <p>text \n    <i/> more</p>\n</root>\n")
+
+	// An element without a parent is unchanged.
+	NewElement("orphan").ReindentSelf(s)
+}
+
+func TestWritePrettyStable(t *testing.T) {
+	input := `<root z="1" a="2&#10;"><b y='x' p:x="3"><c></c></b><d>text</d></root>`
+	doc := newDocumentFromString(t, input)
+	doc.WriteSettings.CanonicalEndTags = true
+
+	var buf bytes.Buffer
+	n, err := doc.WritePrettyStable(&buf)
+	if err != nil {
+		t.Fatalf("etree: WritePrettyStable failed: %v", err)
+	}
+	checkIntEq(t, int(n), buf.Len())
+	expected := `<root a="2&#xA;" z="1">
+  <b y="x" p:x="3">
+    <c/>
+  </b>
+  <d>text</d>
+</root>
+`
+	checkStrEq(t, buf.String(), expected)
+
+	// The document is not modified.
+	checkBoolEq(t, doc.WriteSettings.CanonicalEndTags, true)
+	checkStrEq(t, doc.Root().Attr[0].Key, "z")
+	checkIntEq(t, len(doc.Root().Child), 2)
+
+	// Write settings unrelated to stability still apply.
+	doc.WriteSettings.MaxBytes = 10
+	buf.Reset()
+	if _, err := doc.WritePrettyStable(&buf); err != ErrMaxBytes {
+		t.Errorf("etree: WritePrettyStable returned %v, wanted ErrMaxBytes", err)
+	}
+}
+
+func TestIndentedString(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><book id="1"><title>T</title><authors><author>A</author></authors></book></root>`)
+	book := doc.FindElement("//book")
+
+	checkStrEq(t, book.IndentedString(2, 0), `<book id="1">
+  <title>T</title>
+  <authors>
+    <author>A</author>
+  </authors>
+</book>`)
+
+	checkStrEq(t, book.IndentedString(2, 2), `    <book id="1">
+      <title>T</title>
+      <authors>
+        <author>A</author>
+      </authors>
+    </book>`)
+
+	checkStrEq(t, book.IndentedString(NoIndent, 3), `<book id="1"><title>T</title><authors><author>A</author></authors></book>`)
+
+	// The original element is left untouched.
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, `<root><book id="1"><title>T</title><authors><author>A</author></authors></book></root>`)
+}
+
+func TestIndentXMLSpacePreserve(t *testing.T) {
+	input := `<root><a>
+<pre xml:space="preserve">
+  line 1
+    <b> line 2 </b>
+  <c xml:space="default"><d/>  </c>
+</pre></a></root>`
+
+	doc := newDocumentFromString(t, input)
+	doc.Indent(2)
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Error("etree: failed to serialize document")
+	}
+
+	expected := `<root>
+  <a>
+    <pre xml:space="preserve">
+  line 1
+    <b> line 2 </b>
+  <c xml:space="default">
+        <d/>
+      </c>
+</pre>
+  </a>
+</root>
+`
+	checkStrEq(t, s, expected)
+
+	// Indenting a descendant of a preserved element leaves it untouched.
+	b := doc.FindElement("//b")
+	b.IndentWithSettings(NewIndentSettings())
+	checkStrEq(t, b.Text(), " line 2 ")
+
+	// Unindent also leaves preserved whitespace intact.
+	doc.Unindent()
+	s, err = doc.WriteToString()
+	if err != nil {
+		t.Error("etree: failed to serialize document")
+	}
+
+	expected = `<root><a><pre xml:space="preserve">
+  line 1
+    <b> line 2 </b>
+  <c xml:space="default"><d/></c>
+</pre></a></root>`
+	checkStrEq(t, s, expected)
+}
+
 func TestPreserveCData(t *testing.T) {
 	tests := []struct {
 		input                   string
@@ -1042,6 +2488,91 @@ func TestPreserveCData(t *testing.T) {
 	}
 }
 
+func TestPreserveProcInstSpacing(t *testing.T) {
+	long := strings.Repeat(" ", 10000)
+	tests := []struct {
+		input                   string
+		expectedWithPreserve    string
+		expectedWithoutPreserve string
+	}{
+		{
+			"<?target   extra  spaces?><x/>",
+			"<?target   extra  spaces?><x/>",
+			"<?target extra  spaces?><x/>",
+		},
+		{
+			"<?target\n\tinst ?><x/>",
+			"<?target\n\tinst ?><x/>",
+			"<?target inst ?><x/>",
+		},
+		{
+			"<?target?><x/>",
+			"<?target?><x/>",
+			"<?target?><x/>",
+		},
+		{
+			"<?target   ?><x/>",
+			"<?target   ?><x/>",
+			"<?target?><x/>",
+		},
+		{
+			"<x><?t a?><![CDATA[ y ]]></x>",
+			"<x><?t a?><![CDATA[ y ]]></x>",
+			"<x><?t a?><![CDATA[ y ]]></x>",
+		},
+		{
+			"<?target" + long + "inst?><x/>",
+			"<?target" + long + "inst?><x/>",
+			"<?target inst?><x/>",
+		},
+	}
+
+	for _, test := range tests {
+		settings := ReadSettings{PreserveCData: true, PreserveProcInstSpacing: true}
+		doc := newDocumentFromString2(t, test.input, settings)
+		output, _ := doc.WriteToString()
+		checkStrEq(t, output, test.expectedWithPreserve)
+
+		output, _ = doc.Copy().WriteToString()
+		checkStrEq(t, output, test.expectedWithPreserve)
+
+		settings.PreserveProcInstSpacing = false
+		doc = newDocumentFromString2(t, test.input, settings)
+		output, _ = doc.WriteToString()
+		checkStrEq(t, output, test.expectedWithoutPreserve)
+	}
+}
+
+func TestProcInstEmptyInst(t *testing.T) {
+	doc := NewDocument()
+	doc.CreateProcInst("target", "")
+	root := doc.CreateElement("root")
+	root.AddChild(NewProcInst("target", ""))
+	parsed := newDocumentFromString(t, `<?target ?><root/>`)
+
+	// Every serialization path produces the same output.
+	var b bytes.Buffer
+	root.Child[0].WriteTo(&b, &doc.WriteSettings)
+	checkStrEq(t, b.String(), "<?target?>")
+
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal("etree: failed to write document")
+	}
+	checkStrEq(t, s, "<?target?><root><?target?></root>")
+
+	s, _ = parsed.WriteToString()
+	checkStrEq(t, s, "<?target?><root/>")
+
+	r := doc.Reader()
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal("etree: failed to read document")
+	}
+	checkStrEq(t, string(data), "<?target?><root><?target?></root>")
+}
+
 func TestTokenIndexing(t *testing.T) {
 	s := `<?xml version="1.0" encoding="UTF-8"?>
 <?xml-stylesheet type="text/xsl" href="style.xsl"?>
@@ -1154,6 +2685,31 @@ func TestSetText(t *testing.T) {
 	checkIntEq(t, len(root.Child), 1)
 }
 
+func TestSetTextAuto(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+		cdata    bool
+	}{
+		{"plain text", `<a>plain text</a>`, false},
+		{"", `<a/>`, false},
+		{`if (a < b && c > d) { f("x") }`, `<a><![CDATA[if (a < b && c > d) { f("x") }]]></a>`, true},
+		{"x ]]> y & z", `<a>x ]]&gt; y &amp; z</a>`, false},
+		{`say "hi"`, `<a>say &quot;hi&quot;</a>`, false},
+	}
+	for _, test := range tests {
+		doc := NewDocument()
+		a := doc.CreateElement("a")
+		a.SetText("old")
+		a.SetTextAuto(test.text)
+		checkDocEq(t, doc, test.expected)
+		checkStrEq(t, a.Text(), test.text)
+		if test.text != "" {
+			checkBoolEq(t, a.Child[0].(*CharData).IsCData(), test.cdata)
+		}
+	}
+}
+
 func TestSetTail(t *testing.T) {
 	doc := NewDocument()
 	root := doc.CreateElement("root")
@@ -1223,6 +2779,78 @@ func TestAttrParent(t *testing.T) {
 	}
 }
 
+func TestAttrIndex(t *testing.T) {
+	doc := newDocumentFromString(t, `<root a="1" x:b="2" b="3"/>`)
+	root := doc.Root()
+
+	checkIntEq(t, root.AttrIndex("a"), 0)
+	checkIntEq(t, root.AttrIndex("x:b"), 1)
+	checkIntEq(t, root.AttrIndex("b"), 1)
+	checkIntEq(t, root.AttrIndex("y:b"), -1)
+	checkIntEq(t, root.AttrIndex("c"), -1)
+
+	checkBoolEq(t, root.HasAttr("a"), true)
+	checkBoolEq(t, root.HasAttr("x:b"), true)
+	checkBoolEq(t, root.HasAttr("y:b"), false)
+	checkBoolEq(t, root.HasAttr("c"), false)
+
+	// Indexes remain usable after the Attr slice grows.
+	i := root.AttrIndex("a")
+	for j := 0; j < 16; j++ {
+		root.CreateAttr("n"+string(rune('a'+j)), "v")
+	}
+	root.Attr[i].Value = "updated"
+	checkStrEq(t, root.SelectAttrValue("a", ""), "updated")
+	checkIntEq(t, root.AttrIndex("np"), 18)
+}
+
+func TestRemoveAttrsBySpace(t *testing.T) {
+	doc := newDocumentFromString(t, `<root xmlns:wsu="urn:wsu" wsu:Id="1" a="x"><b wsu:Id="2" wsu:Other="3" c="y"><d wsu:Id="4"/></b></root>`)
+	root := doc.Root()
+
+	removed := root.RemoveAttrsBySpace("wsu")
+	checkIntEq(t, len(removed), 1)
+	checkStrEq(t, removed[0].FullKey(), "wsu:Id")
+	checkStrEq(t, removed[0].Value, "1")
+	checkElementEq(t, removed[0].Element(), nil)
+	checkDocEq(t, doc, `<root xmlns:wsu="urn:wsu" a="x"><b wsu:Id="2" wsu:Other="3" c="y"><d wsu:Id="4"/></b></root>`)
+
+	checkIntEq(t, root.RemoveAttrsBySpaceRecursive("wsu"), 3)
+	checkDocEq(t, doc, `<root xmlns:wsu="urn:wsu" a="x"><b c="y"><d/></b></root>`)
+
+	removed = root.RemoveAttrsBySpace("")
+	checkIntEq(t, len(removed), 1)
+	checkStrEq(t, removed[0].Key, "a")
+	checkIntEq(t, len(root.RemoveAttrsBySpace("none")), 0)
+	checkDocEq(t, doc, `<root xmlns:wsu="urn:wsu"><b c="y"><d/></b></root>`)
+}
+
+func TestSetTag(t *testing.T) {
+	e := NewElement("x:old")
+
+	checkBoolEq(t, e.SetTag("new") == nil, true)
+	checkStrEq(t, e.FullTag(), "new")
+	checkBoolEq(t, e.SetTag("p:name-1.x") == nil, true)
+	checkStrEq(t, e.Space, "p")
+	checkStrEq(t, e.Tag, "name-1.x")
+	checkBoolEq(t, e.SetTag("_élève") == nil, true)
+	checkStrEq(t, e.FullTag(), "_élève")
+
+	for _, tag := range []string{"", "1a", "-a", "a b", "a<b", "p:", ":a", "p:1", "a:b:c", "\xff"} {
+		if err := e.SetTag(tag); err != ErrInvalidName {
+			t.Errorf("etree: SetTag(%q) returned %v", tag, err)
+		}
+	}
+	checkStrEq(t, e.FullTag(), "_élève")
+
+	checkBoolEq(t, e.SetNamespace("ns") == nil, true)
+	checkStrEq(t, e.FullTag(), "ns:_élève")
+	checkBoolEq(t, e.SetNamespace("") == nil, true)
+	checkStrEq(t, e.FullTag(), "_élève")
+	checkBoolEq(t, e.SetNamespace("a:b") == ErrInvalidName, true)
+	checkStrEq(t, e.FullTag(), "_élève")
+}
+
 func TestDefaultNamespaceURI(t *testing.T) {
 	s := `
 <root xmlns="https://root.example.com" xmlns:attrib="https://attrib.example.com" attrib:a="foo" b="bar">
@@ -1318,6 +2946,10 @@ func TestLocalNamespaceURI(t *testing.T) {
 	grandchild4 := child1.SelectElement("grandchild4")
 	greatgrandchild1 := grandchild2.SelectElement("greatgrandchild1")
 
+	checkStrEq(t, root.Prefix(), "a")
+	checkStrEq(t, child1.Prefix(), "b")
+	checkStrEq(t, grandchild4.Prefix(), "")
+
 	checkStrEq(t, doc.NamespaceURI(), "")
 	checkStrEq(t, root.NamespaceURI(), "https://root.example.com")
 	checkStrEq(t, child1.NamespaceURI(), "https://child.example.com")
@@ -1355,8 +2987,84 @@ func TestLocalNamespaceURI(t *testing.T) {
 	}
 }
 
-func TestWhitespace(t *testing.T) {
-	s := "<root>\n\t<child>\n\t\t<grandchild> x</grandchild>\n    </child>\n</root>"
+func TestNamespacesInScope(t *testing.T) {
+	s := `
+<root xmlns="urn:default" xmlns:a="urn:a1" xmlns:b="urn:b">
+	<child xmlns:a="urn:a2" xmlns:c="urn:c">
+		<grandchild xmlns=""/>
+	</child>
+</root>`
+
+	doc := newDocumentFromString(t, s)
+	root := doc.SelectElement("root")
+	child := root.SelectElement("child")
+	grandchild := child.SelectElement("grandchild")
+
+	nsString := func(ns map[string]string) string {
+		var list []string
+		for _, prefix := range []string{"", "a", "b", "c"} {
+			if uri, ok := ns[prefix]; ok {
+				list = append(list, prefix+"="+uri)
+			}
+		}
+		checkIntEq(t, len(list), len(ns))
+		return strings.Join(list, ",")
+	}
+
+	checkStrEq(t, nsString(doc.NamespacesInScope()), "")
+	checkStrEq(t, nsString(root.NamespacesInScope()), "=urn:default,a=urn:a1,b=urn:b")
+	checkStrEq(t, nsString(child.NamespacesInScope()), "=urn:default,a=urn:a2,b=urn:b,c=urn:c")
+	checkStrEq(t, nsString(grandchild.NamespacesInScope()), "a=urn:a2,b=urn:b,c=urn:c")
+}
+
+func TestDeclareNamespace(t *testing.T) {
+	doc := NewDocument()
+	root := doc.CreateElement("t:root")
+	checkBoolEq(t, root.DeclareNamespace("t", "urn:t") != nil, true)
+	checkBoolEq(t, root.DeclareNamespace("t", "urn:t") == nil, true)
+
+	for i := 0; i < 2; i++ {
+		item := root.CreateElement("t:item")
+		checkBoolEq(t, item.DeclareNamespace("t", "urn:t") == nil, true)
+		item.DeclareNamespace("", "urn:d")
+		item.CreateElement("sub").DeclareNamespace("", "urn:d")
+	}
+	other := root.CreateElement("u:other")
+	attr := other.DeclareNamespace("t", "urn:other")
+	checkStrEq(t, attr.FullKey(), "xmlns:t")
+
+	checkDocEq(t, doc, `<t:root xmlns:t="urn:t"><t:item xmlns="urn:d"><sub/></t:item><t:item xmlns="urn:d"><sub/></t:item><u:other xmlns:t="urn:other"/></t:root>`)
+}
+
+func TestResolveURI(t *testing.T) {
+	s := `
+<feed xml:base="http://example.com/blog/">
+	<entry xml:base="2024/">
+		<link href="post.html"/>
+		<img xml:base="/static/" src="a.png"/>
+	</entry>
+	<entry xml:base="https://other.org/x/">
+		<link href="../y"/>
+	</entry>
+</feed>`
+	doc := newDocumentFromString(t, s)
+	links := doc.FindElements("//link")
+	img := doc.FindElement("//img")
+
+	checkStrEq(t, links[0].ResolveURI("post.html"), "http://example.com/blog/2024/post.html")
+	checkStrEq(t, links[0].ResolveURI("/about"), "http://example.com/about")
+	checkStrEq(t, links[0].ResolveURI("mailto:a@b.c"), "mailto:a@b.c")
+	checkStrEq(t, img.ResolveURI("a.png"), "http://example.com/static/a.png")
+	checkStrEq(t, links[1].ResolveURI("../y"), "https://other.org/y")
+	checkStrEq(t, doc.Root().ResolveURI("index.html"), "http://example.com/blog/index.html")
+
+	// Without xml:base, references are returned unchanged.
+	doc = newDocumentFromString(t, `<a><b/></a>`)
+	checkStrEq(t, doc.FindElement("//b").ResolveURI("../x.html"), "../x.html")
+}
+
+func TestWhitespace(t *testing.T) {
+	s := "<root>\n\t<child>\n\t\t<grandchild> x</grandchild>\n    </child>\n</root>"
 
 	doc := newDocumentFromString(t, s)
 	root := doc.Root()
@@ -1403,6 +3111,63 @@ func TestWhitespace(t *testing.T) {
 	checkBoolEq(t, cd.IsWhitespace(), true)
 }
 
+func TestIsWhitespaceToken(t *testing.T) {
+	s := "<root>\n\t<child> x </child><![CDATA[ ]]><!-- c -->\n</root>"
+
+	doc := newDocumentFromString2(t, s, ReadSettings{PreserveCData: true})
+	root := doc.Root()
+	checkIntEq(t, len(root.Child), 5)
+
+	checkBoolEq(t, IsWhitespaceToken(root.Child[0]), true)
+	checkBoolEq(t, IsWhitespaceToken(root.Child[1]), false)
+	checkBoolEq(t, IsWhitespaceToken(root.Child[2]), false)
+	checkBoolEq(t, IsWhitespaceToken(root.Child[3]), false)
+	checkBoolEq(t, IsWhitespaceToken(root.Child[4]), true)
+
+	child := root.SelectElement("child")
+	checkBoolEq(t, IsWhitespaceToken(child.Child[0]), false)
+
+	cd := NewText("")
+	cd.SetData("\r\n  ")
+	checkBoolEq(t, IsWhitespaceToken(cd), true)
+}
+
+func TestNormalize(t *testing.T) {
+	doc := NewDocument()
+	root := doc.CreateElement("root")
+	root.CreateText("")
+	root.CreateText("a")
+	root.CreateText("b")
+	root.CreateText(" ")
+	root.CreateCData("c")
+	root.CreateText("d")
+	root.CreateText("")
+	child := root.CreateElement("child")
+	child.CreateText("  ")
+	child.CreateText("\n")
+	root.CreateComment("x")
+	root.CreateText("")
+	root.CreateText("e")
+
+	before, _ := doc.WriteToString()
+	doc.Normalize()
+	after, _ := doc.WriteToString()
+	checkStrEq(t, after, before)
+
+	checkIntEq(t, len(root.Child), 6)
+	checkIndexes(t, &doc.Element)
+	checkStrEq(t, root.Text(), "ab cd")
+	checkStrEq(t, root.Child[0].(*CharData).Data, "ab ")
+	checkBoolEq(t, root.Child[1].(*CharData).IsCData(), true)
+	checkStrEq(t, root.Child[2].(*CharData).Data, "d")
+	checkStrEq(t, root.Child[5].(*CharData).Data, "e")
+
+	checkIntEq(t, len(child.Child), 1)
+	cd := child.Child[0].(*CharData)
+	checkStrBinaryEq(t, cd.Data, "  \n")
+	checkBoolEq(t, cd.IsWhitespace(), true)
+}
+
 func TestTokenWriteTo(t *testing.T) {
 	s := `<store>
 	<!-- comment -->
@@ -1597,15 +3362,17 @@ func TestSiblingElement(t *testing.T) {
 	b1 := b.SelectElement("b1")
 
 	tests := []struct {
-		e    *Element
-		next *Element
-		prev *Element
+		e     *Element
+		next  *Element
+		prev  *Element
+		index int
 	}{
-		{root, nil, nil},
-		{a, b, nil},
-		{b, c, a},
-		{c, nil, b},
-		{b1, nil, nil},
+		{root, nil, nil, 0},
+		{a, b, nil, 0},
+		{b, c, a, 1},
+		{c, nil, b, 2},
+		{b1, nil, nil, 0},
+		{NewElement("x"), nil, nil, -1},
 	}
 
 	toString := func(e *Element) string {
@@ -1627,5 +3394,806 @@ func TestSiblingElement(t *testing.T) {
 			t.Errorf("etree: test #%d unexpected PrevSibling result.\n  Expected: %s\n  Received: %s\n",
 				i, toString(prev), toString(test.prev))
 		}
+
+		if index := test.e.SiblingIndex(); index != test.index {
+			t.Errorf("etree: test #%d unexpected SiblingIndex result.\n  Expected: %d\n  Received: %d\n",
+				i, test.index, index)
+		}
+	}
+}
+
+func TestElementRoot(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><b><c/></b></a>`)
+	c := doc.FindElement("//c")
+	checkElementEq(t, c.Root(), &doc.Element)
+	checkElementEq(t, doc.Root().Root(), &doc.Element)
+
+	b := c.Parent()
+	doc.Root().RemoveChild(b)
+	checkElementEq(t, c.Root(), b)
+	checkElementEq(t, b.Root(), b)
+
+	e := NewElement("e")
+	checkElementEq(t, e.Root(), e)
+}
+
+func TestSourceSpan(t *testing.T) {
+	s := "<?xml version=\"1.0\"?>\n<root a=\"1\">\n  <child>text</child>\n  <empty/>\n</root>"
+	doc := newDocumentFromString(t, s)
+
+	tests := []struct {
+		path, src string
+	}{
+		{"/root", s[22:]},
+		{"/root/child", "<child>text</child>"},
+		{"/root/empty", "<empty/>"},
+	}
+	for _, test := range tests {
+		e := doc.FindElement(test.path)
+		start, end, ok := e.SourceSpan()
+		if !ok {
+			t.Errorf("etree: SourceSpan for %s not available", test.path)
+			continue
+		}
+		checkStrEq(t, s[start:end], test.src)
+	}
+
+	if _, _, ok := doc.FindElement("//child").Copy().SourceSpan(); ok {
+		t.Error("etree: SourceSpan unexpectedly retained by copy")
+	}
+	if _, _, ok := doc.Root().CreateElement("new").SourceSpan(); ok {
+		t.Error("etree: SourceSpan unexpectedly available for created element")
+	}
+
+	s = "<p>a<br>b</p>"
+	doc = newDocumentFromString2(t, s, ReadSettings{
+		Permissive: true,
+		AutoClose:  xml.HTMLAutoClose,
+	})
+	start, end, ok := doc.FindElement("//br").SourceSpan()
+	if !ok {
+		t.Fatal("etree: SourceSpan for auto-closed element not available")
+	}
+	checkStrEq(t, s[start:end], "<br>")
+}
+
+func TestSelectElementsFunc(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a n="1"/>text<b n="2"><c n="3"/></b><!--x--><a n="4"/></root>`)
+	root := doc.Root()
+
+	even := root.SelectElementsFunc(func(c *Element) bool {
+		n := c.SelectAttrValue("n", "")
+		return n == "2" || n == "4"
+	})
+	checkIntEq(t, len(even), 2)
+	checkStrEq(t, even[0].Tag, "b")
+	checkStrEq(t, even[1].Tag, "a")
+
+	all := root.SelectElementsFunc(func(c *Element) bool { return true })
+	checkIntEq(t, len(all), 3)
+
+	none := root.SelectElementsFunc(func(c *Element) bool { return c.Tag == "c" })
+	checkIntEq(t, len(none), 0)
+
+	tokens := root.FilterChildren(func(t Token) bool {
+		_, isElement := t.(*Element)
+		return !isElement
+	})
+	checkIntEq(t, len(tokens), 2)
+	if cd, ok := tokens[0].(*CharData); !ok || cd.Data != "text" {
+		t.Error("etree: FilterChildren returned unexpected first token")
+	}
+	if _, ok := tokens[1].(*Comment); !ok {
+		t.Error("etree: FilterChildren returned unexpected second token")
+	}
+}
+
+func TestChildText(t *testing.T) {
+	s := `<book><t:title>Great Expectations</t:title><author/><year>1861</year></book>`
+	doc := newDocumentFromString(t, s)
+	book := doc.Root()
+
+	tests := []struct {
+		tag   string
+		text  string
+		found bool
+	}{
+		{"title", "Great Expectations", true},
+		{"t:title", "Great Expectations", true},
+		{"x:title", "", false},
+		{"author", "", true},
+		{"year", "1861", true},
+		{"publisher", "", false},
+	}
+	for _, test := range tests {
+		text, found := book.ChildText(test.tag)
+		checkStrEq(t, text, test.text)
+		checkBoolEq(t, found, test.found)
+	}
+
+	text, found := doc.FindText("/book/year")
+	checkStrEq(t, text, "1861")
+	checkBoolEq(t, found, true)
+
+	text, found = doc.FindText("//author")
+	checkStrEq(t, text, "")
+	checkBoolEq(t, found, true)
+
+	text, found = doc.FindText("//publisher")
+	checkStrEq(t, text, "")
+	checkBoolEq(t, found, false)
+}
+
+func TestMaxAttrWidth(t *testing.T) {
+	doc := NewDocument()
+	root := doc.CreateElement("root")
+	root.CreateAttr("a", "1")
+	root.CreateAttr("b", "2")
+	item := root.CreateElement("item")
+	item.CreateAttr("id", "item-0001")
+	item.CreateAttr("name", "A fairly long item name")
+	item.CreateAttr("x:kind", "example & more")
+	single := root.CreateElement("single")
+	single.CreateAttr("only", "this attribute is never wrapped, no matter how long it is")
+
+	doc.Indent(2)
+	doc.WriteSettings.MaxAttrWidth = 40
+	s, _ := doc.WriteToString()
+	expected := `<root a="1" b="2">
+  <item id="item-0001"
+        name="A fairly long item name"
+        x:kind="example &amp; more"/>
+  <single only="this attribute is never wrapped, no matter how long it is"/>
+</root>
+`
+	checkStrEq(t, s, expected)
+
+	doc.WriteSettings.MaxAttrWidth = 84
+	s, _ = doc.WriteToString()
+	expected = `<root a="1" b="2">
+  <item id="item-0001" name="A fairly long item name" x:kind="example &amp; more"/>
+  <single only="this attribute is never wrapped, no matter how long it is"/>
+</root>
+`
+	checkStrEq(t, s, expected)
+
+	settings := NewIndentSettings()
+	settings.UseTabs = true
+	settings.UseCRLF = true
+	doc.IndentWithSettings(settings)
+	doc.WriteSettings.MaxAttrWidth = 16
+	s, _ = doc.WriteToString()
+	expected = "<root a=\"1\"\r\n      b=\"2\">\r\n" +
+		"\t<item id=\"item-0001\"\r\n\t      name=\"A fairly long item name\"\r\n\t      x:kind=\"example &amp; more\"/>\r\n" +
+		"\t<single only=\"this attribute is never wrapped, no matter how long it is\"/>\r\n" +
+		"</root>\r\n"
+	checkStrEq(t, s, expected)
+}
+
+func TestDocumentReader(t *testing.T) {
+	doc := NewDocument()
+	doc.CreateProcInst("xml", `version="1.0"`)
+	root := doc.CreateElement("root")
+	for i := 0; i < 1000; i++ {
+		item := root.CreateElement("item")
+		item.CreateAttr("name", "it's")
+		item.SetText("text & more")
+	}
+	doc.WriteSettings.AttrSingleQuote = true
+	doc.Indent(2)
+
+	expected, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := doc.Reader()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, string(b), expected)
+	r.Close()
+
+	// Closing the reader early stops serialization.
+	r = doc.Reader()
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, string(buf), expected[:16])
+	r.Close()
+	if _, err := r.Read(buf); err != io.ErrClosedPipe {
+		t.Errorf("etree: unexpected error reading closed reader: %v", err)
+	}
+}
+
+func TestElementReadFromWithSettings(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a/></root>`)
+	a := doc.FindElement("//a")
+
+	fragment := `<b>x &ent;</b><!--c--><b><![CDATA[y]]></b>`
+	settings := ReadSettings{
+		Entity:        map[string]string{"ent": "entity"},
+		PreserveCData: true,
+	}
+	n, err := a.ReadFromWithSettings(strings.NewReader(fragment), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIntEq(t, int(n), len(fragment))
+	checkIndexes(t, &doc.Element)
+	checkDocEq(t, doc, `<root><a><b>x entity</b><!--c--><b><![CDATA[y]]></b></a></root>`)
+
+	b := a.SelectElement("b")
+	checkElementEq(t, b.Parent(), a)
+
+	// Invalid input is rejected before modifying the element when
+	// validating.
+	settings.ValidateInput = true
+	_, err = a.ReadFromWithSettings(strings.NewReader(`<c>`), settings)
+	if err == nil {
+		t.Error("etree: ReadFromWithSettings failed to detect invalid input")
+	}
+	checkIntEq(t, len(a.Child), 3)
+
+	// Tokens read before an error are discarded, and the existing text is
+	// unchanged, since read text isn't coalesced with it.
+	settings = ReadSettings{CoalesceText: true}
+	a.CreateText("t")
+	_, err = a.ReadFromWithSettings(strings.NewReader(`more<d/><e>`), settings)
+	if err == nil {
+		t.Error("etree: ReadFromWithSettings failed to detect invalid input")
+	}
+	checkIndexes(t, &doc.Element)
+	checkDocEq(t, doc, `<root><a><b>x entity</b><!--c--><b><![CDATA[y]]></b>t</a></root>`)
+}
+
+func TestAddFromReader(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a/></root>`)
+	a := doc.FindElement("//a")
+
+	elements, err := a.AddFromReader(strings.NewReader(`text<b/><!--c--><c><d/></c>`), ReadSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIntEq(t, len(elements), 2)
+	checkStrEq(t, elements[0].Tag, "b")
+	checkStrEq(t, elements[1].Tag, "c")
+	checkElementEq(t, elements[1].Parent(), a)
+	checkIndexes(t, &doc.Element)
+	checkDocEq(t, doc, `<root><a>text<b/><!--c--><c><d/></c></a></root>`)
+
+	// A failed read leaves the element unchanged.
+	elements, err = a.AddFromReader(strings.NewReader(`<e/><f></g>`), ReadSettings{})
+	if err == nil {
+		t.Error("etree: AddFromReader failed to detect invalid input")
+	}
+	if elements != nil {
+		t.Error("etree: AddFromReader returned elements after an error")
+	}
+	checkIntEq(t, len(a.Child), 4)
+	checkDocEq(t, doc, `<root><a>text<b/><!--c--><c><d/></c></a></root>`)
+
+	// Coalesced text isn't merged into the element's existing text, which
+	// is left unchanged by a failed read.
+	settings := ReadSettings{CoalesceText: true}
+	x := NewElement("x")
+	x.CreateText("t")
+	if _, err = x.AddFromReader(strings.NewReader(`u<![CDATA[v]]><y/><z>`), settings); err == nil {
+		t.Error("etree: AddFromReader failed to detect invalid input")
+	}
+	checkIntEq(t, len(x.Child), 1)
+	checkStrEq(t, x.Child[0].(*CharData).Data, "t")
+
+	if _, err = x.AddFromReader(strings.NewReader(`u<![CDATA[v]]><y/>`), settings); err != nil {
+		t.Fatal(err)
+	}
+	checkIntEq(t, len(x.Child), 3)
+	checkStrEq(t, x.Text(), "tuv")
+	checkStrEq(t, x.Child[1].(*CharData).Data, "uv")
+}
+
+func TestElementPredicates(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><empty/><text>x</text><comment><!--c--></comment><parent><child/></parent></root>`)
+
+	tests := []struct {
+		path               string
+		hasChildren, empty bool
+		leaf               bool
+	}{
+		{"/root", true, false, false},
+		{"/root/empty", false, true, true},
+		{"/root/text", false, false, true},
+		{"/root/comment", false, false, true},
+		{"/root/parent", true, false, false},
+	}
+	for _, test := range tests {
+		e := doc.FindElement(test.path)
+		checkBoolEq(t, e.HasChildElements(), test.hasChildren)
+		checkBoolEq(t, e.IsEmpty(), test.empty)
+		checkBoolEq(t, e.IsLeaf(), test.leaf)
+	}
+}
+
+func TestCountDescendants(t *testing.T) {
+	doc := newDocumentFromString(t, `<?pi x?><root>text<a><b/><!--c--><d>e</d></a><f/></root>`)
+	tests := []struct {
+		path           string
+		elements, toks int
+	}{
+		{"/root", 4, 7},
+		{"/root/a", 2, 4},
+		{"/root/a/d", 0, 1},
+		{"/root/f", 0, 0},
+	}
+	for _, test := range tests {
+		e := doc.FindElement(test.path)
+		checkIntEq(t, e.CountDescendants(), test.elements)
+		checkIntEq(t, e.CountTokens(), test.toks)
+	}
+
+	checkIntEq(t, doc.CountDescendants(), len(doc.FindElements("//*")))
+	checkIntEq(t, doc.CountTokens(), 9)
+}
+
+func TestFindTokensByType(t *testing.T) {
+	doc := newDocumentFromString(t, `<?xml version="1.0"?><!--1--><!DOCTYPE r><root><!--2--><a><?p a?><!--3--></a><!DIR x><?p b?><!--4--></root>`)
+
+	var comments []string
+	for _, c := range doc.FindComments() {
+		comments = append(comments, c.Data)
+	}
+	checkStrEq(t, strings.Join(comments, ","), "1,2,3,4")
+
+	var insts []string
+	for _, p := range doc.FindProcInsts() {
+		insts = append(insts, p.Target+" "+p.Inst)
+	}
+	checkStrEq(t, strings.Join(insts, ","), `xml version="1.0",p a,p b`)
+
+	var dirs []string
+	for _, d := range doc.FindDirectives() {
+		dirs = append(dirs, d.Data)
+	}
+	checkStrEq(t, strings.Join(dirs, ","), "DOCTYPE r,DIR x")
+
+	a := doc.FindElement("//a")
+	checkIntEq(t, len(a.FindComments()), 1)
+	checkIntEq(t, len(a.FindProcInsts()), 1)
+	if a.FindDirectives() != nil {
+		t.Error("etree: expected no directives")
+	}
+}
+
+func TestDeclaration(t *testing.T) {
+	doc := newDocumentFromString(t, `<?xml version="1.0" encoding='UTF-8'  standalone="yes" ?>
+<root/>`)
+	decl, ok := doc.Declaration()
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, decl.Version, "1.0")
+	checkStrEq(t, decl.Encoding, "UTF-8")
+	checkStrEq(t, decl.Standalone, "yes")
+
+	// Declarations are written in a standard form regardless of their input
+	// spacing and quoting.
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal("etree: failed to write document")
+	}
+	checkStrEq(t, s, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<root/>`)
+
+	// ForceStandalone overrides the value without modifying the document.
+	no := false
+	doc.WriteSettings.ForceStandalone = &no
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<root/>`)
+	decl, _ = doc.Declaration()
+	checkStrEq(t, decl.Standalone, "yes")
+
+	decl.Standalone = ""
+	doc.SetDeclaration(decl)
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<root/>`)
+
+	yes := true
+	doc.WriteSettings.ForceStandalone = &yes
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<root/>`)
+
+	// A document without a declaration gets one inserted.
+	doc = newDocumentFromString(t, `<root/>`)
+	_, ok = doc.Declaration()
+	checkBoolEq(t, ok, false)
+	doc.SetDeclaration(Declaration{Standalone: "no"})
+	checkDocEq(t, doc, `<?xml version="1.0" standalone="no"?><root/>`)
+	decl, ok = doc.Declaration()
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, decl.Version, "1.0")
+	checkStrEq(t, decl.Encoding, "")
+	checkStrEq(t, decl.Standalone, "no")
+
+	// Values that aren't allowed in a declaration are rejected.
+	bad := []Declaration{
+		{Version: "2.0"},
+		{Version: "1."},
+		{Version: `1.0" x="`},
+		{Encoding: "UTF 8"},
+		{Encoding: "8bit"},
+		{Encoding: "UTF-8?>"},
+		{Standalone: "true"},
+	}
+	for _, decl := range bad {
+		if err := doc.SetDeclaration(decl); err != ErrDeclaration {
+			t.Errorf("etree: SetDeclaration(%+v) returned %v, wanted ErrDeclaration", decl, err)
+		}
+	}
+	if err := doc.SetDeclaration(Declaration{Version: "1.1", Encoding: "ISO-8859-1"}); err != nil {
+		t.Errorf("etree: SetDeclaration returned %v", err)
 	}
+	checkDocEq(t, doc, `<?xml version="1.1" encoding="ISO-8859-1"?><root/>`)
 }
+
+func TestDeclarationSpacing(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{`<?xml version="1.0" encoding="UTF-8"?>`, `<?xml version="1.0" encoding="UTF-8"?>`},
+		{"<?xml   version = '1.0'\n\tencoding=\"UTF-8\"   ?>", `<?xml version="1.0" encoding="UTF-8"?>`},
+		{`<?xml version="1.0" standalone='"yes"'?>`, `<?xml version="1.0" standalone='"yes"'?>`},
+		{`<?xml version="1.0" bogus?>`, `<?xml version="1.0" bogus?>`},
+	}
+	for _, test := range tests {
+		for _, settings := range []ReadSettings{{}, {PreserveProcInstSpacing: true}} {
+			doc := newDocumentFromString2(t, test.in+"<root/>", settings)
+			s, err := doc.WriteToString()
+			if err != nil {
+				t.Fatal("etree: failed to write document")
+			}
+			checkStrEq(t, s, test.out+"<root/>")
+		}
+	}
+
+	doc := NewDocument()
+	doc.CreateProcInst("xml", `version="1.0"  encoding="UTF-8" `)
+	doc.CreateElement("root")
+	checkDocEq(t, doc, `<?xml version="1.0" encoding="UTF-8"?><root/>`)
+}
+
+func TestDocType(t *testing.T) {
+	doc := newDocumentFromString(t, `<?xml version="1.0"?><html/>`)
+	if _, _, _, ok := doc.DocType(); ok {
+		t.Error("etree: expected no DOCTYPE")
+	}
+
+	doc.CreateDocType("html", "", "", "")
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, `<?xml version="1.0"?><!DOCTYPE html><html/>`)
+
+	doc.CreateDocType("html", "-//W3C//DTD XHTML 1.0 Strict//EN", "http://www.w3.org/TR/xhtml1/DTD/xhtml1-strict.dtd", "")
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<?xml version="1.0"?><!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Strict//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-strict.dtd"><html/>`)
+
+	name, pub, sys, ok := doc.DocType()
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, name, "html")
+	checkStrEq(t, pub, "-//W3C//DTD XHTML 1.0 Strict//EN")
+	checkStrEq(t, sys, "http://www.w3.org/TR/xhtml1/DTD/xhtml1-strict.dtd")
+
+	doc = NewDocument()
+	doc.CreateDocType("note", "", `say "hi".dtd`, `<!ELEMENT note (#PCDATA)>`)
+	doc.CreateElement("note")
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<!DOCTYPE note SYSTEM 'say "hi".dtd' [<!ELEMENT note (#PCDATA)>]><note/>`)
+
+	doc = newDocumentFromString(t, s)
+	name, pub, sys, ok = doc.DocType()
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, name, "note")
+	checkStrEq(t, pub, "")
+	checkStrEq(t, sys, `say "hi".dtd`)
+
+	// Invalid names and identifiers are rejected.
+	errTests := []struct {
+		name, pub, sys string
+		err            error
+	}{
+		{"", "", "", ErrInvalidName},
+		{"1html", "", "", ErrInvalidName},
+		{"html x", "", "", ErrInvalidName},
+		{"html", `say "hi"`, "", ErrDocTypeID},
+		{"html", "a<b", "", ErrDocTypeID},
+		{"html", "", `"it's"`, ErrDocTypeID},
+	}
+	for _, test := range errTests {
+		dir, err := doc.CreateDocType(test.name, test.pub, test.sys, "")
+		if dir != nil || err != test.err {
+			t.Errorf("etree: CreateDocType(%q, %q, %q) returned %v, wanted %v", test.name, test.pub, test.sys, err, test.err)
+		}
+	}
+	name, pub, sys, _ = doc.DocType()
+	checkStrEq(t, name, "note")
+	checkStrEq(t, pub, "")
+	checkStrEq(t, sys, `say "hi".dtd`)
+
+	tests := []struct {
+		data, name, pub, sys string
+		ok                   bool
+	}{
+		{"DOCTYPE html", "html", "", "", true},
+		{"DOCTYPE\n  a  PUBLIC 'p'\n 's' ", "a", "p", "s", true},
+		{`DOCTYPE a PUBLIC "p"`, "a", "p", "", true},
+		{`DOCTYPE a[<!ENTITY e "x">]`, "a", "", "", true},
+		{`DOCTYPE a SYSTEM`, "", "", "", false},
+		{`DOCTYPE a PUBLIC "p`, "", "", "", false},
+		{`DOCTYPE a junk`, "", "", "", false},
+		{`DOCTYPEa`, "", "", "", false},
+		{`DOCTYPE `, "", "", "", false},
+	}
+	for _, test := range tests {
+		name, pub, sys, ok := parseDocType(test.data)
+		checkStrEq(t, name, test.name)
+		checkStrEq(t, pub, test.pub)
+		checkStrEq(t, sys, test.sys)
+		checkBoolEq(t, ok, test.ok)
+	}
+}
+
+func TestProlog(t *testing.T) {
+	s := `<?xml version="1.0"?>
+<!--c1-->
+<!DOCTYPE root>
+<?pi a?>
+<root><?pi inner?><!--inner--></root>
+<!--after-->`
+	doc := newDocumentFromString(t, s)
+
+	var list []string
+	for _, t := range doc.Prolog() {
+		switch t := t.(type) {
+		case *ProcInst:
+			list = append(list, "pi:"+t.Target)
+		case *Comment:
+			list = append(list, "comment:"+t.Data)
+		case *Directive:
+			list = append(list, "directive:"+t.Data)
+		}
+	}
+	checkStrEq(t, strings.Join(list, ","), "pi:xml,comment:c1,directive:DOCTYPE root,pi:pi")
+
+	pis := doc.ProcInsts()
+	checkIntEq(t, len(pis), 1)
+	checkStrEq(t, pis[0].Inst, "a")
+	comments := doc.PrologComments()
+	checkIntEq(t, len(comments), 1)
+	checkStrEq(t, comments[0].Data, "c1")
+
+	doc.AddProcInst("xml-stylesheet", `href="style.xsl"`)
+	doc.RemoveChild(pis[0])
+	pis = doc.ProcInsts()
+	checkIntEq(t, len(pis), 1)
+	checkStrEq(t, pis[0].Target, "xml-stylesheet")
+	checkIndexes(t, &doc.Element)
+
+	doc.Unindent()
+	out, _ := doc.WriteToString()
+	checkStrEq(t, out, `<?xml version="1.0"?><!--c1--><!DOCTYPE root><?xml-stylesheet href="style.xsl"?><root><?pi inner?><!--inner--></root><!--after-->`)
+
+	doc = NewDocument()
+	doc.AddProcInst("pi", "")
+	checkIntEq(t, len(doc.ProcInsts()), 1)
+	checkIntEq(t, len(doc.Prolog()), 1)
+}
+
+func TestEpilog(t *testing.T) {
+	input := "<?xml version=\"1.0\"?>\n<!--head-->\n<root/>\n<!--tail-->\n<?pi x?>\n"
+	doc := newDocumentFromString(t, input)
+
+	var list []string
+	for _, tok := range doc.Epilog() {
+		list = append(list, TokenKind(tok).String())
+	}
+	checkStrEq(t, strings.Join(list, ","), "Comment,ProcInst")
+	checkIntEq(t, len(doc.Prolog()), 2)
+
+	doc.StripEpilog()
+	checkIntEq(t, len(doc.Epilog()), 0)
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, "<?xml version=\"1.0\"?>\n<!--head-->\n<root/>")
+	checkIndexes(t, &doc.Element)
+
+	doc.StripProlog()
+	checkIntEq(t, len(doc.Prolog()), 0)
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<root/>")
+	checkIntEq(t, doc.Root().Index(), 0)
+	checkIndexes(t, &doc.Element)
+
+	// Documents without a root element are left alone.
+	doc = newDocumentFromString(t, "<!--a--><!--b-->")
+	checkIntEq(t, len(doc.Epilog()), 0)
+	doc.StripProlog()
+	doc.StripEpilog()
+	checkIntEq(t, len(doc.Child), 2)
+}
+
+func TestDocumentValidate(t *testing.T) {
+	tests := []struct {
+		build    func(d *Document)
+		err      error
+		fragment bool
+	}{
+		{func(d *Document) {
+			d.CreateProcInst("xml", `version="1.0"`)
+			d.CreateText("\n")
+			d.CreateDirective("DOCTYPE root")
+			d.CreateComment("c")
+			d.CreateElement("root")
+			d.CreateText("\n")
+		}, nil, false},
+		{func(d *Document) {}, errNoRoot, true},
+		{func(d *Document) { d.CreateComment("c") }, errNoRoot, true},
+		{func(d *Document) {
+			d.CreateElement("a")
+			d.CreateElement("b")
+		}, errMultipleRoots, true},
+		{func(d *Document) {
+			d.CreateText("text")
+			d.CreateElement("a")
+		}, errTopLevelText, true},
+		{func(d *Document) {
+			d.CreateElement("a")
+			d.CreateCData(" ")
+		}, errTopLevelText, true},
+		{func(d *Document) {
+			d.CreateText("\n")
+			d.CreateProcInst("xml", `version="1.0"`)
+			d.CreateElement("a")
+		}, errMisplacedXMLDecl, false},
+		{func(d *Document) {
+			d.CreateElement("a")
+			d.CreateDirective("DOCTYPE a")
+		}, errLateDirective, false},
+		{func(d *Document) {
+			d.CreateProcInst("xml-stylesheet", `href="a.xsl"`)
+			d.CreateElement("a")
+			d.CreateProcInst("pi", "")
+		}, nil, false},
+	}
+
+	for i, test := range tests {
+		doc := NewDocument()
+		test.build(doc)
+		if err := doc.Validate(); err != test.err {
+			t.Errorf("etree: test #%d: Validate returned %v, expected %v", i, err, test.err)
+		}
+		checkBoolEq(t, doc.IsFragment(), test.fragment)
+	}
+}
+
+func TestWriteMaxBytes(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a>text</a><b/></root>`)
+	full, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal("etree: WriteToString failed:", err)
+	}
+
+	doc.WriteSettings.MaxBytes = int64(len(full))
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Errorf("etree: unexpected error at exact limit: %v", err)
+	}
+	checkStrEq(t, s, full)
+
+	doc.WriteSettings.MaxBytes = 10
+	var buf bytes.Buffer
+	n, err := doc.WriteTo(&buf)
+	if err != ErrMaxBytes {
+		t.Errorf("etree: expected ErrMaxBytes, got %v", err)
+	}
+	checkIntEq(t, int(n), 10)
+	checkStrEq(t, buf.String(), full[:10])
+}
+
+func TestDocumentStats(t *testing.T) {
+	doc := newDocumentFromString(t, `<root a="1"><b x="1" y="2">text<c/></b><![CDATA[cd]]><!--comment--></root>`)
+
+	stats := doc.Stats()
+	checkIntEq(t, stats.Elements, 3)
+	checkIntEq(t, stats.Attributes, 3)
+	checkIntEq(t, stats.TextBytes, 6)
+	checkIntEq(t, stats.MaxDepth, 3)
+
+	checkIntEq(t, doc.Root().AttrCount(), 1)
+	checkIntEq(t, doc.FindElement("//b").AttrCount(), 2)
+	checkIntEq(t, doc.FindElement("//c").AttrCount(), 0)
+
+	empty := NewDocument().Stats()
+	checkIntEq(t, empty.Elements, 0)
+	checkIntEq(t, empty.MaxDepth, 0)
+}
+
+func TestReadTrimText(t *testing.T) {
+	s := "<root>\n\t<year>\n\t\t2005 \n</year>\n\t<title> A  B </title>\n\t<c><![CDATA[ x ]]></c>\n</root>"
+
+	doc := newDocumentFromString2(t, s, ReadSettings{TrimText: true})
+	checkStrEq(t, doc.FindElement("//year").Text(), "2005")
+	checkStrEq(t, doc.FindElement("//title").Text(), "A  B")
+	checkStrEq(t, doc.FindElement("//c").Text(), "x")
+	checkStrEq(t, doc.Root().Child[0].(*CharData).Data, "\n\t")
+
+	doc = newDocumentFromString2(t, s, ReadSettings{TrimText: true, PreserveCData: true})
+	checkStrEq(t, doc.FindElement("//c").Text(), " x ")
+
+	doc = newDocumentFromString2(t, "<a>&#10; x&#9;y&#10;</a>", ReadSettings{TrimText: true, PreserveCharRefs: true})
+	out, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal("etree: WriteToString failed:", err)
+	}
+	checkStrEq(t, out, "<a>x&#x9;y</a>")
+}
+
+func TestTagIndex(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a n="1"/><p:b n="2"/><a n="3"/><c n="4"/></root>`)
+	root := doc.Root()
+	root.BuildTagIndex()
+
+	ids := func(elements []*Element) string {
+		var list []string
+		for _, e := range elements {
+			list = append(list, e.SelectAttrValue("n", ""))
+		}
+		return strings.Join(list, ",")
+	}
+
+	checkStrEq(t, ids(root.SelectElements("a")), "1,3")
+	checkStrEq(t, ids(root.SelectElements("b")), "2")
+	checkStrEq(t, ids(root.SelectElements("p:b")), "2")
+	checkStrEq(t, ids(root.SelectElements("q:b")), "")
+	checkStrEq(t, ids(root.SelectElements("missing")), "")
+	checkStrEq(t, root.SelectElement("a").SelectAttrValue("n", ""), "1")
+
+	// Adding a child discards the index.
+	root.InsertChildAt(0, NewElement("a").WithAttr("n", "0"))
+	checkStrEq(t, ids(root.SelectElements("a")), "0,1,3")
+
+	// Removing or renaming a child is detected.
+	root.BuildTagIndex()
+	root.RemoveChild(root.SelectElement("a"))
+	checkStrEq(t, ids(root.SelectElements("a")), "1,3")
+
+	// A lookup doesn't modify the stale index, so concurrent lookups are
+	// safe.
+	checkBoolEq(t, root.tagIndex != nil, true)
+	root.BuildTagIndex()
+	root.SelectElement("c").SetTag("a")
+	checkStrEq(t, ids(root.SelectElements("a")), "1,3,4")
+	root.BuildTagIndex()
+	root.SelectElement("a").SetTag("d")
+	checkStrEq(t, root.SelectElement("a").SelectAttrValue("n", ""), "3")
+
+	root.DropTagIndex()
+	checkStrEq(t, ids(root.SelectElements("a")), "3,4")
+	checkBoolEq(t, root.Copy().tagIndex == nil, true)
+}
+
+func benchmarkSelectElement(b *testing.B, indexed bool) {
+	root := NewElement("root")
+	for i := 0; i < 10000; i++ {
+		root.CreateElement("item" + strconv.Itoa(i))
+	}
+	if indexed {
+		root.BuildTagIndex()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		root.SelectElement("item9999")
+	}
+}
+
+func BenchmarkSelectElementLinear(b *testing.B)  { benchmarkSelectElement(b, false) }
+func BenchmarkSelectElementIndexed(b *testing.B) { benchmarkSelectElement(b, true) }
@@ -5,7 +5,11 @@
 package etree
 
 import (
+	"bytes"
+	"encoding/xml"
 	"io"
+	"regexp"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
@@ -218,23 +222,178 @@ func (xr *xmlPeekReader) updatePeekBuf() {
 	}
 }
 
+// An excerptSource provides the input surrounding an offset, so that it
+// may be reported in a ParseError.
+type excerptSource interface {
+	Excerpt(offset int64, radius int) string
+}
+
+// xmlTailReader implements a proxy reader that retains the most recently
+// read bytes of its encapsulated reader, so that the input surrounding a
+// parse error can be reported. The bytes are retained in two chunks, the
+// older of which holds at least tailChunkSize bytes once it is filled.
+type xmlTailReader struct {
+	r     io.Reader
+	prev  []byte // the older chunk of retained bytes
+	cur   []byte // the most recently read bytes
+	bytes int64  // total bytes read
+}
+
+// tailChunkSize is the minimum number of bytes in each filled chunk retained
+// by an xmlTailReader. It must exceed the size of the read-ahead buffers
+// between the reader and the xml.Decoder.
+const tailChunkSize = 8192
+
+func newXmlTailReader(r io.Reader) *xmlTailReader {
+	return &xmlTailReader{r: r}
+}
+
+func (xr *xmlTailReader) Read(p []byte) (n int, err error) {
+	n, err = xr.r.Read(p)
+	if len(xr.cur) >= tailChunkSize {
+		xr.prev, xr.cur = xr.cur, xr.prev[:0]
+	}
+	xr.cur = append(xr.cur, p[:n]...)
+	xr.bytes += int64(n)
+	return n, err
+}
+
+// Excerpt returns the retained input surrounding the offset, extending up
+// to 'radius' bytes in each direction and stopping at line breaks.
+func (xr *xmlTailReader) Excerpt(offset int64, radius int) string {
+	curStart := xr.bytes - int64(len(xr.cur))
+	prevStart := curStart - int64(len(xr.prev))
+	retained := func(start, end int64) []byte {
+		start, end = max(start, prevStart), min(end, xr.bytes)
+		var b []byte
+		if start < curStart && start < end {
+			b = append(b, xr.prev[start-prevStart:min(end, curStart)-prevStart]...)
+		}
+		if end > curStart {
+			b = append(b, xr.cur[max(start, curStart)-curStart:end-curStart]...)
+		}
+		return b
+	}
+	return excerpt(retained(offset-int64(radius), offset), retained(offset, offset+int64(radius)))
+}
+
+// xmlReaderAtSource provides excerpts of input read from an in-memory
+// reader, such as a bytes.Reader or strings.Reader, without retaining any
+// of the input as it is read.
+type xmlReaderAtSource struct {
+	r    io.ReaderAt
+	base int64 // position of the reader when reading began
+	size int64 // size of the reader's data
+}
+
+// newXmlReaderAtSource returns an excerpt source for the reader 'r' if it
+// is an in-memory reader, or nil otherwise.
+func newXmlReaderAtSource(r io.Reader) *xmlReaderAtSource {
+	if ra, ok := r.(interface {
+		io.ReaderAt
+		Len() int
+		Size() int64
+	}); ok {
+		return &xmlReaderAtSource{ra, ra.Size() - int64(ra.Len()), ra.Size()}
+	}
+	return nil
+}
+
+// Excerpt returns the input surrounding the offset, extending up to 'radius'
+// bytes in each direction and stopping at line breaks.
+func (xs *xmlReaderAtSource) Excerpt(offset int64, radius int) string {
+	start := max(offset-int64(radius), 0)
+	end := min(offset+int64(radius), xs.size-xs.base)
+	if start >= end {
+		return ""
+	}
+	b := make([]byte, end-start)
+	n, _ := xs.r.ReadAt(b, xs.base+start)
+	b = b[:n]
+	split := min(int(offset-start), len(b))
+	return excerpt(b[:split], b[split:])
+}
+
+// excerpt joins the input 'before' and 'after' an offset, keeping only the
+// line containing the offset.
+func excerpt(before, after []byte) string {
+	if i := bytes.LastIndexAny(before, "\r\n"); i >= 0 {
+		before = before[i+1:]
+	}
+	if i := bytes.IndexAny(after, "\r\n"); i >= 0 {
+		after = after[:i]
+	}
+	return strings.TrimSpace(strings.ToValidUTF8(string(before)+string(after), ""))
+}
+
+// xmlRecordReader implements a proxy reader that records the data read from
+// its encapsulated reader, so that the raw input of previously decoded
+// tokens may be examined. Data preceding an offset passed to Discard is no
+// longer retained.
+type xmlRecordReader struct {
+	r         io.Reader
+	buf       []byte // recorded data
+	bufOffset int64  // total read offset of the start of buf
+}
+
+func newXmlRecordReader(r io.Reader) *xmlRecordReader {
+	return &xmlRecordReader{r: r}
+}
+
+func (xr *xmlRecordReader) Read(p []byte) (n int, err error) {
+	n, err = xr.r.Read(p)
+	xr.buf = append(xr.buf, p[:n]...)
+	return n, err
+}
+
+// Discard stops retaining the recorded data preceding the offset.
+func (xr *xmlRecordReader) Discard(offset int64) {
+	if n := offset - xr.bufOffset; n > 0 && n <= int64(len(xr.buf)) {
+		xr.buf = xr.buf[:copy(xr.buf, xr.buf[n:])]
+		xr.bufOffset = offset
+	}
+}
+
+// Recorded returns the recorded data between the start and end offsets, or
+// nil if the data is no longer retained.
+func (xr *xmlRecordReader) Recorded(start, end int64) []byte {
+	if start < xr.bufOffset || end < start || end-xr.bufOffset > int64(len(xr.buf)) {
+		return nil
+	}
+	return xr.buf[start-xr.bufOffset : end-xr.bufOffset]
+}
+
 // xmlWriter implements a proxy writer that counts the number of
-// bytes written by its encapsulated writer.
+// bytes written by its encapsulated writer. If maxBytes is greater than
+// zero, it writes no more than maxBytes bytes and returns ErrMaxBytes once
+// the limit is exceeded.
 type xmlWriter struct {
-	w     io.Writer
-	bytes int64
+	w        io.Writer
+	bytes    int64
+	maxBytes int64
 }
 
-func newXmlWriter(w io.Writer) *xmlWriter {
-	return &xmlWriter{w: w}
+func newXmlWriter(w io.Writer, maxBytes int64) *xmlWriter {
+	return &xmlWriter{w: w, maxBytes: maxBytes}
 }
 
 func (xw *xmlWriter) Write(p []byte) (n int, err error) {
+	if xw.maxBytes > 0 && xw.bytes+int64(len(p)) > xw.maxBytes {
+		n, err = xw.w.Write(p[:xw.maxBytes-xw.bytes])
+		xw.bytes += int64(n)
+		if err == nil {
+			err = ErrMaxBytes
+		}
+		return n, err
+	}
 	n, err = xw.w.Write(p)
 	xw.bytes += int64(n)
 	return n, err
 }
 
+// whitespace holds the characters considered whitespace by isWhitespace.
+const whitespace = " \t\n\r"
+
 // isWhitespace returns true if the byte slice contains only
 // whitespace characters.
 func isWhitespace(s string) bool {
@@ -246,6 +405,17 @@ func isWhitespace(s string) bool {
 	return true
 }
 
+// isSpaceByte returns true if the byte is an XML whitespace character.
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// isValidComment returns true if the string s may be used as the text of an
+// XML comment without producing malformed XML.
+func isValidComment(s string) bool {
+	return !strings.Contains(s, "--") && !strings.HasSuffix(s, "-")
+}
+
 // spaceMatch returns true if namespace a is the empty string
 // or if namespace a equals namespace b.
 func spaceMatch(a, b string) bool {
@@ -267,6 +437,26 @@ func spaceDecompose(str string) (space, key string) {
 	return str[:colon], str[colon+1:]
 }
 
+// spaceCompose joins a namespace prefix and a tag or key into a
+// namespace:tag identifier. It returns the tag alone if the prefix is empty.
+func spaceCompose(space, key string) string {
+	if space == "" {
+		return key
+	}
+	return space + ":" + key
+}
+
+// isIndentString returns true if the string contains only spaces and tabs.
+// An empty string is also considered an indent string.
+func isIndentString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] != ' ' && s[i] != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
 // Strings used by indentCRLF and indentLF
 const (
 	indentSpaces = "\r\n                                                                "
@@ -320,15 +510,192 @@ func isInteger(s string) bool {
 	return true
 }
 
+// isVarName returns true if the string s is a valid path variable name.
+func isVarName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') &&
+			c != '_' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// isName returns true if the string is a legal XML name, which may contain
+// colons, suitable as the name of an entity or a document type.
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r != ':' && (r == utf8.RuneError || !isNameChar(r, i == 0)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isNCName returns true if the string is a legal XML name that contains no
+// colons, making it suitable as an element's tag or namespace prefix.
+func isNCName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r == utf8.RuneError || !isNameChar(r, i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// isNameChar returns true if the rune may appear in an XML name, excluding
+// the colon. If 'first' is true, the rune must be a legal first character.
+func isNameChar(r rune, first bool) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_',
+		r >= 0xC0 && r <= 0xD6, r >= 0xD8 && r <= 0xF6, r >= 0xF8 && r <= 0x2FF,
+		r >= 0x370 && r <= 0x37D, r >= 0x37F && r <= 0x1FFF, r >= 0x200C && r <= 0x200D,
+		r >= 0x2070 && r <= 0x218F, r >= 0x2C00 && r <= 0x2FEF, r >= 0x3001 && r <= 0xD7FF,
+		r >= 0xF900 && r <= 0xFDCF, r >= 0xFDF0 && r <= 0xFFFD, r >= 0x10000 && r <= 0xEFFFF:
+		return true
+	case first:
+		return false
+	case r >= '0' && r <= '9', r == '-', r == '.', r == 0xB7,
+		r >= 0x300 && r <= 0x36F, r >= 0x203F && r <= 0x2040:
+		return true
+	default:
+		return false
+	}
+}
+
+// findRefs compares the raw input 'raw' of a text token with its decoded
+// text 'data'. It returns the offsets within data of each tab, newline and
+// carriage return character that appeared in the raw input as a character
+// reference, and the offsets of each reference to an undefined entity that
+// the decoder left unexpanded in the text. The 'entity' map holds the
+// non-standard entities known to the decoder. The function returns nil
+// slices if the raw input can't be reconciled with the decoded text.
+func findRefs(raw []byte, data string, entity map[string]string) (refs, ents []int) {
+	j := 0
+	for i := 0; i < len(raw); {
+		switch raw[i] {
+		case '&':
+			end := bytes.IndexByte(raw[i:], ';')
+			if end < 0 {
+				return nil, nil
+			}
+			name := string(raw[i+1 : i+end])
+			i += end + 1
+			switch {
+			case strings.HasPrefix(name, "#"):
+				r, ok := parseCharRef(name[1:])
+				if !ok {
+					return nil, nil
+				}
+				if r == '\t' || r == '\n' || r == '\r' {
+					if j >= len(data) || data[j] != byte(r) {
+						return nil, nil
+					}
+					refs = append(refs, j)
+				}
+				j += utf8.RuneLen(r)
+			case isPredefinedEntity(name):
+				j++
+			default:
+				if value, ok := entity[name]; ok {
+					j += len(value)
+					break
+				}
+				ref := "&" + name + ";"
+				if !isName(name) || j > len(data) || !strings.HasPrefix(data[j:], ref) {
+					return nil, nil
+				}
+				ents = append(ents, j)
+				j += len(ref)
+			}
+		case '\r':
+			// The decoder translates "\r\n" and "\r" to "\n".
+			i++
+			if i < len(raw) && raw[i] == '\n' {
+				i++
+			}
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	if j != len(data) {
+		return nil, nil
+	}
+	return refs, ents
+}
+
+// trimCharRefs adjusts the character reference offsets of a text string
+// after 'start' bytes have been trimmed from its beginning and it has been
+// shortened to 'n' bytes. References within the trimmed bytes are dropped.
+func trimCharRefs(refs []int, start, n int) []int {
+	var trimmed []int
+	for _, i := range refs {
+		if i >= start && i < start+n {
+			trimmed = append(trimmed, i-start)
+		}
+	}
+	return trimmed
+}
+
+// parseCharRef parses the numeric portion of a character reference, such as
+// "10" or "xA", and returns the referenced character.
+func parseCharRef(s string) (rune, bool) {
+	base := 10
+	if strings.HasPrefix(s, "x") {
+		s, base = s[1:], 16
+	}
+	n, err := strconv.ParseUint(s, base, 32)
+	if err != nil || n > utf8.MaxRune {
+		return 0, false
+	}
+	return rune(n), true
+}
+
+// isCharRefByte returns true if 'c' is a tab, newline or carriage return
+// character, the only characters preserved as character references.
+func isCharRefByte(c byte) bool {
+	return c == '\t' || c == '\n' || c == '\r'
+}
+
+// writeCharRef writes the tab, newline or carriage return character 'c' as
+// a character reference.
+func writeCharRef(w Writer, c byte) {
+	switch c {
+	case '\t':
+		w.WriteString("&#x9;")
+	case '\n':
+		w.WriteString("&#xA;")
+	case '\r':
+		w.WriteString("&#xD;")
+	default:
+		w.WriteByte(c)
+	}
+}
+
 type escapeMode byte
 
 const (
 	escapeNormal escapeMode = iota
+	escapeNormalAttrWhitespace
 	escapeCanonicalText
 	escapeCanonicalAttr
 )
 
 // escapeString writes an escaped version of a string to the writer.
+// Characters outside the range of legal XML characters are replaced by the
+// Unicode replacement character.
 func escapeString(w Writer, s string, m escapeMode) {
 	var esc []byte
 	last := 0
@@ -346,7 +713,7 @@ func escapeString(w Writer, s string, m escapeMode) {
 			}
 			esc = []byte("&gt;")
 		case '\'':
-			if m != escapeNormal {
+			if m != escapeNormal && m != escapeNormalAttrWhitespace {
 				continue
 			}
 			esc = []byte("&apos;")
@@ -356,12 +723,12 @@ func escapeString(w Writer, s string, m escapeMode) {
 			}
 			esc = []byte("&quot;")
 		case '\t':
-			if m != escapeCanonicalAttr {
+			if m != escapeCanonicalAttr && m != escapeNormalAttrWhitespace {
 				continue
 			}
 			esc = []byte("&#x9;")
 		case '\n':
-			if m != escapeCanonicalAttr {
+			if m != escapeCanonicalAttr && m != escapeNormalAttrWhitespace {
 				continue
 			}
 			esc = []byte("&#xA;")
@@ -384,6 +751,52 @@ func escapeString(w Writer, s string, m escapeMode) {
 	w.WriteString(s[last:])
 }
 
+// isValidChars returns true if the string contains only legal XML
+// characters encoded as valid UTF-8.
+func isValidChars(s string) bool {
+	for i := 0; i < len(s); {
+		r, width := utf8.DecodeRuneInString(s[i:])
+		if !isInCharacterRange(r) || (r == 0xFFFD && width == 1) {
+			return false
+		}
+		i += width
+	}
+	return true
+}
+
+// hasValidChars returns true if the token and, for an element, its
+// attributes and descendants contain only legal XML characters.
+func hasValidChars(t Token) bool {
+	switch t := t.(type) {
+	case *Element:
+		if !isValidChars(t.Space) || !isValidChars(t.Tag) {
+			return false
+		}
+		for _, a := range t.Attr {
+			if !isValidChars(a.Space) || !isValidChars(a.Key) || !isValidChars(a.Value) {
+				return false
+			}
+		}
+		for _, c := range t.Child {
+			if !hasValidChars(c) {
+				return false
+			}
+		}
+		return true
+	case *CharData:
+		return isValidChars(t.Data)
+	case *Comment:
+		return isValidChars(t.Data)
+	case *Directive:
+		return isValidChars(t.Data)
+	case *ProcInst:
+		return isValidChars(t.Target) && isValidChars(t.Inst)
+	case *EntityRef:
+		return isValidChars(t.Name)
+	}
+	return true
+}
+
 func isInCharacterRange(r rune) bool {
 	return r == 0x09 ||
 		r == 0x0A ||
@@ -392,3 +805,412 @@ func isInCharacterRange(r rune) bool {
 		r >= 0xE000 && r <= 0xFFFD ||
 		r >= 0x10000 && r <= 0x10FFFF
 }
+
+// pseudoAttrValue returns the value of the pseudo-attribute 'key' within a
+// processing instruction's value, such as the encoding within the value
+// `version="1.0" encoding="UTF-8"`. The boolean result is false if the
+// pseudo-attribute isn't present or the value is malformed.
+func pseudoAttrValue(inst, key string) (string, bool) {
+	start, end := findPseudoAttr(inst, key)
+	if start < 0 {
+		return "", false
+	}
+	return inst[start:end], true
+}
+
+// setPseudoAttrValue returns a copy of the processing instruction value
+// 'inst' with the pseudo-attribute 'key' set to 'value'. If the
+// pseudo-attribute isn't already present, it is appended.
+func setPseudoAttrValue(inst, key, value string) string {
+	start, end := findPseudoAttr(inst, key)
+	if start >= 0 {
+		return inst[:start] + value + inst[end:]
+	}
+	trimmed := strings.TrimRight(inst, " \t\r\n")
+	sep := ""
+	if trimmed != "" {
+		sep = " "
+	}
+	return trimmed + sep + key + `="` + value + `"` + inst[len(trimmed):]
+}
+
+// normalizePseudoAttrs returns the processing instruction value 'inst' with
+// its pseudo-attributes separated by single spaces and their values enclosed
+// in double quotes, unless a value contains a double quote. If 'inst' isn't
+// a well-formed list of pseudo-attributes, it is returned unchanged.
+func normalizePseudoAttrs(inst string) string {
+	attrs, ok := parsePseudoAttrs(inst)
+	if !ok {
+		return inst
+	}
+	var b strings.Builder
+	for _, a := range attrs {
+		value := inst[a.start:a.end]
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(a.name)
+		b.WriteByte('=')
+		if strings.IndexByte(value, '"') >= 0 {
+			b.WriteString("'" + value + "'")
+		} else {
+			b.WriteString(`"` + value + `"`)
+		}
+	}
+	return b.String()
+}
+
+// findPseudoAttr returns the start and end offsets of the value of the
+// pseudo-attribute 'key' within the processing instruction value 'inst'.
+// The offsets are -1 if the pseudo-attribute can't be found or 'inst' isn't
+// a well-formed list of pseudo-attributes.
+func findPseudoAttr(inst, key string) (start, end int) {
+	attrs, _ := parsePseudoAttrs(inst)
+	for _, a := range attrs {
+		if a.name == key {
+			return a.start, a.end
+		}
+	}
+	return -1, -1
+}
+
+// A pseudoAttr is a pseudo-attribute within a processing instruction value,
+// such as version="1.0" within an XML declaration.
+type pseudoAttr struct {
+	name       string
+	start, end int // offsets of the value within the instruction
+}
+
+// parsePseudoAttrs splits the processing instruction value 'inst' into a
+// list of pseudo-attributes, each a name followed by an equals sign and a
+// quoted value, optionally separated by whitespace. The boolean result is
+// false, and the list is nil, if 'inst' isn't a well-formed list of
+// pseudo-attributes.
+func parsePseudoAttrs(inst string) ([]pseudoAttr, bool) {
+	var attrs []pseudoAttr
+	skipSpace := func(i int) int {
+		for i < len(inst) && isSpaceByte(inst[i]) {
+			i++
+		}
+		return i
+	}
+	for i := skipSpace(0); i < len(inst); i = skipSpace(i) {
+		nameStart := i
+		for i < len(inst) && inst[i] != '=' && !isSpaceByte(inst[i]) {
+			i++
+		}
+		name := inst[nameStart:i]
+		i = skipSpace(i)
+		if name == "" || i >= len(inst) || inst[i] != '=' {
+			return nil, false
+		}
+		i = skipSpace(i + 1)
+		if i >= len(inst) || (inst[i] != '"' && inst[i] != '\'') {
+			return nil, false
+		}
+		end := strings.IndexByte(inst[i+1:], inst[i])
+		if end < 0 {
+			return nil, false
+		}
+		attrs = append(attrs, pseudoAttr{name, i + 1, i + 1 + end})
+		i += end + 2
+	}
+	return attrs, true
+}
+
+// isXMLVersion returns true if the string is an XML version number of the
+// form 1.x, as allowed in an XML declaration.
+func isXMLVersion(s string) bool {
+	digits, ok := strings.CutPrefix(s, "1.")
+	if !ok || digits == "" {
+		return false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isEncName returns true if the string is a legal encoding name, as allowed
+// in an XML declaration.
+func isEncName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		case i > 0 && ((c >= '0' && c <= '9') || c == '.' || c == '_' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isPubidLiteral returns true if the string contains only the characters
+// allowed in a DOCTYPE public identifier.
+func isPubidLiteral(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') &&
+			strings.IndexByte(" \r\n-'()+,./:=?;!*#@$_%", c) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// quoteDocTypeID returns a DOCTYPE public or system identifier enclosed in
+// quotes. Double quotes are used unless the identifier contains one.
+func quoteDocTypeID(id string) string {
+	if strings.IndexByte(id, '"') >= 0 {
+		return "'" + id + "'"
+	}
+	return `"` + id + `"`
+}
+
+// parseDocType parses the contents of a DOCTYPE directive, such as
+// `DOCTYPE html PUBLIC "pubid" "sysid"`, and returns its root element name
+// and its public and system identifiers. The boolean result is false if the
+// directive isn't a well-formed DOCTYPE declaration.
+func parseDocType(data string) (name, publicID, systemID string, ok bool) {
+	rest, found := strings.CutPrefix(data, "DOCTYPE")
+	if !found || rest == "" || !isSpaceByte(rest[0]) {
+		return "", "", "", false
+	}
+	rest = strings.TrimLeft(rest, whitespace)
+	i := 0
+	for i < len(rest) && !isSpaceByte(rest[i]) && rest[i] != '[' {
+		i++
+	}
+	name, rest = rest[:i], strings.TrimLeft(rest[i:], whitespace)
+	if name == "" {
+		return "", "", "", false
+	}
+
+	var literal string
+	switch {
+	case strings.HasPrefix(rest, "PUBLIC"):
+		if literal, rest, ok = cutQuoted(strings.TrimLeft(rest[6:], whitespace)); !ok {
+			return "", "", "", false
+		}
+		publicID = literal
+		rest = strings.TrimLeft(rest, whitespace)
+		if rest == "" || (rest[0] != '"' && rest[0] != '\'') {
+			break
+		}
+		fallthrough
+	case strings.HasPrefix(rest, "SYSTEM"):
+		rest = strings.TrimPrefix(rest, "SYSTEM")
+		if literal, rest, ok = cutQuoted(strings.TrimLeft(rest, whitespace)); !ok {
+			return "", "", "", false
+		}
+		systemID = literal
+		rest = strings.TrimLeft(rest, whitespace)
+	}
+	if rest != "" && rest[0] != '[' {
+		return "", "", "", false
+	}
+	return name, publicID, systemID, true
+}
+
+// cutQuoted returns the contents of the single- or double-quoted literal at
+// the start of s, along with the remainder of s following the literal.
+func cutQuoted(s string) (literal, rest string, ok bool) {
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		return "", s, false
+	}
+	end := strings.IndexByte(s[1:], s[0])
+	if end < 0 {
+		return "", s, false
+	}
+	return s[1 : end+1], s[end+2:], true
+}
+
+var entityRefRegexp = regexp.MustCompile(`&([^#&;<>'"\s][^&;<>'"\s]*);`)
+
+// undefinedEntities returns a copy of the 'entity' map extended with an
+// empty replacement for each entity referenced by the input 'b' that is
+// neither predefined nor listed in the map. It allows the input to be
+// validated by a strict decoder when undefined entities are preserved.
+func undefinedEntities(b []byte, entity map[string]string) map[string]string {
+	m := make(map[string]string, len(entity))
+	for k, v := range entity {
+		m[k] = v
+	}
+	for _, match := range entityRefRegexp.FindAllSubmatch(b, -1) {
+		name := string(match[1])
+		if _, ok := m[name]; !ok && !isPredefinedEntity(name) {
+			m[name] = ""
+		}
+	}
+	return m
+}
+
+// isPredefinedEntity returns true if 'name' is one of the five entities
+// predefined by XML.
+func isPredefinedEntity(name string) bool {
+	switch name {
+	case "amp", "lt", "gt", "apos", "quot":
+		return true
+	}
+	return false
+}
+
+// addText adds the decoded text 'data' to the parent element, splitting it
+// into CharData tokens and an EntityRef token for each undefined entity
+// reference starting at one of the offsets 'ents'. The offsets 'refs' locate
+// the characters within the text that are preserved as character
+// references. If 'coalesce' is true, text is merged into a preceding
+// CharData token of the same kind.
+func addText(parent *Element, data string, flags charDataFlags, refs, ents []int, coalesce bool) {
+	last := 0
+	for _, i := range ents {
+		end := i + strings.IndexByte(data[i:], ';')
+		if i > last {
+			addCharData(parent, data[last:i], textFlags(data[last:i]), trimCharRefs(refs, last, i-last), coalesce)
+		}
+		newEntityRef(data[i+1:end], parent)
+		last = end + 1
+	}
+	if len(ents) == 0 {
+		addCharData(parent, data, flags, refs, coalesce)
+	} else if last < len(data) {
+		addCharData(parent, data[last:], textFlags(data[last:]), trimCharRefs(refs, last, len(data)-last), coalesce)
+	}
+}
+
+// textFlags returns the flags of a simple text CharData token holding the
+// text 'data'.
+func textFlags(data string) charDataFlags {
+	if isWhitespace(data) {
+		return whitespaceFlag
+	}
+	return 0
+}
+
+// addCharData adds a CharData token holding the text 'data' to the parent
+// element. If 'coalesce' is true and the parent's last child token is a
+// CharData token of the same kind, the text is appended to it instead.
+func addCharData(parent *Element, data string, flags charDataFlags, refs []int, coalesce bool) {
+	if coalesce {
+		if n := len(parent.Child); n > 0 {
+			if prev, ok := parent.Child[n-1].(*CharData); ok && prev.IsCData() == (flags == cdataFlag) {
+				for _, i := range refs {
+					prev.refs = append(prev.refs, len(prev.Data)+i)
+				}
+				prev.Data += data
+				if flags != cdataFlag && isWhitespace(prev.Data) {
+					prev.flags = whitespaceFlag
+				} else {
+					prev.flags &= cdataFlag
+				}
+				return
+			}
+		}
+	}
+	newCharData(data, flags, parent).refs = refs
+}
+
+// badEntityRef returns a message describing the first ampersand in the raw
+// input 'raw' of the token 't' that doesn't begin a character reference or
+// a reference to an entity that is predefined or listed in the 'entity'
+// map, as required by the decoder's strict mode. It returns the empty
+// string if there is no such ampersand. Only character data, other than
+// CDATA sections, and start elements are checked. If 'undefined' is true,
+// references to undefined entities are allowed within character data, but
+// they are reported within attribute values, where they can't be preserved.
+func badEntityRef(t xml.Token, raw []byte, entity map[string]string, undefined bool) string {
+	_, isText := t.(xml.CharData)
+	switch t.(type) {
+	case xml.CharData:
+		if bytes.HasPrefix(raw, cdataPrefix) {
+			return ""
+		}
+	case xml.StartElement:
+	default:
+		return ""
+	}
+
+	for i := bytes.IndexByte(raw, '&'); i >= 0; i = bytes.IndexByte(raw, '&') {
+		raw = raw[i+1:]
+		end := bytes.IndexByte(raw, ';')
+		if end < 0 {
+			return "invalid character entity &" + string(raw[:min(len(raw), 8)]) + " (no semicolon)"
+		}
+		ref := string(raw[:end])
+		if !isValidRef(ref, entity) {
+			switch {
+			case !undefined || !isName(ref):
+				return "invalid character entity &" + ref + ";"
+			case !isText:
+				return "undefined entity &" + ref + "; in attribute value"
+			}
+		}
+		raw = raw[end+1:]
+	}
+	return ""
+}
+
+// badAttr returns a message describing the first attribute in the raw start
+// tag 'raw' that has no value or whose value isn't quoted, as required by
+// the decoder's strict mode. It returns the empty string if there is no such
+// attribute.
+func badAttr(raw []byte) string {
+	i := bytes.IndexAny(raw, whitespace)
+	if i < 0 {
+		return ""
+	}
+	skipSpace := func() {
+		for i < len(raw) && isSpaceByte(raw[i]) {
+			i++
+		}
+	}
+	for {
+		skipSpace()
+		if i >= len(raw) || raw[i] == '/' || raw[i] == '>' {
+			return ""
+		}
+		for i < len(raw) && !isSpaceByte(raw[i]) && raw[i] != '=' && raw[i] != '/' && raw[i] != '>' {
+			i++
+		}
+		skipSpace()
+		if i >= len(raw) || raw[i] != '=' {
+			return "attribute name without = in element"
+		}
+		i++
+		skipSpace()
+		if i >= len(raw) || (raw[i] != '"' && raw[i] != '\'') {
+			return "unquoted or missing attribute value in element"
+		}
+		end := bytes.IndexByte(raw[i+1:], raw[i])
+		if end < 0 {
+			return ""
+		}
+		i += end + 2
+	}
+}
+
+// isValidRef returns true if 'ref', the text between the ampersand and
+// semicolon of a reference, names a legal character or a known entity.
+func isValidRef(ref string, entity map[string]string) bool {
+	var v uint64
+	var err error
+	switch {
+	case strings.HasPrefix(ref, "#x"):
+		v, err = strconv.ParseUint(ref[2:], 16, 32)
+	case strings.HasPrefix(ref, "#"):
+		v, err = strconv.ParseUint(ref[1:], 10, 32)
+	default:
+		if isPredefinedEntity(ref) {
+			return true
+		}
+		_, ok := entity[ref]
+		return ok
+	}
+	return err == nil && isInCharacterRange(rune(v))
+}
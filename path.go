@@ -5,8 +5,11 @@
 package etree
 
 import (
+	"container/list"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 /*
@@ -19,6 +22,14 @@ be modified by one or more bracket-enclosed "filters". Selectors are used to
 traverse the etree from element to element, while filters are used to narrow
 the list of candidate elements at each node.
 
+A relative path is evaluated starting from the element on which a Find*
+method is called. When that element is a Document, the path's first selector
+is applied to the document's children, which include the root element along
+with any top-level comments or processing instructions. For instance, the
+path "book" finds a root element named book, not the root element's book
+children. Use the Document's Find*FromRoot methods to evaluate a relative
+path starting from the document's root element instead.
+
 Although etree Path strings are structurally and behaviorally similar to XPath
 strings (https://www.w3.org/TR/1999/REC-xpath-19991116/), they have a more
 limited set of selectors and filtering options.
@@ -32,14 +43,42 @@ The following selectors are supported by etree paths:
 	//              Select all descendants of the current element.
 	tag             Select all child elements with a name matching the tag.
 
+	descendant-or-self::tag  Select the current element and all descendants with a name matching the tag.
+	descendant-or-self::*    Select the current element and all of its descendants.
+
+When a segment contains filters without a preceding selector, the *
+selector is assumed, so a path such as //[@attrib] is equivalent to
+//*[@attrib].
+
+Because the tag following a // selector selects child elements, a path such
+as .//tag never selects the current element itself, even if its name
+matches the tag. Use descendant-or-self::tag to include the current element.
+
+The // and descendant-or-self:: selectors search the entire subtree below
+the current element. To search only a limited number of levels below it,
+compile the path and call its WithMaxDepth method.
+
 The following basic filters are supported:
 
 	[@attrib]       Keep elements with an attribute named attrib.
 	[@attrib='val'] Keep elements with an attribute named attrib and value matching val.
 	[tag]           Keep elements with a child element named tag.
 	[tag='val']     Keep elements with a child element named tag and text matching val.
+	[.='val']       Keep elements whose text matches val. Same as [text()='val'].
 	[n]             Keep the n-th element, where n is a numeric index starting from 1.
 
+Positions count from 1, as in XPath, so [1] keeps the first element. As an
+extension to XPath, a negative position counts backward from the last
+element, so [-1] keeps the last element and [-2] keeps the one before it.
+The position [0], like any position beyond the number of elements, keeps no
+elements.
+
+The attribute name in an attribute filter may use * in place of its
+namespace prefix or its local name, as in [@*:id], which keeps elements with
+an id attribute having any prefix, or [@xml:*], which keeps elements with
+any attribute in the xml namespace. An attribute name without a prefix, as
+in [@id], also matches attributes having any prefix.
+
 The following function-based filters are supported:
 
 	[text()]                    Keep elements with non-empty text.
@@ -51,6 +90,102 @@ The following function-based filters are supported:
 	[namespace-uri()]           Keep elements with non-empty namespace URIs.
 	[namespace-uri()='val']     Keep elements whose namespace URI matches val.
 
+In place of a tag, the basic filters may contain a relative path, which is
+evaluated starting from each element being filtered. Any path containing a
+slash is treated this way:
+
+	[.//tag]          Keep elements with a descendant element named tag.
+	[.//tag='val']    Keep elements with a descendant named tag whose text matches val.
+	[tag/sub='val']   Keep elements with a tag child having a sub child whose text matches val.
+
+Values may also be matched against regular expressions, using the syntax
+of Go's regexp package. The ~ operator keeps elements whose value contains a
+match for the expression anywhere within it, while the ~= operator keeps
+elements whose entire value matches the expression:
+
+	[@attrib~'re']   Keep elements with an attribute named attrib whose value contains a match for re.
+	[@attrib~='re']  Keep elements with an attribute named attrib whose entire value matches re.
+	[tag~'re']       Keep elements with a child element named tag whose text contains a match for re.
+	[.~'re']         Keep elements whose text contains a match for re.
+	[text()~='re']   Keep elements whose entire text matches re.
+
+For example, [@lang~'e.'] keeps an element whose lang attribute is "en" or
+"fre", while [@lang~='e.'] keeps only the former. To anchor only one end of
+the expression, use ~ with the ^ or $ assertions.
+
+Any filter may be negated by wrapping it in not():
+
+	[not(@attrib)]       Keep elements without an attribute named attrib.
+	[not(tag='val')]     Keep elements without a child named tag whose text matches val.
+	[not(text()='val')]  Keep elements whose text doesn't match val.
+
+Filters may be combined using the and and or operators, with and binding
+more tightly than or. Parentheses may be used for grouping:
+
+	[@a and @b]          Keep elements with both an a and a b attribute.
+	[@a or tag='val']    Keep elements with an a attribute or a child named tag whose text matches val.
+	[not(@a or @b)]      Keep elements with neither an a nor a b attribute.
+	[(@a or @b) and c]   Keep elements with an a or b attribute and a child named c.
+
+Each operand is evaluated against the same candidate elements, so a
+position filter within an operand, such as [1 or @a], refers to the
+element's position among those candidates.
+
+The following functions may wrap an attribute (@attrib) or another function
+within a function-based filter:
+
+	[lower-case(@attrib)='val'] Keep elements whose lower-cased attrib value matches val.
+	[upper-case(text())='VAL']  Keep elements whose upper-cased text matches VAL.
+
+The lower-case and upper-case functions fold case using Go's strings.ToLower
+and strings.ToUpper functions, respectively.
+
+Additional functions may be made available to function-based filters by
+calling RegisterPathFunc.
+
+In place of a quoted 'val', the basic and function-based value filters may
+reference a variable, as in [@attrib=$name]. The values of variables are
+supplied when the path is evaluated, using an Element's FindElementPathVars
+or FindElementsPathVars method. A filter referencing a variable whose value
+isn't supplied matches no elements.
+
+A filter applied to a selector is evaluated separately for each element
+from which the selector is applied. For example, //author[1] selects the
+first author child of every element having author children. To apply
+filters to the combined results of a path instead, enclose the path in
+parentheses at the start of the path string. For example, (//author)[1]
+selects only the first of all author elements found by //author. The
+parenthesized group may be followed by filters and by additional path
+segments, as in (//book)[2]/title.
+
+A path may end with a node test instead of a selector, in which case it
+selects tokens rather than elements. A node test selects the child tokens of
+each element selected by the rest of the path. Paths ending with node tests
+are evaluated with an Element's FindTokens or FindTokensPath method; the
+element-returning Find* methods find nothing when given such a path. The
+following node tests are supported:
+
+	comment()                         Select comments.
+	processing-instruction()          Select processing instructions.
+	processing-instruction('target')  Select processing instructions with the target.
+	text()                            Select character data.
+	node()                            Select tokens of any kind.
+
+For example, //comment() selects every comment in a document, and
+/processing-instruction('xml-stylesheet') selects the document's top-level
+xml-stylesheet processing instructions. An Element's FindCharData method
+returns the character data selected by a path ending with text(), such as
+//title/text(), as CharData tokens that may be edited in place.
+
+Whitespace, including newlines, may be used to format a path string for
+readability. Whitespace at the start or end of a path, or next to any of the
+characters / [ ] ( ) = ~ , | ! @ $ : < or >, is ignored. Whitespace within a
+quoted value is preserved exactly, as is whitespace separating two names.
+For example, the following path is equivalent to //book[@lang='en']/title:
+
+	//book[ @lang = 'en' ]
+	    /title
+
 Below are some examples of etree path strings.
 
 Select the bookstore child element of the root element:
@@ -89,6 +224,8 @@ belonging to the http://www.w3.org/TR/html4/ namespace:
 */
 type Path struct {
 	segments []segment
+	test     func(t Token) bool // node test selecting the path's final tokens
+	testExpr string             // source text of the node test
 }
 
 // ErrPath is returned by path functions when an invalid etree path is provided.
@@ -103,11 +240,76 @@ func (err ErrPath) Error() string {
 // can be used to query elements in an element tree.
 func CompilePath(path string) (Path, error) {
 	var comp compiler
+	path = trimPathSpace(path)
+	pieces := splitPath(path)
+	testExpr := pieces[len(pieces)-1]
+	test := comp.parseNodeTest(testExpr)
+	if test != nil {
+		// The node test applies to the children of the elements selected
+		// by the rest of the path.
+		path = path[:len(path)-len(testExpr)]
+		switch path {
+		case "":
+			return Path{test: test, testExpr: testExpr}, nil
+		case "/":
+			root := segment{sel: new(selectRoot), filters: []filter{}}
+			return Path{segments: []segment{root}, test: test, testExpr: testExpr}, nil
+		}
+		path = path[:len(path)-1]
+	} else {
+		testExpr = ""
+	}
+	if comp.err != ErrPath("") {
+		return Path{}, comp.err
+	}
+
 	segments := comp.parsePath(path)
 	if comp.err != ErrPath("") {
-		return Path{nil}, comp.err
+		return Path{}, comp.err
 	}
-	return Path{segments}, nil
+	return Path{segments: segments, test: test, testExpr: testExpr}, nil
+}
+
+// pathDelims holds the characters next to which whitespace in a path
+// string is insignificant.
+const pathDelims = "/[]()=~,|!@$:<>"
+
+// trimPathSpace returns the path string with its insignificant whitespace
+// removed. Whitespace within quoted values, or between two characters
+// that aren't delimiters, is retained.
+func trimPathSpace(path string) string {
+	if !strings.ContainsAny(path, whitespace) {
+		return path
+	}
+
+	isSpace := func(c byte) bool { return strings.IndexByte(whitespace, c) >= 0 }
+	isDelim := func(c byte) bool { return strings.IndexByte(pathDelims, c) >= 0 }
+
+	b := make([]byte, 0, len(path))
+	var quote byte
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case isSpace(c):
+			j := i + 1
+			for j < len(path) && isSpace(path[j]) {
+				j++
+			}
+			if len(b) > 0 && j < len(path) && !isDelim(b[len(b)-1]) && !isDelim(path[j]) {
+				b = append(b, path[i:j]...)
+			}
+			i = j - 1
+			continue
+		}
+		b = append(b, c)
+	}
+	return string(b)
 }
 
 // MustCompilePath creates an optimized version of an XPath-like string that
@@ -122,11 +324,277 @@ func MustCompilePath(path string) Path {
 	return p
 }
 
+// WithMaxDepth returns a copy of the path in which every descendant selector
+// is limited to elements at most 'depth' levels below the element from which
+// it is evaluated. For example, the path .//item limited to depth 2 selects
+// item elements that are children or grandchildren of the current element,
+// and descendant-or-self::item limited to depth 2 also selects the current
+// element itself if it is named item. Paths within filters are not limited.
+// If 'depth' is zero or negative, the limit is removed.
+func (path Path) WithMaxDepth(depth int) Path {
+	path.segments = limitSegments(path.segments, max(depth, 0))
+	return path
+}
+
+// limitSegments returns a copy of the segments with the descendant
+// selectors limited to the specified depth.
+func limitSegments(segments []segment, depth int) []segment {
+	out := make([]segment, len(segments))
+	for i, seg := range segments {
+		switch sel := seg.sel.(type) {
+		case *selectDescendants:
+			seg.sel = &selectDescendants{maxDepth: depth}
+		case *selectDescendantsOrSelf:
+			seg.sel = &selectDescendantsOrSelf{space: sel.space, tag: sel.tag, maxDepth: depth}
+		case *selectGroup:
+			seg.sel = newSelectGroup(sel.path.WithMaxDepth(depth))
+		}
+		out[i] = seg
+	}
+	return out
+}
+
+// SegmentInfo describes a segment of a compiled path, as reported by
+// Path.Describe. Each segment consists of a selector followed by zero or
+// more filters.
+type SegmentInfo struct {
+	// Selector identifies the kind of the segment's selector. It is one of
+	// "root" (/), "self" (.), "parent" (..), "children" (*), "descendants"
+	// (//), "tag" (tag), "descendant-or-self" (descendant-or-self::tag),
+	// "group" ((path)) or "node-test" (a final node test such as comment()).
+	Selector string
+
+	// Name holds the tag selected by a "tag" or "descendant-or-self"
+	// selector, or the source text of a "node-test" selector.
+	Name string
+
+	// Group holds the segments of a "group" selector's parenthesized path.
+	Group []SegmentInfo
+
+	// Filters describes the segment's filters, in the order they are
+	// applied.
+	Filters []FilterInfo
+}
+
+// FilterInfo describes a filter of a compiled path segment, as reported by
+// Path.Describe.
+type FilterInfo struct {
+	// Kind identifies the kind of the filter. It is one of "position",
+	// "attr", "attr-value", "attr-regexp", "child", "child-value",
+	// "child-regexp", "func", "func-value", "func-regexp", "path",
+	// "path-value", "path-regexp", "not" or "variable".
+	Kind string
+
+	// Expr holds the source text of the filter, without its brackets.
+	Expr string
+}
+
+// Describe returns a description of the structure of the compiled path,
+// listing its segments along with their selectors and filters.
+func (path Path) Describe() []SegmentInfo {
+	info := describeSegments(path.segments)
+	if path.test != nil {
+		info = append(info, SegmentInfo{Selector: "node-test", Name: path.testExpr})
+	}
+	return info
+}
+
+// describeSegments returns descriptions of the path segments.
+func describeSegments(segments []segment) []SegmentInfo {
+	info := make([]SegmentInfo, len(segments))
+	for i, seg := range segments {
+		switch sel := seg.sel.(type) {
+		case *selectRoot:
+			info[i].Selector = "root"
+		case *selectSelf:
+			info[i].Selector = "self"
+		case *selectParent:
+			info[i].Selector = "parent"
+		case *selectChildren:
+			info[i].Selector = "children"
+		case *selectDescendants:
+			info[i].Selector = "descendants"
+		case *selectChildrenByTag:
+			info[i].Selector, info[i].Name = "tag", spaceCompose(sel.space, sel.tag)
+		case *selectDescendantsOrSelf:
+			info[i].Selector, info[i].Name = "descendant-or-self", spaceCompose(sel.space, sel.tag)
+		case *selectGroup:
+			info[i].Selector, info[i].Group = "group", describeSegments(sel.path.segments)
+		}
+		for j, f := range seg.filters {
+			fi := FilterInfo{Kind: filterKind(f)}
+			if j < len(seg.exprs) {
+				fi.Expr = seg.exprs[j]
+			}
+			info[i].Filters = append(info[i].Filters, fi)
+		}
+	}
+	return info
+}
+
+// filterKind returns the name describing the kind of a filter.
+func filterKind(f filter) string {
+	switch f.(type) {
+	case *filterPos:
+		return "position"
+	case *filterAttr:
+		return "attr"
+	case *filterAttrVal:
+		return "attr-value"
+	case *filterAttrRegexp:
+		return "attr-regexp"
+	case *filterChild:
+		return "child"
+	case *filterChildText:
+		return "child-value"
+	case *filterChildRegexp:
+		return "child-regexp"
+	case *filterFunc:
+		return "func"
+	case *filterFuncVal:
+		return "func-value"
+	case *filterFuncRegexp:
+		return "func-regexp"
+	case *filterPath:
+		return "path"
+	case *filterPathVal:
+		return "path-value"
+	case *filterPathRegexp:
+		return "path-regexp"
+	case *filterNot:
+		return "not"
+	case *filterLogic:
+		if f.(*filterLogic).or {
+			return "or"
+		}
+		return "and"
+	case *filterVar:
+		return "variable"
+	default:
+		return ""
+	}
+}
+
+// pathCacheSize is the maximum number of compiled paths retained by the
+// path cache.
+const pathCacheSize = 256
+
+// A pathCache is a concurrency-safe, least-recently-used cache of compiled
+// paths, keyed by path string. It allows the string-based Find* functions to
+// skip recompiling paths they have seen recently.
+type pathCache struct {
+	mu    sync.Mutex
+	size  int
+	lru   list.List // of *pathCacheEntry, most recently used first
+	index map[string]*list.Element
+	gen   uint64 // incremented whenever the cache is cleared
+}
+
+type pathCacheEntry struct {
+	key  string
+	path Path
+}
+
+var compiledPaths = pathCache{size: pathCacheSize}
+
+// get returns the cached compiled path for the path string, if present,
+// along with the cache's current generation, which must be passed to put
+// when adding a path compiled after a cache miss.
+func (c *pathCache) get(key string) (Path, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if le, ok := c.index[key]; ok {
+		c.lru.MoveToFront(le)
+		return le.Value.(*pathCacheEntry).path, c.gen, true
+	}
+	return Path{}, c.gen, false
+}
+
+// put adds a compiled path to the cache, evicting the least recently used
+// path if the cache is full. The path is discarded if the cache has been
+// cleared since generation 'gen', since it may have been compiled against
+// path functions that have since been redefined.
+func (c *pathCache) put(key string, path Path, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if c.index == nil {
+		c.index = make(map[string]*list.Element)
+	}
+	if le, ok := c.index[key]; ok {
+		le.Value.(*pathCacheEntry).path = path
+		c.lru.MoveToFront(le)
+		return
+	}
+	c.index[key] = c.lru.PushFront(&pathCacheEntry{key, path})
+	if c.lru.Len() > c.size {
+		le := c.lru.Back()
+		c.lru.Remove(le)
+		delete(c.index, le.Value.(*pathCacheEntry).key)
+	}
+}
+
+// clear removes all paths from the cache.
+func (c *pathCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	clear(c.index)
+	c.gen++
+}
+
+// mustCompileCachedPath behaves like MustCompilePath, but it reuses a
+// previously compiled path from the path cache when one is available.
+func mustCompileCachedPath(path string) Path {
+	p, gen, ok := compiledPaths.get(path)
+	if ok {
+		return p
+	}
+	p = MustCompilePath(path)
+	compiledPaths.put(path, p, gen)
+	return p
+}
+
+// parseNodeTest parses a node test appearing as the final segment of a
+// path, such as comment() or processing-instruction('target'), and returns
+// a function reporting whether a token passes the test. It returns nil if
+// the segment isn't a node test.
+func (c *compiler) parseNodeTest(path string) func(t Token) bool {
+	switch path {
+	case "node()":
+		return func(t Token) bool { return true }
+	case "text()":
+		return func(t Token) bool { _, ok := t.(*CharData); return ok }
+	case "comment()":
+		return func(t Token) bool { _, ok := t.(*Comment); return ok }
+	case "processing-instruction()":
+		return func(t Token) bool { _, ok := t.(*ProcInst); return ok }
+	}
+
+	target, ok := strings.CutPrefix(path, "processing-instruction(")
+	if !ok || !strings.HasSuffix(target, ")") {
+		return nil
+	}
+	target = target[:len(target)-1]
+	if len(target) < 2 || (target[0] != '\'' && target[0] != '"') || target[len(target)-1] != target[0] {
+		c.err = ErrPath("path has invalid node test " + path)
+		return nil
+	}
+	target = target[1 : len(target)-1]
+	return func(t Token) bool {
+		p, ok := t.(*ProcInst)
+		return ok && p.Target == target
+	}
+}
+
 // A segment is a portion of a path between "/" characters.
 // It contains one selector and zero or more [filters].
 type segment struct {
 	sel     selector
 	filters []filter
+	exprs   []string // source text of each filter, without brackets
 }
 
 func (seg *segment) apply(e *Element, p *pather) {
@@ -156,7 +624,8 @@ type pather struct {
 	results    []*Element
 	inResults  map[*Element]bool
 	candidates []*Element
-	scratch    []*Element // used by filters
+	scratch    []*Element        // used by filters
+	vars       map[string]string // values of $variables
 }
 
 // A node represents an element and the remaining path segments that
@@ -179,12 +648,131 @@ func newPather() *pather {
 // and then returning all elements that match the path's selectors
 // and filters.
 func (p *pather) traverse(e *Element, path Path) []*Element {
+	if path.test != nil {
+		return p.results
+	}
 	for p.queue.add(node{e, path.segments}); p.queue.len() > 0; {
 		p.eval(p.queue.remove())
 	}
 	return p.results
 }
 
+// match returns true if the element e is selected by the path when the path
+// is evaluated from e or from any of its ancestors. Rather than traversing
+// the whole tree once per ancestor, it evaluates every ancestor at the same
+// time and, whenever the remaining segments can only descend the tree, it
+// keeps only those candidates lying on the chain of ancestors leading to e.
+func (p *pather) match(e *Element, path Path) bool {
+	if path.test != nil {
+		return false
+	}
+
+	// descends[i] is true if segments i and beyond select only the
+	// current element or its descendants.
+	n := len(path.segments)
+	descends := make([]bool, n+1)
+	descends[n] = true
+	for i := n - 1; i >= 0; i-- {
+		descends[i] = descends[i+1] && isDescendingSelector(path.segments[i].sel)
+	}
+
+	chain := make(map[*Element]bool)
+	for a := e; a != nil; a = a.parent {
+		chain[a] = true
+	}
+
+	type step struct {
+		e *Element
+		i int
+	}
+	var queue queue[step]
+	seen := make(map[step]bool)
+	for a := e; a != nil; a = a.parent {
+		queue.add(step{a, 0})
+	}
+	for queue.len() > 0 {
+		s := queue.remove()
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+
+		seg := &path.segments[s.i]
+		p.candidates = p.candidates[0:0]
+		if len(seg.filters) > 0 || !descends[s.i+1] || !p.selectChain(s.e, e, seg.sel) {
+			seg.apply(s.e, p)
+		}
+
+		last := s.i+1 == n
+		for _, c := range p.candidates {
+			switch {
+			case last && c == e:
+				return true
+			case !last && (!descends[s.i+1] || chain[c]):
+				queue.add(step{c, s.i + 1})
+			}
+		}
+	}
+	return false
+}
+
+// selectChain selects into the candidate list the elements on the chain of
+// ancestors from 'from' down to 'to' that the descendant selector 'sel'
+// would select from 'from'. It returns false if 'sel' is not a descendant
+// selector, in which case nothing is selected.
+func (p *pather) selectChain(from, to *Element, sel selector) bool {
+	maxDepth := -1 // no limit
+	var match func(e *Element) bool
+	switch s := sel.(type) {
+	case *selectDescendants:
+		if s.maxDepth > 0 {
+			maxDepth = s.maxDepth - 1
+		}
+		match = func(e *Element) bool { return true }
+	case *selectDescendantsOrSelf:
+		if s.maxDepth > 0 {
+			maxDepth = s.maxDepth
+		}
+		match = func(e *Element) bool {
+			return s.tag == "*" || (spaceMatch(s.space, e.Space) && s.tag == e.Tag)
+		}
+	default:
+		return false
+	}
+
+	start := len(p.candidates)
+	for a := to; a != nil; a = a.parent {
+		p.candidates = append(p.candidates, a)
+		if a == from {
+			// Discard the elements deeper than the selector's maximum depth.
+			chain := p.candidates[start:]
+			if maxDepth >= 0 && len(chain) > maxDepth+1 {
+				chain = chain[len(chain)-maxDepth-1:]
+			}
+			p.candidates = p.candidates[:start]
+			for _, c := range chain {
+				if match(c) {
+					p.candidates = append(p.candidates, c)
+				}
+			}
+			return true
+		}
+	}
+	p.candidates = p.candidates[:start]
+	return true
+}
+
+// isDescendingSelector returns true if the selector selects only the
+// current element or its descendants.
+func isDescendingSelector(sel selector) bool {
+	switch sel.(type) {
+	case *selectSelf, *selectChildren, *selectChildrenByTag,
+		*selectDescendants, *selectDescendantsOrSelf:
+		return true
+	}
+	return false
+}
+
 // eval evaluates the current path node by applying the remaining
 // path's selector rules against the node's element.
 func (p *pather) eval(n node) {
@@ -222,14 +810,52 @@ func (c *compiler) parsePath(path string) []segment {
 
 	var segments []segment
 
+	// Check for a parenthesized group at the start of the path
+	if strings.HasPrefix(path, "(") {
+		end := findGroupEnd(path)
+		if end < 0 {
+			c.err = ErrPath("path has mismatched group (parentheses).")
+			return nil
+		}
+		group := c.parsePath(path[1:end])
+		if c.err != ErrPath("") {
+			return nil
+		}
+
+		// The group is followed by zero or more filters and then by the
+		// remaining path segments.
+		pieces := splitPath(path[end+1:])
+		if pieces[0] != "" && pieces[0][0] != '[' {
+			c.err = ErrPath("path has invalid group (parentheses).")
+			return nil
+		}
+		filters, exprs := c.parseFilters(pieces[0])
+		seg := segment{
+			sel:     newSelectGroup(Path{segments: group}),
+			filters: filters,
+			exprs:   exprs,
+		}
+		segments = append(segments, seg)
+		if c.err != ErrPath("") || len(pieces) == 1 {
+			return segments
+		}
+		return append(segments, c.parseSegments(pieces[1:])...)
+	}
+
 	// Check for an absolute path
 	if strings.HasPrefix(path, "/") {
-		segments = append(segments, segment{new(selectRoot), []filter{}})
+		segments = append(segments, segment{sel: new(selectRoot), filters: []filter{}})
 		path = path[1:]
 	}
 
 	// Split path into segments
-	for _, s := range splitPath(path) {
+	return append(segments, c.parseSegments(splitPath(path))...)
+}
+
+// parseSegments parses a series of path segments.
+func (c *compiler) parseSegments(pieces []string) []segment {
+	var segments []segment
+	for _, s := range pieces {
 		segments = append(segments, c.parseSegment(s))
 		if c.err != ErrPath("") {
 			break
@@ -238,42 +864,228 @@ func (c *compiler) parsePath(path string) []segment {
 	return segments
 }
 
+// findGroupEnd returns the index of the parenthesis closing the group that
+// begins at the start of the path. It returns -1 if the group isn't closed.
+func findGroupEnd(path string) int {
+	depth := 0
+	inquote := false
+	var quote byte
+	for i := 0; i < len(path); i++ {
+		if inquote {
+			if path[i] == quote {
+				inquote = false
+			}
+			continue
+		}
+		switch path[i] {
+		case '\'', '"':
+			inquote, quote = true, path[i]
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitPath splits the path at each '/' character that doesn't appear
+// within a quoted string or a bracketed filter.
 func splitPath(path string) []string {
 	var pieces []string
 	start := 0
+	depth := 0
 	inquote := false
 	var quote byte
-	for i := 0; i+1 <= len(path); i++ {
-		if !inquote {
-			if path[i] == '\'' || path[i] == '"' {
-				inquote, quote = true, path[i]
-			} else if path[i] == '/' {
+	for i := 0; i < len(path); i++ {
+		if inquote {
+			if path[i] == quote {
+				inquote = false
+			}
+			continue
+		}
+		switch path[i] {
+		case '\'', '"':
+			inquote, quote = true, path[i]
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '/':
+			if depth == 0 {
 				pieces = append(pieces, path[start:i])
 				start = i + 1
 			}
-		} else if path[i] == quote {
-			inquote = false
 		}
 	}
 	return append(pieces, path[start:])
 }
 
+// indexUnnested returns the index of the first character in the path
+// matching one of the characters in 'chars' that doesn't appear within a
+// quoted string or a bracketed filter. It returns -1 if there is no such
+// character.
+func indexUnnested(path, chars string) int {
+	depth := 0
+	inquote := false
+	var quote byte
+	for i := 0; i < len(path); i++ {
+		if inquote {
+			if path[i] == quote {
+				inquote = false
+			}
+			continue
+		}
+		switch path[i] {
+		case '\'', '"':
+			inquote, quote = true, path[i]
+		case '[':
+			depth++
+		case ']':
+			depth--
+		default:
+			if depth == 0 && strings.IndexByte(chars, path[i]) >= 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitFilterOp splits a filter expression into the operands of the
+// logical operator 'op', such as "or", found outside of any quotes,
+// brackets or parentheses. It returns nil if the expression doesn't contain
+// the operator. An operator must be separated from its operands by
+// whitespace, unless an operand begins or ends with a delimiter.
+func splitFilterOp(path, op string) []string {
+	var operands []string
+	depth, last := 0, 0
+	var quote byte
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case depth == 0 && i > 0 && strings.HasPrefix(path[i:], op):
+			prev, end := path[i-1], i+len(op)
+			var next byte = ' '
+			if end < len(path) {
+				next = path[end]
+			}
+			if (isSpaceByte(prev) || strings.IndexByte(")]'\"", prev) >= 0) &&
+				(isSpaceByte(next) || strings.IndexByte(pathDelims, next) >= 0 || next == '\'' || next == '"' || next == '.') {
+				operands = append(operands, strings.TrimSpace(path[last:i]))
+				last = end
+				i = end - 1
+			}
+		}
+	}
+	if operands == nil {
+		return nil
+	}
+	return append(operands, strings.TrimSpace(path[last:]))
+}
+
+// findParenEnd returns the index of the ')' character closing the '('
+// character at the start of the path, ignoring parentheses within quotes.
+// It returns -1 if the parenthesis isn't closed.
+func findParenEnd(path string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// findFilterEnd returns the index of the ']' character closing the filter
+// that begins with the '[' character at the start of the path, along with a
+// boolean indicating whether a quoted string was left unterminated. It
+// returns -1 if the filter isn't closed.
+func findFilterEnd(path string) (end int, inquote bool) {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(path); i++ {
+		if inquote {
+			if path[i] == quote {
+				inquote = false
+			}
+			continue
+		}
+		switch path[i] {
+		case '\'', '"':
+			inquote, quote = true, path[i]
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				return i, false
+			}
+		}
+	}
+	return -1, inquote
+}
+
 // parseSegment parses a path segment between / characters.
 func (c *compiler) parseSegment(path string) segment {
-	pieces := strings.Split(path, "[")
-	seg := segment{
-		sel:     c.parseSelector(pieces[0]),
-		filters: []filter{},
-	}
-	for i := 1; i < len(pieces); i++ {
-		fpath := pieces[i]
-		if len(fpath) == 0 || fpath[len(fpath)-1] != ']' {
+	sel, filters := path, ""
+	if i := strings.IndexByte(path, '['); i >= 0 {
+		sel, filters = path[:i], path[i:]
+	}
+
+	// A segment consisting only of filters, as in //[@attr], selects all
+	// child elements, as if the * selector preceded the filters.
+	if sel == "" && filters != "" {
+		sel = "*"
+	}
+	seg := segment{sel: c.parseSelector(sel)}
+	seg.filters, seg.exprs = c.parseFilters(filters)
+	return seg
+}
+
+// parseFilters parses a series of [bracketed] filters. It returns the
+// filters along with the source text of each.
+func (c *compiler) parseFilters(path string) (filters []filter, exprs []string) {
+	filters = []filter{}
+	for path != "" {
+		end, inquote := findFilterEnd(path)
+		switch {
+		case path[0] != '[' || (end < 0 && !inquote):
 			c.err = ErrPath("path has invalid filter [brackets].")
-			break
+			return filters, exprs
+		case end < 0:
+			c.err = ErrPath("path has mismatched filter quotes.")
+			return filters, exprs
 		}
-		seg.filters = append(seg.filters, c.parseFilter(fpath[:len(fpath)-1]))
+		filters = append(filters, c.parseFilter(path[1:end]))
+		exprs = append(exprs, path[1:end])
+		path = path[end+1:]
 	}
-	return seg
+	return filters, exprs
 }
 
 // parseSelector parses a selector at the start of a path segment.
@@ -287,19 +1099,130 @@ func (c *compiler) parseSelector(path string) selector {
 		return new(selectChildren)
 	case "":
 		return new(selectDescendants)
-	default:
-		return newSelectChildrenByTag(path)
 	}
+	if tag, ok := strings.CutPrefix(path, "descendant-or-self::"); ok {
+		return newSelectDescendantsOrSelf(tag)
+	}
+	return newSelectChildrenByTag(path)
 }
 
 var fnTable = map[string]func(e *Element) string{
 	"local-name":       (*Element).name,
 	"name":             (*Element).FullTag,
-	"namespace-prefix": (*Element).namespacePrefix,
+	"namespace-prefix": (*Element).Prefix,
 	"namespace-uri":    (*Element).NamespaceURI,
 	"text":             (*Element).Text,
 }
 
+var wrapFnTable = map[string]func(s string) string{
+	"lower-case": strings.ToLower,
+	"upper-case": strings.ToUpper,
+}
+
+var (
+	userFnTable = make(map[string]func(e *Element) string)
+	userFnMutex sync.RWMutex
+)
+
+// RegisterPathFunc registers a custom function that may be called from
+// function-based path filters, such as [name()] or [name()='val']. When a
+// path filter is applied, the function 'fn' is called with each candidate
+// element, and its result is treated like the result of the built-in text()
+// function. If 'fn' is nil, the function named 'name' is unregistered.
+//
+// Registered functions are global and are resolved when a path is compiled.
+// RegisterPathFunc returns an error if 'name' is the name of a built-in path
+// function or contains characters not allowed in a function name.
+func RegisterPathFunc(name string, fn func(e *Element) string) error {
+	if name == "" || strings.ContainsAny(name, "()[]/@='\" \t\r\n") {
+		return ErrPath("invalid path function name " + name)
+	}
+	if _, ok := fnTable[name]; ok || isBuiltinWrapFunc(name) {
+		return ErrPath("cannot redefine built-in path function " + name)
+	}
+
+	userFnMutex.Lock()
+	defer userFnMutex.Unlock()
+
+	// Compiled paths capture the functions they call, so discard any that
+	// may refer to a previous definition. Clearing the cache also prevents
+	// paths being compiled concurrently from being added to it.
+	compiledPaths.clear()
+
+	if fn == nil {
+		delete(userFnTable, name)
+	} else {
+		userFnTable[name] = fn
+	}
+	return nil
+}
+
+// isBuiltinWrapFunc returns true if name is a built-in function that takes
+// an argument.
+func isBuiltinWrapFunc(name string) bool {
+	_, ok := wrapFnTable[name]
+	return ok || name == "not"
+}
+
+// lookupFunc returns the built-in or registered function with the requested
+// name.
+func lookupFunc(name string) (func(e *Element) string, bool) {
+	if fn, ok := fnTable[name]; ok {
+		return fn, true
+	}
+	userFnMutex.RLock()
+	defer userFnMutex.RUnlock()
+	fn, ok := userFnTable[name]
+	return fn, ok
+}
+
+// parseFunc parses a function call expression such as fn() or
+// wrapfn(@attr) and returns a function that evaluates it against an element.
+func (c *compiler) parseFunc(path string) func(e *Element) string {
+	open := strings.IndexByte(path, '(')
+	if open < 0 || path[len(path)-1] != ')' {
+		c.err = ErrPath("path has invalid function call " + path)
+		return nil
+	}
+
+	name, arg := path[:open], path[open+1:len(path)-1]
+	if arg == "" {
+		if fn, ok := lookupFunc(name); ok {
+			return fn
+		}
+		c.err = ErrPath("path has unknown function " + name)
+		return nil
+	}
+
+	wrap, ok := wrapFnTable[name]
+	if !ok {
+		c.err = ErrPath("path has unknown function " + name)
+		return nil
+	}
+
+	var inner func(e *Element) string
+	switch {
+	case arg[0] == '@':
+		space, key := spaceDecompose(arg[1:])
+		inner = func(e *Element) string {
+			for _, a := range e.Attr {
+				if attrMatch(space, key, &a) {
+					return a.Value
+				}
+			}
+			return ""
+		}
+	case strings.HasSuffix(arg, ")"):
+		if inner = c.parseFunc(arg); inner == nil {
+			return nil
+		}
+	default:
+		c.err = ErrPath("path has invalid function argument " + arg)
+		return nil
+	}
+	return func(e *Element) string { return wrap(inner(e)) }
+}
+
 // parseFilter parses a path filter contained within [brackets].
 func (c *compiler) parseFilter(path string) filter {
 	if len(path) == 0 {
@@ -307,9 +1230,43 @@ func (c *compiler) parseFilter(path string) filter {
 		return nil
 	}
 
+	// Filter contains [filter or filter] or [filter and filter]?
+	for _, op := range []string{"or", "and"} {
+		if operands := splitFilterOp(path, op); operands != nil {
+			filters := make([]filter, len(operands))
+			for i, operand := range operands {
+				if filters[i] = c.parseFilter(operand); filters[i] == nil {
+					return nil
+				}
+			}
+			return newFilterLogic(op == "or", filters)
+		}
+	}
+
+	// Filter contains [(filter)]?
+	if path[0] == '(' && findParenEnd(path) == len(path)-1 {
+		return c.parseFilter(path[1 : len(path)-1])
+	}
+
+	// Filter contains [not(filter)]?
+	if strings.HasPrefix(path, "not(") && findParenEnd(path[3:]) == len(path)-4 {
+		if inner := c.parseFilter(path[4 : len(path)-1]); inner != nil {
+			return newFilterNot(inner)
+		}
+		return nil
+	}
+
+	// Filter contains [@attr~'re'], [fn()~'re'], [.~'re'], [tag~'re'] or
+	// [path~'re'], or their anchored ~= forms?
+	opindex := indexUnnested(path, "=~")
+	if opindex >= 0 && path[opindex] == '~' {
+		return c.parseRegexpFilter(path[:opindex], path[opindex+1:])
+	}
+
 	// Filter contains [@attr='val'], [@attr="val"], [fn()='val'],
-	// [fn()="val"], [tag='val'] or [tag="val"]?
-	eqindex := strings.IndexByte(path, '=')
+	// [fn()="val"], [.='val'], [.="val"], [tag='val'], [tag="val"],
+	// [path='val'] or [path="val"]?
+	eqindex := opindex
 	if eqindex >= 0 && eqindex+1 < len(path) {
 		quote := path[eqindex+1]
 		if quote == '\'' || quote == '"' {
@@ -319,49 +1276,150 @@ func (c *compiler) parseFilter(path string) filter {
 				return nil
 			}
 
-			key := path[:eqindex]
 			value := path[eqindex+2 : rindex]
+			if newFilter := c.parseValueFilter(path[:eqindex]); newFilter != nil {
+				return newFilter(value)
+			}
+			return nil
+		}
 
-			switch {
-			case key[0] == '@':
-				return newFilterAttrVal(key[1:], value)
-			case strings.HasSuffix(key, "()"):
-				name := key[:len(key)-2]
-				if fn, ok := fnTable[name]; ok {
-					return newFilterFuncVal(fn, value)
-				}
-				c.err = ErrPath("path has unknown function " + name)
+		// Filter contains [@attr=$var], [fn()=$var], [.=$var], [tag=$var] or
+		// [path=$var]?
+		if quote == '$' {
+			name := path[eqindex+2:]
+			if !isVarName(name) {
+				c.err = ErrPath("path has invalid variable name $" + name)
 				return nil
-			default:
-				return newFilterChildText(key, value)
 			}
+			if newFilter := c.parseValueFilter(path[:eqindex]); newFilter != nil {
+				return newFilterVar(name, newFilter)
+			}
+			return nil
 		}
 	}
 
-	// Filter contains [@attr], [N], [tag] or [fn()]
+	// Filter contains [@attr], [N], [tag], [path] or [fn()]
 	switch {
 	case path[0] == '@':
 		return newFilterAttr(path[1:])
-	case strings.HasSuffix(path, "()"):
-		name := path[:len(path)-2]
-		if fn, ok := fnTable[name]; ok {
+	case strings.IndexByte(path, '/') >= 0:
+		if sub := c.parseSubPath(path); sub != nil {
+			return newFilterPath(*sub)
+		}
+		return nil
+	case strings.HasSuffix(path, ")"):
+		if fn := c.parseFunc(path); fn != nil {
 			return newFilterFunc(fn)
 		}
-		c.err = ErrPath("path has unknown function " + name)
 		return nil
 	case isInteger(path):
 		pos, _ := strconv.Atoi(path)
-		switch {
-		case pos > 0:
-			return newFilterPos(pos - 1)
-		default:
-			return newFilterPos(pos)
-		}
+		return newFilterPos(pos)
 	default:
 		return newFilterChild(path)
 	}
 }
 
+// parseValueFilter parses the key of a value-comparison filter, such as the
+// @attr in [@attr='val'], and returns a function that creates the filter
+// for a requested value.
+func (c *compiler) parseValueFilter(key string) func(value string) filter {
+	switch {
+	case key == "":
+		c.err = ErrPath("path has invalid filter expression.")
+		return nil
+	case key[0] == '@':
+		return func(value string) filter {
+			return newFilterAttrVal(key[1:], value)
+		}
+	case key == ".":
+		return func(value string) filter {
+			return newFilterFuncVal((*Element).Text, value)
+		}
+	case strings.IndexByte(key, '/') >= 0:
+		sub := c.parseSubPath(key)
+		if sub == nil {
+			return nil
+		}
+		return func(value string) filter {
+			return newFilterPathVal(*sub, value)
+		}
+	case strings.HasSuffix(key, ")"):
+		fn := c.parseFunc(key)
+		if fn == nil {
+			return nil
+		}
+		return func(value string) filter {
+			return newFilterFuncVal(fn, value)
+		}
+	default:
+		return func(value string) filter {
+			return newFilterChildText(key, value)
+		}
+	}
+}
+
+// parseSubPath parses a path appearing within a filter, such as the path
+// .//author in the filter [.//author='Kurt Cagle'].
+func (c *compiler) parseSubPath(path string) *Path {
+	segments := c.parsePath(path)
+	if c.err != ErrPath("") {
+		return nil
+	}
+	return &Path{segments: segments}
+}
+
+// parseRegexpFilter parses a regular expression filter of the form
+// key~'re' or key~='re', where 'op' holds the portion of the filter
+// following the ~ character.
+func (c *compiler) parseRegexpFilter(key, op string) filter {
+	anchored := strings.HasPrefix(op, "=")
+	if anchored {
+		op = op[1:]
+	}
+	if len(op) < 2 || (op[0] != '\'' && op[0] != '"') {
+		c.err = ErrPath("path has invalid filter expression.")
+		return nil
+	}
+	if nextIndex(op, op[0], 1) != len(op)-1 {
+		c.err = ErrPath("path has mismatched filter quotes.")
+		return nil
+	}
+
+	expr := op[1 : len(op)-1]
+	if anchored {
+		expr = `^(?:` + expr + `)$`
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		c.err = ErrPath("path has invalid regular expression " + op + ": " + err.Error())
+		return nil
+	}
+
+	switch {
+	case key == "":
+		c.err = ErrPath("path has invalid filter expression.")
+		return nil
+	case key[0] == '@':
+		return newFilterAttrRegexp(key[1:], re)
+	case key == ".":
+		return newFilterFuncRegexp((*Element).Text, re)
+	case strings.IndexByte(key, '/') >= 0:
+		if sub := c.parseSubPath(key); sub != nil {
+			return newFilterPathRegexp(*sub, re)
+		}
+		return nil
+	case strings.HasSuffix(key, ")"):
+		fn := c.parseFunc(key)
+		if fn == nil {
+			return nil
+		}
+		return newFilterFuncRegexp(fn, re)
+	default:
+		return newFilterChildRegexp(key, re)
+	}
+}
+
 // selectSelf selects the current element into the candidate list.
 type selectSelf struct{}
 
@@ -373,11 +1431,7 @@ func (s *selectSelf) apply(e *Element, p *pather) {
 type selectRoot struct{}
 
 func (s *selectRoot) apply(e *Element, p *pather) {
-	root := e
-	for root.parent != nil {
-		root = root.parent
-	}
-	p.candidates = append(p.candidates, root)
+	p.candidates = append(p.candidates, e.Root())
 }
 
 // selectParent selects the element's parent into the candidate list.
@@ -401,23 +1455,87 @@ func (s *selectChildren) apply(e *Element, p *pather) {
 	}
 }
 
-// selectDescendants selects all descendant child elements
-// of the element into the candidate list.
-type selectDescendants struct{}
+// selectDescendants selects the element and all of its descendant
+// elements into the candidate list. Because the element itself is
+// included, a path like //tag also finds a root element named tag, when
+// evaluated from a document. If maxDepth is positive, only descendants
+// fewer than maxDepth levels below the element are selected, so that the
+// children selected by the following segment are at most maxDepth levels
+// below it.
+type selectDescendants struct {
+	maxDepth int
+}
 
 func (s *selectDescendants) apply(e *Element, p *pather) {
 	var queue queue[*Element]
+	depth, remain := 0, 1
 	for queue.add(e); queue.len() > 0; {
 		e := queue.remove()
 		p.candidates = append(p.candidates, e)
-		for _, c := range e.Child {
-			if c, ok := c.(*Element); ok {
-				queue.add(c)
+		if s.maxDepth == 0 || depth+1 < s.maxDepth {
+			for _, c := range e.Child {
+				if c, ok := c.(*Element); ok {
+					queue.add(c)
+				}
+			}
+		}
+		if remain--; remain == 0 {
+			depth, remain = depth+1, queue.len()
+		}
+	}
+}
+
+// selectDescendantsOrSelf selects into the candidate list the element and
+// all of its descendant elements having the specified tag, or all of them
+// if the tag is "*". If maxDepth is positive, only descendants at most
+// maxDepth levels below the element are selected.
+type selectDescendantsOrSelf struct {
+	space, tag string
+	maxDepth   int
+}
+
+func newSelectDescendantsOrSelf(path string) *selectDescendantsOrSelf {
+	s, l := spaceDecompose(path)
+	return &selectDescendantsOrSelf{space: s, tag: l}
+}
+
+func (s *selectDescendantsOrSelf) apply(e *Element, p *pather) {
+	var queue queue[*Element]
+	depth, remain := 0, 1
+	for queue.add(e); queue.len() > 0; {
+		e := queue.remove()
+		if s.tag == "*" || (spaceMatch(s.space, e.Space) && s.tag == e.Tag) {
+			p.candidates = append(p.candidates, e)
+		}
+		if s.maxDepth == 0 || depth < s.maxDepth {
+			for _, c := range e.Child {
+				if c, ok := c.(*Element); ok {
+					queue.add(c)
+				}
 			}
 		}
+		if remain--; remain == 0 {
+			depth, remain = depth+1, queue.len()
+		}
 	}
 }
 
+// selectGroup selects into the candidate list all elements found by a
+// parenthesized path group.
+type selectGroup struct {
+	path Path
+}
+
+func newSelectGroup(path Path) *selectGroup {
+	return &selectGroup{path}
+}
+
+func (s *selectGroup) apply(e *Element, p *pather) {
+	sub := newPather()
+	sub.vars = p.vars
+	p.candidates = append(p.candidates, sub.traverse(e, s.path)...)
+}
+
 // selectChildrenByTag selects into the candidate list all child
 // elements of the element having the specified tag.
 type selectChildrenByTag struct {
@@ -437,10 +1555,11 @@ func (s *selectChildrenByTag) apply(e *Element, p *pather) {
 	}
 }
 
-// filterPos filters the candidate list, keeping only the
-// candidate at the specified index.
+// filterPos filters the candidate list, keeping only the candidate at the
+// specified 1-based position. Negative positions count backward from the
+// last candidate, and position 0 keeps no candidates.
 type filterPos struct {
-	index int
+	pos int
 }
 
 func newFilterPos(pos int) *filterPos {
@@ -448,18 +1567,25 @@ func newFilterPos(pos int) *filterPos {
 }
 
 func (f *filterPos) apply(p *pather) {
-	if f.index >= 0 {
-		if f.index < len(p.candidates) {
-			p.scratch = append(p.scratch, p.candidates[f.index])
+	switch {
+	case f.pos > 0:
+		if f.pos <= len(p.candidates) {
+			p.scratch = append(p.scratch, p.candidates[f.pos-1])
 		}
-	} else {
-		if -f.index <= len(p.candidates) {
-			p.scratch = append(p.scratch, p.candidates[len(p.candidates)+f.index])
+	case f.pos < 0:
+		if -f.pos <= len(p.candidates) {
+			p.scratch = append(p.scratch, p.candidates[len(p.candidates)+f.pos])
 		}
 	}
 	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
 }
 
+// attrMatch returns true if the attribute 'a' matches the namespace prefix
+// and key of an attribute filter. Either may be the wildcard "*".
+func attrMatch(space, key string, a *Attr) bool {
+	return (space == "*" || spaceMatch(space, a.Space)) && (key == "*" || key == a.Key)
+}
+
 // filterAttr filters the candidate list for elements having
 // the specified attribute.
 type filterAttr struct {
@@ -474,7 +1600,7 @@ func newFilterAttr(str string) *filterAttr {
 func (f *filterAttr) apply(p *pather) {
 	for _, c := range p.candidates {
 		for _, a := range c.Attr {
-			if spaceMatch(f.space, a.Space) && f.key == a.Key {
+			if attrMatch(f.space, f.key, &a) {
 				p.scratch = append(p.scratch, c)
 				break
 			}
@@ -497,7 +1623,7 @@ func newFilterAttrVal(str, value string) *filterAttrVal {
 func (f *filterAttrVal) apply(p *pather) {
 	for _, c := range p.candidates {
 		for _, a := range c.Attr {
-			if spaceMatch(f.space, a.Space) && f.key == a.Key && f.val == a.Value {
+			if attrMatch(f.space, f.key, &a) && f.val == a.Value {
 				p.scratch = append(p.scratch, c)
 				break
 			}
@@ -593,3 +1719,223 @@ func (f *filterChildText) apply(p *pather) {
 	}
 	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
 }
+
+// filterAttrRegexp filters the candidate list for elements having the
+// specified attribute with a value matching a regular expression.
+type filterAttrRegexp struct {
+	space, key string
+	re         *regexp.Regexp
+}
+
+func newFilterAttrRegexp(str string, re *regexp.Regexp) *filterAttrRegexp {
+	s, l := spaceDecompose(str)
+	return &filterAttrRegexp{s, l, re}
+}
+
+func (f *filterAttrRegexp) apply(p *pather) {
+	for _, c := range p.candidates {
+		for _, a := range c.Attr {
+			if attrMatch(f.space, f.key, &a) && f.re.MatchString(a.Value) {
+				p.scratch = append(p.scratch, c)
+				break
+			}
+		}
+	}
+	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
+}
+
+// filterFuncRegexp filters the candidate list for elements for which a
+// custom string function returns a value matching a regular expression.
+type filterFuncRegexp struct {
+	fn func(e *Element) string
+	re *regexp.Regexp
+}
+
+func newFilterFuncRegexp(fn func(e *Element) string, re *regexp.Regexp) *filterFuncRegexp {
+	return &filterFuncRegexp{fn, re}
+}
+
+func (f *filterFuncRegexp) apply(p *pather) {
+	for _, c := range p.candidates {
+		if f.re.MatchString(f.fn(c)) {
+			p.scratch = append(p.scratch, c)
+		}
+	}
+	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
+}
+
+// filterChildRegexp filters the candidate list for elements having a child
+// element with the specified tag and text matching a regular expression.
+type filterChildRegexp struct {
+	space, tag string
+	re         *regexp.Regexp
+}
+
+func newFilterChildRegexp(str string, re *regexp.Regexp) *filterChildRegexp {
+	s, l := spaceDecompose(str)
+	return &filterChildRegexp{s, l, re}
+}
+
+func (f *filterChildRegexp) apply(p *pather) {
+	for _, c := range p.candidates {
+		for _, cc := range c.Child {
+			if cc, ok := cc.(*Element); ok &&
+				spaceMatch(f.space, cc.Space) &&
+				f.tag == cc.Tag &&
+				f.re.MatchString(cc.Text()) {
+				p.scratch = append(p.scratch, c)
+				break
+			}
+		}
+	}
+	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
+}
+
+// filterPath filters the candidate list for elements from which a sub-path
+// selects at least one element.
+type filterPath struct {
+	path Path
+}
+
+func newFilterPath(path Path) *filterPath {
+	return &filterPath{path}
+}
+
+func (f *filterPath) apply(p *pather) {
+	for _, c := range p.candidates {
+		sub := newPather()
+		sub.vars = p.vars
+		if len(sub.traverse(c, f.path)) > 0 {
+			p.scratch = append(p.scratch, c)
+		}
+	}
+	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
+}
+
+// filterPathVal filters the candidate list for elements from which a
+// sub-path selects at least one element with the specified text.
+type filterPathVal struct {
+	path Path
+	val  string
+}
+
+func newFilterPathVal(path Path, value string) *filterPathVal {
+	return &filterPathVal{path, value}
+}
+
+func (f *filterPathVal) apply(p *pather) {
+	for _, c := range p.candidates {
+		sub := newPather()
+		sub.vars = p.vars
+		for _, e := range sub.traverse(c, f.path) {
+			if e.Text() == f.val {
+				p.scratch = append(p.scratch, c)
+				break
+			}
+		}
+	}
+	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
+}
+
+// filterPathRegexp filters the candidate list for elements from which a
+// sub-path selects at least one element with text matching a regular
+// expression.
+type filterPathRegexp struct {
+	path Path
+	re   *regexp.Regexp
+}
+
+func newFilterPathRegexp(path Path, re *regexp.Regexp) *filterPathRegexp {
+	return &filterPathRegexp{path, re}
+}
+
+func (f *filterPathRegexp) apply(p *pather) {
+	for _, c := range p.candidates {
+		sub := newPather()
+		sub.vars = p.vars
+		for _, e := range sub.traverse(c, f.path) {
+			if f.re.MatchString(e.Text()) {
+				p.scratch = append(p.scratch, c)
+				break
+			}
+		}
+	}
+	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
+}
+
+// filterNot filters the candidate list for elements that are not kept by
+// another filter.
+type filterNot struct {
+	inner filter
+}
+
+func newFilterNot(inner filter) *filterNot {
+	return &filterNot{inner}
+}
+
+func (f *filterNot) apply(p *pather) {
+	all := append([]*Element(nil), p.candidates...)
+	f.inner.apply(p)
+	kept := make(map[*Element]bool, len(p.candidates))
+	for _, c := range p.candidates {
+		kept[c] = true
+	}
+	p.scratch = p.scratch[0:0]
+	for _, c := range all {
+		if !kept[c] {
+			p.scratch = append(p.scratch, c)
+		}
+	}
+	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
+}
+
+// filterLogic filters the candidate list for elements kept by all of its
+// filters or, if 'or' is true, by any of them. Each filter is applied to
+// the full candidate list.
+type filterLogic struct {
+	or      bool
+	filters []filter
+}
+
+func newFilterLogic(or bool, filters []filter) *filterLogic {
+	return &filterLogic{or, filters}
+}
+
+func (f *filterLogic) apply(p *pather) {
+	all := append([]*Element(nil), p.candidates...)
+	count := make(map[*Element]int, len(all))
+	for _, inner := range f.filters {
+		p.candidates = append(p.candidates[0:0], all...)
+		inner.apply(p)
+		for _, c := range p.candidates {
+			count[c]++
+		}
+	}
+	p.scratch = p.scratch[0:0]
+	for _, c := range all {
+		if n := count[c]; n == len(f.filters) || (f.or && n > 0) {
+			p.scratch = append(p.scratch, c)
+		}
+	}
+	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
+}
+
+// filterVar filters the candidate list using a value-comparison filter
+// whose value is provided by a variable at the time of the path query.
+type filterVar struct {
+	name      string
+	newFilter func(value string) filter
+}
+
+func newFilterVar(name string, newFilter func(value string) filter) *filterVar {
+	return &filterVar{name, newFilter}
+}
+
+func (f *filterVar) apply(p *pather) {
+	value, ok := p.vars[f.name]
+	if !ok {
+		p.candidates = p.candidates[0:0]
+		return
+	}
+	f.newFilter(value).apply(p)
+}
@@ -4,7 +4,11 @@
 
 package etree
 
-import "testing"
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
 
 var testXML = `
 <?xml version="1.0" encoding="UTF-8"?>
@@ -81,13 +85,28 @@ var tests = []test{
 	{"./bookstore/book[1]/title", "Everyday Italian"},
 	{"./bookstore/book[4]/title", "Learning XML"},
 	{"./bookstore/book[5]/title", nil},
-	{"./bookstore/book[3]/author[0]", "James McGovern"},
+	{"./bookstore/book[3]/author[0]", nil},
 	{"./bookstore/book[3]/author[1]", "James McGovern"},
 	{"./bookstore/book[3]/author[3]/./.", "Kurt Cagle"},
 	{"./bookstore/book[3]/author[6]", nil},
 	{"./bookstore/book[-1]/title", "Learning XML"},
 	{"./bookstore/book[-4]/title", "Everyday Italian"},
 	{"./bookstore/book[-5]/title", nil},
+	{"./bookstore/book[0]/title", nil},
+	{"./bookstore/book[-0]/title", nil},
+
+	// group queries
+	{"//author[1]", []string{"Giada De Laurentiis", "J K. Rowling", "James McGovern", "Erik T. Ray"}},
+	{"(//author)[1]", "Giada De Laurentiis"},
+	{"(//author)[3]", "James McGovern"},
+	{"(//author)[-1]", "Erik T. Ray"},
+	{"(//author)[9]", nil},
+	{"(//book)[2]/title", "Harry Potter"},
+	{"(//book[@category='WEB'])[1]/author[2]", "Per Bothner"},
+	{"(./bookstore/book/title)[@lang='en'][2]", "Harry Potter"},
+	{"(//title)", []string{"Everyday Italian", "Harry Potter", "XQuery Kick Start", "Learning XML"}},
+	{"(/bookstore)//p:price", []string{"30.00", "29.99", "39.95"}},
+	{"((//book)[2]/*)[1]", "Harry Potter"},
 
 	// text function queries
 	{"./bookstore/book[author='James McGovern']/title", "XQuery Kick Start"},
@@ -99,6 +118,9 @@ var tests = []test{
 	{"//book[price='29.99']/title", "Harry Potter"},
 	{"//book/price[text()='29.99']", "29.99"},
 	{"//book/author[text()='Kurt Cagle']", "Kurt Cagle"},
+	{"//book/author[.='Kurt Cagle']", "Kurt Cagle"},
+	{"//book/price[.=\"29.99\"]", "29.99"},
+	{"./bookstore/book/title[not(.='Harry Potter')]", []string{"Everyday Italian", "XQuery Kick Start", "Learning XML"}},
 	{"//book/editor[text()]", []string{"Clarkson Potter", "\n\t\t"}},
 
 	// namespace function queries
@@ -114,6 +136,16 @@ var tests = []test{
 	{"//price[name()='price']", []string{"49.99"}},
 	{"//price[local-name()='price']", []string{"30.00", "29.99", "49.99", "39.95"}},
 
+	// case-folding function queries
+	{"./bookstore/book[lower-case(@category)='web']/title", []string{"XQuery Kick Start", "Learning XML"}},
+	{"./bookstore/book[upper-case(@category)='cooking']/title", nil},
+	{"./bookstore/book[upper-case(@category)='COOKING']/title", "Everyday Italian"},
+	{"./bookstore/book[lower-case(upper-case(@category))='children']/title", "Harry Potter"},
+	{"//book/title[upper-case(text())='HARRY POTTER']", "Harry Potter"},
+	{"//*[upper-case(name())='P:PRICE']", []string{"30.00", "29.99", "39.95"}},
+	{"//p:price[lower-case(@p:tax)]", "29.99"},
+	{"//p:price[lower-case(@missing)]", nil},
+
 	// attribute queries
 	{"./bookstore/book[@category='WEB']/title", []string{"XQuery Kick Start", "Learning XML"}},
 	{"./bookstore/book[@path='/books/xml']/title", []string{"Learning XML"}},
@@ -126,6 +158,61 @@ var tests = []test{
 	{"//p:price[@p:tax]", []string{"29.99"}},
 	{"//p:price[@tax]", []string{"29.99"}},
 
+	// negated filter queries
+	{"./bookstore/book[not(@category='WEB')]/title", []string{"Everyday Italian", "Harry Potter"}},
+	{"./bookstore/book[not(@path)]/title", []string{"Everyday Italian", "Harry Potter", "XQuery Kick Start"}},
+	{"./bookstore/book[not(editor)]/title", "Learning XML"},
+	{"./bookstore/book[not(author='Per Bothner')]/title", []string{"Everyday Italian", "Harry Potter", "Learning XML"}},
+	{"./bookstore/book/title[not(text()='Harry Potter')]", []string{"Everyday Italian", "XQuery Kick Start", "Learning XML"}},
+	{"./bookstore/book[not(not(@path))]/title", "Learning XML"},
+	{"./bookstore/book[not(1)]/title", []string{"Harry Potter", "XQuery Kick Start", "Learning XML"}},
+	{"./bookstore/book[not(@category)]/title", nil},
+	{"//book[not(lower-case(@category)='web')][2]/title", "Harry Potter"},
+	{"./bookstore/book[@path or year='2005']/title", []string{"Everyday Italian", "Harry Potter", "Learning XML"}},
+	{"./bookstore/book[@category='WEB' and author='Per Bothner']/title", "XQuery Kick Start"},
+	{"./bookstore/book[(@path or author='Per Bothner') and year='2003']/title", []string{"XQuery Kick Start", "Learning XML"}},
+	{"./bookstore/book[@category='COOKING' or @category='WEB' and @path]/title", []string{"Everyday Italian", "Learning XML"}},
+	{"./bookstore/book[not(@path) and not(editor)]/title", nil},
+	{"./bookstore/book[not(@category='WEB') or not(editor)]/title", []string{"Everyday Italian", "Harry Potter", "Learning XML"}},
+	{"./bookstore/book[title='a or b' or @path]/title", "Learning XML"},
+
+	// regular expression queries
+	{"//book[@category~'R']/title", []string{"Harry Potter"}},
+	{"//book[@category~='O']/title", nil},
+	{"//book[@category~='C.*G']/title", "Everyday Italian"},
+	{"//book[@category~='WEB|COOKING']/title", []string{"Everyday Italian", "XQuery Kick Start", "Learning XML"}},
+	{"//book[@path~'^/books/']/title", "Learning XML"},
+	{"//p:price[.~'^29']", "29.99"},
+	{"//price[text()~='[0-9]+\\.99']", []string{"29.99", "49.99"}},
+	{"//book[author~'Bothner']/title", "XQuery Kick Start"},
+	{"//book[author~='Bothner']/title", nil},
+	{"//book[lower-case(@category)~='web']/title", []string{"XQuery Kick Start", "Learning XML"}},
+	{"//book[not(year~'^200[45]$')]/title", []string{"XQuery Kick Start", "Learning XML"}},
+	{"//book/title[@lang~\"=\"]", nil},
+
+	// sub-path queries
+	{"//book[.//author='Kurt Cagle']/title", "XQuery Kick Start"},
+	{"./bookstore[.//author='Kurt Cagle']/book[1]/title", "Everyday Italian"},
+	{"./bookstore[book/author='Kurt Cagle']/book[1]/title", "Everyday Italian"},
+	{"./bookstore[author='Kurt Cagle']", nil},
+	{"//book[./title[@sku]]/author", "J K. Rowling"},
+	{"//book[title[@lang='en']/../year='2003']/title", []string{"XQuery Kick Start", "Learning XML"}},
+	{"//book[not(.//p:price)]/title", "XQuery Kick Start"},
+	{"//book[.//author~'^James']/title", "XQuery Kick Start"},
+	{"//book[./author[2]]/title", "XQuery Kick Start"},
+	{"/bookstore[./book[@path='/books/xml']/title='Learning XML']/book[4]/year", "2003"},
+
+	// filters without a selector
+	{"//[@lang='en'][@sku]", "Harry Potter"},
+	{"./bookstore/book[3]//[1]", "XQuery Kick Start"},
+	{"./bookstore/book[4]/[@lang]", "Learning XML"},
+	{"//book[author='Erik T. Ray']//[@lang]", "Learning XML"},
+
+	// descendant-or-self queries
+	{"descendant-or-self::title[@sku]", "Harry Potter"},
+	{"./bookstore/book[3]/descendant-or-self::author[2]", "Per Bothner"},
+	{"./bookstore/descendant-or-self::p:price", []string{"30.00", "29.99", "39.95"}},
+
 	// parent queries
 	{"./bookstore/book[@category='COOKING']/title/../../book[4]/title", "Learning XML"},
 
@@ -133,13 +220,15 @@ var tests = []test{
 	{"/bookstore/book[1]/title", "Everyday Italian"},
 	{"/bookstore/book[4]/title", "Learning XML"},
 	{"/bookstore/book[5]/title", nil},
-	{"/bookstore/book[3]/author[0]", "James McGovern"},
+	{"/bookstore/book[3]/author[0]", nil},
 	{"/bookstore/book[3]/author[1]", "James McGovern"},
 	{"/bookstore/book[3]/author[3]/./.", "Kurt Cagle"},
 	{"/bookstore/book[3]/author[6]", nil},
 	{"/bookstore/book[-1]/title", "Learning XML"},
 	{"/bookstore/book[-4]/title", "Everyday Italian"},
 	{"/bookstore/book[-5]/title", nil},
+	{"/bookstore/book[0]/title", nil},
+	{"/bookstore/book[-0]/title", nil},
 
 	// bad paths
 	{"./bookstore/book[]", errorResult("etree: path contains an empty filter expression.")},
@@ -149,6 +238,21 @@ var tests = []test{
 	{`./bookstore/book[@category="WEB']`, errorResult("etree: path has mismatched filter quotes.")},
 	{"./bookstore/book[author]a", errorResult("etree: path has invalid filter [brackets].")},
 	{"/][", errorResult("etree: path has invalid filter [brackets].")},
+	{"//book[foo()='x']", errorResult("etree: path has unknown function foo")},
+	{"(//book[1]", errorResult("etree: path has mismatched group (parentheses).")},
+	{"(//book)title", errorResult("etree: path has invalid group (parentheses).")},
+	{"(//book)[1", errorResult("etree: path has invalid filter [brackets].")},
+	{"//book[not()]", errorResult("etree: path contains an empty filter expression.")},
+	{"//book[not(@category='WEB)]", errorResult("etree: path has mismatched filter quotes.")},
+	{"//book[foo(@category)='x']", errorResult("etree: path has unknown function foo")},
+	{"//book[lower-case(category)='x']", errorResult("etree: path has invalid function argument category")},
+	{"//book[@category~'(']", errorResult("etree: path has invalid regular expression '(': error parsing regexp: missing closing ): `(`")},
+	{"//book[@category~'WEB]", errorResult("etree: path has mismatched filter quotes.")},
+	{"//book[@category~WEB]", errorResult("etree: path has invalid filter expression.")},
+	{"//book[~'WEB']", errorResult("etree: path has invalid filter expression.")},
+	{"//book[./author[1]", errorResult("etree: path has invalid filter [brackets].")},
+	{"//book[./author[foo()='x']]", errorResult("etree: path has unknown function foo")},
+	{"//book[./author='x]", errorResult("etree: path has mismatched filter quotes.")},
 }
 
 func TestPath(t *testing.T) {
@@ -224,3 +328,648 @@ func TestAbsolutePath(t *testing.T) {
 		}
 	}
 }
+
+func TestFindChecked(t *testing.T) {
+	doc := newDocumentFromString(t, testXML)
+
+	e, err := doc.FindElementChecked("//book[@category='WEB']/title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, e.Text(), "XQuery Kick Start")
+
+	e, err = doc.FindElementChecked("//missing")
+	if e != nil || err != nil {
+		t.Error("etree: FindElementChecked returned a result for a missing element")
+	}
+
+	es, err := doc.FindElementsChecked("//book[@category='WEB']/title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIntEq(t, len(es), 2)
+
+	e, err = doc.FindElementChecked("//book[@category='WEB")
+	if e != nil || err == nil {
+		t.Error("etree: FindElementChecked accepted an invalid path")
+	} else if _, ok := err.(ErrPath); !ok {
+		t.Errorf("etree: FindElementChecked returned unexpected error type %T", err)
+	}
+
+	es, err = doc.FindElementsChecked("//book[foo()]")
+	if es != nil || err == nil {
+		t.Error("etree: FindElementsChecked accepted an invalid path")
+	} else {
+		checkStrEq(t, err.Error(), "etree: path has unknown function foo")
+	}
+}
+
+func TestFindFromRoot(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if e := doc.FindElement("book"); e != nil {
+		t.Errorf("etree: relative document path unexpectedly matched")
+	}
+	if e := doc.FindElement("bookstore"); e != doc.Root() {
+		t.Errorf("etree: relative document path failed to match root")
+	}
+
+	books := doc.FindElementsFromRoot("book")
+	if len(books) != 4 {
+		t.Errorf("etree: FindElementsFromRoot returned %d elements", len(books))
+	}
+
+	title := doc.FindElementFromRoot("book[2]/title")
+	if title == nil || title.Text() != "Harry Potter" {
+		t.Errorf("etree: FindElementFromRoot failed")
+	}
+
+	title = doc.FindElementFromRoot("/bookstore/book[1]/title")
+	if title == nil || title.Text() != "Everyday Italian" {
+		t.Errorf("etree: FindElementFromRoot absolute path failed")
+	}
+
+	empty := NewDocument()
+	if empty.FindElementFromRoot("book") != nil || empty.FindElementsFromRoot("book") != nil {
+		t.Errorf("etree: FindElementFromRoot on empty document failed")
+	}
+}
+
+func TestRegisterPathFunc(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RegisterPathFunc("era", func(e *Element) string {
+		year := e.SelectElement("year")
+		if year == nil {
+			return ""
+		}
+		if n, err := strconv.Atoi(year.Text()); err == nil && n >= 2005 {
+			return "recent"
+		}
+		return "older"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RegisterPathFunc("era", nil)
+
+	titles := doc.FindElements("//book[era()='recent']/title")
+	if len(titles) != 2 || titles[0].Text() != "Everyday Italian" || titles[1].Text() != "Harry Potter" {
+		t.Errorf("etree: registered path function failed")
+	}
+	titles = doc.FindElements("//book[upper-case(era())='OLDER']/title")
+	if len(titles) != 2 || titles[0].Text() != "XQuery Kick Start" {
+		t.Errorf("etree: registered path function failed")
+	}
+	if len(doc.FindElements("//*[era()]")) != 4 {
+		t.Errorf("etree: registered path function failed")
+	}
+
+	for _, name := range []string{"text", "name", "lower-case", "not"} {
+		if err := RegisterPathFunc(name, (*Element).Text); err == nil {
+			t.Errorf("etree: redefined built-in path function %s", name)
+		}
+	}
+	for _, name := range []string{"", "bad()", "a b", "x='y'"} {
+		if err := RegisterPathFunc(name, (*Element).Text); err == nil {
+			t.Errorf("etree: registered invalid path function name %q", name)
+		}
+	}
+
+	RegisterPathFunc("era", nil)
+	_, err = CompilePath("//book[era()='recent']")
+	if err == nil || err.Error() != "etree: path has unknown function era" {
+		t.Errorf("etree: unregistered path function still available")
+	}
+}
+
+func TestPathVars(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Error(err)
+	}
+
+	path := MustCompilePath("//book[@category=$cat]/title")
+	titles := doc.FindElementsPathVars(path, map[string]string{"cat": "WEB"})
+	if len(titles) != 2 || titles[0].Text() != "XQuery Kick Start" || titles[1].Text() != "Learning XML" {
+		t.Errorf("etree: variable attribute filter failed")
+	}
+	title := doc.FindElementPathVars(path, map[string]string{"cat": "CHILDREN"})
+	if title == nil || title.Text() != "Harry Potter" {
+		t.Errorf("etree: variable attribute filter failed")
+	}
+	if doc.FindElementPathVars(path, nil) != nil {
+		t.Errorf("etree: unbound variable unexpectedly matched")
+	}
+
+	path = MustCompilePath("(//book[author=$author])[1]/title[text()=$title]")
+	vars := map[string]string{"author": "Per Bothner", "title": "XQuery Kick Start"}
+	title = doc.FindElementPathVars(path, vars)
+	if title == nil || title.Text() != "XQuery Kick Start" {
+		t.Errorf("etree: variable child and function filters failed")
+	}
+	vars["title"] = "Learning XML"
+	if doc.FindElementPathVars(path, vars) != nil {
+		t.Errorf("etree: variable function filter unexpectedly matched")
+	}
+
+	// A value containing quotes or brackets is matched literally.
+	doc2 := NewDocument()
+	doc2.CreateElement("a").CreateAttr("v", `x']"[y`)
+	path = MustCompilePath("//a[@v=$v]")
+	if doc2.FindElementPathVars(path, map[string]string{"v": `x']"[y`}) == nil {
+		t.Errorf("etree: variable containing quotes failed to match")
+	}
+
+	for _, bad := range []string{"//a[@v=$]", "//a[@v=$x y]", "//a[@v=$x)]", "//a[bad()=$x]"} {
+		if _, err := CompilePath(bad); err == nil {
+			t.Errorf("etree: invalid variable path %s compiled", bad)
+		}
+	}
+}
+
+func TestFindAncestor(t *testing.T) {
+	s := `<config>
+	<default name="global"/>
+	<group>
+		<default name="group"/>
+		<item id="1"><default name="item"/></item>
+		<item id="2"/>
+	</group>
+	<other><item id="3"/></other>
+</config>`
+
+	doc := NewDocument()
+	if err := doc.ReadFromString(s); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id, name string
+	}{
+		{"1", "item"},
+		{"2", "group"},
+		{"3", "global"},
+	}
+	for _, test := range tests {
+		item := doc.FindElement("//item[@id='" + test.id + "']")
+		d := item.FindAncestor("default")
+		if d == nil || d.SelectAttrValue("name", "") != test.name {
+			t.Errorf("etree: FindAncestor failed for item %s", test.id)
+		}
+	}
+
+	item := doc.FindElement("//item[@id='3']")
+	if item.FindAncestor("missing") != nil {
+		t.Errorf("etree: FindAncestor unexpectedly found an element")
+	}
+	if e := item.FindAncestor("group/item[2]"); e == nil || e.SelectAttrValue("id", "") != "2" {
+		t.Errorf("etree: FindAncestor failed to evaluate a multi-segment path")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><list><item id="1" active="true"/><item id="2"/><other/></list></root>`)
+	item1 := doc.FindElement("//item[@id='1']")
+	item2 := doc.FindElement("//item[@id='2']")
+	other := doc.FindElement("//other")
+
+	tests := []struct {
+		e        *Element
+		path     string
+		expected bool
+	}{
+		{item1, "//item[@active]", true},
+		{item2, "//item[@active]", false},
+		{item1, "item[@active]", true},
+		{item1, "list/item", true},
+		{item1, "/root/list/item[1]", true},
+		{item2, "/root/list/item[1]", false},
+		{item2, "item[-1]", true},
+		{other, "item", false},
+		{other, "//*", true},
+		{other, ".", true},
+		{other, "..", false},
+		{doc.Root(), "/root", true},
+		{doc.Root(), "list", false},
+		{NewElement("orphan"), "orphan", false},
+		{NewElement("orphan"), "descendant-or-self::orphan", true},
+	}
+	for _, test := range tests {
+		if got := test.e.Matches(test.path); got != test.expected {
+			t.Errorf("etree: %s.Matches(%q) returned %v, wanted %v", test.e.Tag, test.path, got, test.expected)
+		}
+	}
+}
+
+func TestMatchesAgreesWithFind(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a id="1"><b><a id="2"><c/></a></b><c/><c x="y"/></a><d><a id="3"/><b/></d></root>`)
+	paths := []string{
+		"a", "//a", "//a[@id]", "//a[2]", "a[1]", "//c[-1]", "./b/a",
+		"a//c", "//b//c", "b/..", "a/b/../c", "//c/../..", "(//a | //b)[1]",
+		"/root/a/c", "/root//a", "descendant-or-self::a", "descendant-or-self::c[2]",
+		"//*[c]", "*/*", "//a[not(@id='1')]", "../c", ".//a/c",
+	}
+
+	// The element matches if a search from it or an ancestor finds it.
+	find := func(e *Element, path Path) bool {
+		for a := e; a != nil; a = a.parent {
+			for _, f := range a.FindElementsPath(path) {
+				if f == e {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for _, s := range paths {
+		for _, depth := range []int{0, 1, 2} {
+			path := MustCompilePath(s).WithMaxDepth(depth)
+			for _, e := range doc.FindElements("//*") {
+				if got, want := e.MatchesPath(path), find(e, path); got != want {
+					t.Errorf("etree: %s.MatchesPath(%q) with depth %d returned %v, wanted %v", e.GetPath(), s, depth, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestDescendantOrSelf(t *testing.T) {
+	doc := newDocumentFromString(t, `<title id="1"><a><title id="2"/></a><title id="3"/></title>`)
+	root := doc.Root()
+
+	var ids []string
+	for _, e := range root.FindElements(".//title") {
+		ids = append(ids, e.SelectAttrValue("id", ""))
+	}
+	checkStrEq(t, strings.Join(ids, ","), "3,2")
+
+	ids = ids[:0]
+	for _, e := range root.FindElements("descendant-or-self::title") {
+		ids = append(ids, e.SelectAttrValue("id", ""))
+	}
+	checkStrEq(t, strings.Join(ids, ","), "1,3,2")
+
+	checkIntEq(t, len(root.FindElements(".//[@id]")), 2)
+	checkIntEq(t, len(root.FindElements("descendant-or-self::*[@id]")), 3)
+	checkIntEq(t, len(root.FindElements("descendant-or-self::*")), 4)
+	checkIntEq(t, len(root.FindElements("descendant-or-self::a/title")), 1)
+	checkIntEq(t, len(root.FindElements("a/descendant-or-self::title")), 1)
+}
+
+func TestPathMaxDepth(t *testing.T) {
+	doc := newDocumentFromString(t,
+		`<root><item id="1"><x><item id="3"><item id="4"/></item></x></item><y><item id="2"/></y></root>`)
+	root := doc.Root()
+
+	ids := func(elements []*Element) string {
+		var list []string
+		for _, e := range elements {
+			list = append(list, e.SelectAttrValue("id", ""))
+		}
+		return strings.Join(list, ",")
+	}
+
+	tests := []struct {
+		path     string
+		depth    int
+		expected string
+	}{
+		{".//item", 0, "1,2,3,4"},
+		{".//item", 1, "1"},
+		{".//item", 2, "1,2"},
+		{".//item", 3, "1,2,3"},
+		{".//item", 4, "1,2,3,4"},
+		{".//item", -1, "1,2,3,4"},
+		{"item//item", 2, "3"},
+		{"descendant-or-self::item", 2, "1,2"},
+		{"item/descendant-or-self::*[@id]", 2, "1,3"},
+		{"(.//item)[-1]", 2, "2"},
+	}
+	for _, test := range tests {
+		p := MustCompilePath(test.path)
+		got := ids(root.FindElementsPath(p.WithMaxDepth(test.depth)))
+		if got != test.expected {
+			t.Errorf("etree: path %s at depth %d found %q, wanted %q", test.path, test.depth, got, test.expected)
+		}
+	}
+
+	// The original path is not modified.
+	p := MustCompilePath(".//item")
+	p.WithMaxDepth(1)
+	checkStrEq(t, ids(root.FindElementsPath(p)), "1,2,3,4")
+}
+
+func TestPathWhitespace(t *testing.T) {
+	doc := newDocumentFromString(t, `<store><book lang="en"><title>A  B</title></book><book lang="fr"><title>C</title></book></store>`)
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"//book[@lang='en']/title", "A  B"},
+		{"  //book [ @lang = 'en' ] / title  ", "A  B"},
+		{"//book[\n\t@lang = 'en'\n]\r\n\t/title", "A  B"},
+		{"//title[ . = 'A  B' ]", "A  B"},
+		{"//title[ text() = \"A  B\" ]", "A  B"},
+		{"//title[.='A B']", ""},
+		{"( //book )[ 2 ] / title", "C"},
+		{"//book[ not( @lang = 'en' ) ]/title", "C"},
+		{"descendant-or-self:: book[\n  title ~ 'C'\n]/title", "C"},
+	}
+	for _, test := range tests {
+		p, err := CompilePath(test.path)
+		if err != nil {
+			t.Errorf("etree: failed to compile path %q: %v", test.path, err)
+			continue
+		}
+		var got string
+		if e := doc.Root().FindElementPath(p); e != nil {
+			got = e.Text()
+		}
+		if got != test.expected {
+			t.Errorf("etree: path %q found %q, wanted %q", test.path, got, test.expected)
+		}
+	}
+
+	checkStrEq(t, trimPathSpace("a b / c"), "a b/c")
+}
+
+func TestPathLogic(t *testing.T) {
+	doc := newDocumentFromString(t, `<r><a x="1"/><a y="1"/><a/><or/></r>`)
+
+	tests := []struct {
+		path  string
+		count int
+	}{
+		{"//a[@x or @y]", 2},
+		{"//a[not(@x or @y)]", 1},
+		{"//a[@x and @y]", 0},
+		{"//a[not(@x and @y)]", 3},
+		{"//a[ @x or ( @y ) ]", 2},
+		{"//r[or]", 1},
+	}
+	for _, test := range tests {
+		p, err := CompilePath(test.path)
+		if err != nil {
+			t.Errorf("etree: failed to compile path %q: %v", test.path, err)
+			continue
+		}
+		checkIntEq(t, len(doc.FindElementsPath(p)), test.count)
+	}
+
+	if _, err := CompilePath("//a[@x or ]"); err == nil {
+		t.Error("etree: expected an error compiling an incomplete or filter")
+	}
+}
+
+func TestFindTokens(t *testing.T) {
+	doc := newDocumentFromString(t, `<?xml version="1.0"?>
+<?xml-stylesheet href="a.xsl"?>
+<!--top-->
+<root>
+	<!--c1-->
+	<a>text<?xml-stylesheet href="b.xsl"?><?other x?><!--c2--></a>
+	<b><!--c3--></b>
+</root>`)
+
+	tokenStrings := func(tokens []Token) string {
+		var list []string
+		for _, t := range tokens {
+			switch t := t.(type) {
+			case *Comment:
+				list = append(list, "comment:"+t.Data)
+			case *ProcInst:
+				list = append(list, "pi:"+t.Target)
+			case *CharData:
+				if !t.IsWhitespace() {
+					list = append(list, "text:"+t.Data)
+				}
+			case *Element:
+				list = append(list, "element:"+t.Tag)
+			}
+		}
+		return strings.Join(list, ",")
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"//comment()", "comment:top,comment:c1,comment:c2,comment:c3"},
+		{"/comment()", "comment:top"},
+		{"/root/comment()", "comment:c1"},
+		{"root/a/comment()", "comment:c2"},
+		{"//a/processing-instruction()", "pi:xml-stylesheet,pi:other"},
+		{"//processing-instruction('xml-stylesheet')", "pi:xml-stylesheet,pi:xml-stylesheet"},
+		{`/processing-instruction("xml-stylesheet")`, "pi:xml-stylesheet"},
+		{"//a/text()", "text:text"},
+		{"/root/a/node()", "text:text,pi:xml-stylesheet,pi:other,comment:c2"},
+		{"/root/node()", "comment:c1,element:a,element:b"},
+		{"(//b)/comment()", "comment:c3"},
+		{"//missing/comment()", ""},
+	}
+	for _, test := range tests {
+		checkStrEq(t, tokenStrings(doc.FindTokens(test.path)), test.expected)
+	}
+
+	// Relative node tests apply to the context element's children.
+	a := doc.FindElement("//a")
+	checkStrEq(t, tokenStrings(a.FindTokens("comment()")), "comment:c2")
+	checkStrEq(t, tokenStrings(a.FindTokens("./processing-instruction('other')")), "pi:other")
+
+	// Element queries find nothing for node test paths, and token queries
+	// find nothing for element paths.
+	checkIntEq(t, len(doc.FindElements("//comment()")), 0)
+	checkIntEq(t, len(doc.FindTokens("//a")), 0)
+
+	_, err := CompilePath("//processing-instruction(target)")
+	if err == nil || err.Error() != "etree: path has invalid node test processing-instruction(target)" {
+		t.Errorf("etree: unexpected error %v", err)
+	}
+	if _, err := CompilePath("comment()"); err != nil {
+		t.Errorf("etree: unexpected error %v", err)
+	}
+}
+
+func TestFindCharData(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><item>one<b/>two</item><item><!--c--></item><item>three</item></root>`)
+
+	var list []string
+	for _, cd := range doc.FindCharData("//item/text()") {
+		list = append(list, cd.Data)
+	}
+	checkStrEq(t, strings.Join(list, ","), "one,two,three")
+
+	// The returned tokens may be edited in place.
+	doc.FindCharData("/root/item[3]/text()")[0].SetData("THREE")
+	checkDocEq(t, doc, `<root><item>one<b/>two</item><item><!--c--></item><item>THREE</item></root>`)
+
+	// Node tests other than text() find no character data.
+	checkIntEq(t, len(doc.FindCharData("//item/comment()")), 0)
+	checkIntEq(t, len(doc.FindCharData("/root/item[1]/node()")), 2)
+	checkIntEq(t, len(doc.FindCharData("//item")), 0)
+}
+
+func TestFindElementsFrom(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a><x id="1"/><b><x id="2"/></b></a><c><x id="3"/></c></root>`)
+
+	ids := func(elements []*Element) string {
+		var list []string
+		for _, e := range elements {
+			list = append(list, e.SelectAttrValue("id", ""))
+		}
+		return strings.Join(list, ",")
+	}
+
+	starts := doc.FindElements("//root/*")
+	checkStrEq(t, ids(FindElementsFrom(starts, MustCompilePath(".//x"))), "1,2,3")
+
+	// Overlapping starting elements produce no duplicates.
+	starts = doc.FindElements("//*[x]")
+	checkIntEq(t, len(starts), 3)
+	checkStrEq(t, ids(FindElementsFrom(starts, MustCompilePath(".//x"))), "1,2,3")
+	checkStrEq(t, ids(FindElementsFrom(starts, MustCompilePath("x"))), "1,3,2")
+
+	checkIntEq(t, len(FindElementsFrom(nil, MustCompilePath(".//x"))), 0)
+}
+
+func TestPathCache(t *testing.T) {
+	c := pathCache{size: 2}
+	a, b, d := MustCompilePath("a"), MustCompilePath("b"), MustCompilePath("d")
+	c.put("a", a, 0)
+	c.put("b", b, 0)
+	if _, _, ok := c.get("a"); !ok {
+		t.Error("etree: expected cached path a")
+	}
+
+	// Adding a third path evicts the least recently used one (b).
+	c.put("d", d, 0)
+	if _, _, ok := c.get("b"); ok {
+		t.Error("etree: expected path b to be evicted")
+	}
+	if _, _, ok := c.get("a"); !ok {
+		t.Error("etree: expected cached path a")
+	}
+	if _, _, ok := c.get("d"); !ok {
+		t.Error("etree: expected cached path d")
+	}
+	checkIntEq(t, c.lru.Len(), 2)
+
+	c.clear()
+	_, gen, ok := c.get("a")
+	if ok {
+		t.Error("etree: expected empty cache")
+	}
+
+	// A path compiled before the cache was cleared is not stored.
+	c.put("a", a, gen-1)
+	if _, _, ok := c.get("a"); ok {
+		t.Error("etree: expected stale path a to be discarded")
+	}
+	c.put("a", a, gen)
+	if _, _, ok := c.get("a"); !ok {
+		t.Error("etree: expected cached path a")
+	}
+
+	// Re-registering a path function invalidates cached paths using it.
+	doc := newDocumentFromString(t, `<root><a/><b/></root>`)
+	RegisterPathFunc("cache-test", func(e *Element) string { return e.Tag })
+	defer RegisterPathFunc("cache-test", nil)
+	checkIntEq(t, len(doc.FindElements("/root/*[cache-test()='a']")), 1)
+	RegisterPathFunc("cache-test", func(e *Element) string { return "a" })
+	checkIntEq(t, len(doc.FindElements("/root/*[cache-test()='a']")), 2)
+}
+
+func TestAttrWildcardFilters(t *testing.T) {
+	doc := newDocumentFromString(t, `<root xmlns:a="urn:a" xmlns:b="urn:b">
+	<e n="1" id="x"/>
+	<e n="2" a:id="y"/>
+	<e n="3" b:id="z" xml:lang="en"/>
+	<e n="4" xml:space="preserve"/>
+	<e n="5"/>
+</root>`)
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"//e[@*:id]", "1,2,3"},
+		{"//e[@id]", "1,2,3"},
+		{"//e[@a:id]", "2"},
+		{"//e[@xml:*]", "3,4"},
+		{"//e[@*]", "1,2,3,4,5"},
+		{"//e[@*:*]", "1,2,3,4,5"},
+		{"//e[@*:id='z']", "3"},
+		{"//e[@xml:*='en']", "3"},
+		{"//e[@xml:*~'^pre']", "4"},
+		{"//e[not(@xml:*)]", "1,2,5"},
+		{"//e[upper-case(@*:id)='Y']", "2"},
+	}
+	for _, test := range tests {
+		var list []string
+		for _, e := range doc.FindElements(test.path) {
+			list = append(list, e.SelectAttrValue("n", ""))
+		}
+		checkStrEq(t, strings.Join(list, ","), test.expected)
+	}
+}
+
+func TestPathDescribe(t *testing.T) {
+	describe := func(info []SegmentInfo) string {
+		var list []string
+		for _, seg := range info {
+			s := seg.Selector
+			if seg.Name != "" {
+				s += "(" + seg.Name + ")"
+			}
+			if seg.Group != nil {
+				s += "{"
+				for i, g := range seg.Group {
+					if i > 0 {
+						s += ";"
+					}
+					s += g.Selector + "(" + g.Name + ")"
+				}
+				s += "}"
+			}
+			for _, f := range seg.Filters {
+				s += "[" + f.Kind + ":" + f.Expr + "]"
+			}
+			list = append(list, s)
+		}
+		return strings.Join(list, " ")
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/bookstore/book[1]/title", "root tag(bookstore) tag(book)[position:1] tag(title)"},
+		{"./..//*", "self parent descendants children"},
+		{".//p:price[@p:tax][not(@x)]", "self descendants tag(p:price)[attr:@p:tax][not:not(@x)]"},
+		{"book[@lang='en'][author~'^J'][title=$t]", "tag(book)[attr-value:@lang='en'][child-regexp:author~'^J'][variable:title=$t]"},
+		{"//[text()][.='x'][name()~='b.*']", "root descendants children[func:text()][func-value:.='x'][func-regexp:name()~='b.*']"},
+		{"a[b/c][b/c='x'][b/c~'y'][b]", "tag(a)[path:b/c][path-value:b/c='x'][path-regexp:b/c~'y'][child:b]"},
+		{"(//a)[2]/b", "group{root();descendants();tag(a)}[position:2] tag(b)"},
+		{"descendant-or-self::x/comment()", "descendant-or-self(x) node-test(comment())"},
+		{"text()", "node-test(text())"},
+	}
+	for _, test := range tests {
+		checkStrEq(t, describe(MustCompilePath(test.path).Describe()), test.expected)
+	}
+
+	doc := newDocumentFromString(t, `<a><b/><b/></a>`)
+	p := doc.FindElements("//b")[1].CompiledPath()
+	checkStrEq(t, describe(p.Describe()), "root tag(a)[position:1] tag(b)[position:2]")
+}